@@ -7,6 +7,11 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+	// Embedded so TIME_ZONE works in images without a zoneinfo database,
+	// such as scratch.
+	_ "time/tzdata"
 
 	"gopkg.in/yaml.v3"
 )
@@ -16,9 +21,34 @@ type Config struct {
 	// TelegramToken is the bot token provided by BotFather.
 	TelegramToken string
 
-	// ChatID is the Telegram group chat ID the bot posts to.
+	// ChatID is the default Telegram group chat ID the bot posts to. Alerts
+	// that match no entry in Routes are delivered here.
 	ChatID int64
 
+	// ThreadID is the optional forum topic (message_thread_id) within ChatID
+	// the bot posts to. Zero means the chat's General topic.
+	ThreadID int
+
+	// TelegramUpdates enables long polling of Telegram updates, needed for
+	// bot commands and the Ack / Close buttons (default true). Only one
+	// process per bot token may poll at a time.
+	TelegramUpdates bool
+
+	// Routes is the optional routing table used to deliver alerts to
+	// additional chats. Routes are evaluated in order.
+	Routes []Route
+
+	// Escalations is the optional list of escalation policies reposting
+	// problems that stay open and unacknowledged to further chats. The first
+	// matching policy applies.
+	Escalations []Escalation
+
+	// Templates holds optional Go text/template layouts of the alert
+	// messages, keyed by alert status ("problem", "resolved", "update") or
+	// "default" for the other statuses. Statuses without a template use the
+	// built-in layout.
+	Templates map[string]string
+
 	// ServerAddr is the address the HTTP server listens on (e.g. ":8080").
 	ServerAddr string
 
@@ -27,25 +57,242 @@ type Config struct {
 	ServerSecret string
 
 	// RedisAddr is the host:port of the Redis-compatible server used to persist
-	// event-to-message correlations. When empty the in-memory store is used.
+	// event-to-message correlations, or a redis:// or rediss:// URL. With
+	// RedisCluster it is a comma-separated list of seed nodes. When empty, and
+	// no Sentinels are configured, the in-memory store is used.
 	RedisAddr string
 
+	// RedisSentinelMaster is the name of the master monitored by the
+	// Sentinels at RedisSentinelAddrs, used instead of RedisAddr.
+	RedisSentinelMaster string
+	RedisSentinelAddrs  []string
+
+	// RedisCluster connects to a Redis Cluster through RedisAddr.
+	RedisCluster bool
+
+	// RedisUsername is the optional ACL user for the Redis servers.
+	RedisUsername string
+
 	// RedisPassword is the optional password for the Redis server.
 	RedisPassword string
 
+	// RedisSentinelUsername and RedisSentinelPassword are the optional
+	// credentials of the Sentinels, which do not share those of the Redis
+	// servers.
+	RedisSentinelUsername string
+	RedisSentinelPassword string
+
 	// RedisDB is the logical Redis database index (default 0).
 	RedisDB int
+
+	// RedisKeyPrefix namespaces the keys written to Redis
+	// (default "zbxtg:event:").
+	RedisKeyPrefix string
+
+	// RedisEntryTTL is the maximum age of a stored PROBLEM entry. Entries
+	// whose RESOLVED never arrives expire after it. Zero disables expiry.
+	RedisEntryTTL time.Duration
+
+	// RedisMigrateKeys moves entries stored under un-prefixed keys by older
+	// releases to RedisKeyPrefix at startup.
+	RedisMigrateKeys bool
+
+	// RedisTLS connects to Redis over TLS. RedisTLSCA is an optional PEM file
+	// of the CAs to trust instead of the system ones; RedisTLSCert and
+	// RedisTLSKey an optional client certificate. Setting any of the files
+	// implies RedisTLS.
+	RedisTLS     bool
+	RedisTLSCA   string
+	RedisTLSCert string
+	RedisTLSKey  string
+
+	// StorePath is the path of the embedded database file used to persist
+	// event-to-message correlations when no Redis server is configured.
+	// When both are empty the in-memory store is used.
+	StorePath string
+
+	// OutboxEnabled queues incoming alerts and answers 202 Accepted, leaving
+	// delivery to a background worker that retries failures. It defaults to
+	// true when Redis or StorePath keeps the queue across restarts. When
+	// false alerts are delivered before the webhook responds.
+	OutboxEnabled bool
+
+	// OutboxMaxAttempts is the number of delivery attempts after which a
+	// queued alert is moved to the dead-letter list (default 10).
+	OutboxMaxAttempts int
+
+	// OutboxConsumer names this process's claims on a Redis outbox shared by
+	// several processes. It must be stable across restarts (default: the
+	// host name).
+	OutboxConsumer string
+
+	// StormThreshold is the number of PROBLEMs within StormWindow above which
+	// further PROBLEMs are aggregated into a single digest message per chat
+	// instead of being posted one by one. Zero disables aggregation.
+	StormThreshold int
+
+	// StormWindow is the sliding window PROBLEM arrivals are counted over
+	// (default 1m).
+	StormWindow time.Duration
+
+	// StormDigestInterval is the minimum time between two edits of a digest
+	// message (default 10s).
+	StormDigestInterval time.Duration
+
+	// FlapThreshold is the number of state changes of one trigger within
+	// FlapWindow above which the trigger is collapsed into a single message
+	// with a transition counter. Zero disables flap detection.
+	FlapThreshold int
+
+	// FlapWindow is the sliding window trigger transitions are counted over
+	// (default 30m). A trigger stops flapping after a whole window without
+	// transitions.
+	FlapWindow time.Duration
+
+	// ReminderIntervals maps a severity name to the interval between "still
+	// open" reminders for its unacknowledged problems; the "default" key
+	// applies to the other severities. Empty disables reminders.
+	ReminderIntervals map[string]time.Duration
+
+	// ReminderMax caps the number of reminders per problem (default 3).
+	ReminderMax int
+
+	// TimeZone is the time zone timestamps are shown in (default: the
+	// server's local zone).
+	TimeZone *time.Location
+
+	// TimeLayout is the Go layout timestamps are shown with (default
+	// "2006-01-02 15:04:05 MST").
+	TimeLayout string
+
+	// Language is the language of the message labels and of the status and
+	// severity names, e.g. "it" (default "en").
+	Language string
+
+	// DetailsDocument makes alerts whose Details are too long for a Telegram
+	// message get the full Details as a .txt document reply.
+	DetailsDocument bool
+
+	// ZabbixAPIURL is the Zabbix API endpoint (…/api_jsonrpc.php). When set,
+	// PROBLEM messages get "Ack" / "Close" buttons that call back into Zabbix.
+	ZabbixAPIURL string
+
+	// ZabbixAPIToken is the Zabbix API token used to authenticate API calls.
+	ZabbixAPIToken string
+}
+
+// Route sends alerts matching all of its non-empty criteria to one or more
+// Telegram chats.
+type Route struct {
+	// Name is an optional label used in error messages.
+	Name string `yaml:"name"`
+
+	// Severities lists the alert severities the route applies to. Matching is
+	// case-insensitive. When empty, every severity matches.
+	Severities []string `yaml:"severities"`
+
+	// Host is a shell-style glob (e.g. "db-*") matched against the host name.
+	Host string `yaml:"host"`
+
+	// HostRegex is a regular expression matched against the host name.
+	HostRegex string `yaml:"host_regex"`
+
+	// Trigger is a regular expression matched against the trigger name.
+	Trigger string `yaml:"trigger"`
+
+	// Destinations lists the chats matching alerts are sent to.
+	Destinations []Destination `yaml:"destinations"`
+
+	// Templates overrides the message templates for the chats of this route,
+	// keyed like Config.Templates.
+	Templates map[string]string `yaml:"templates"`
+
+	// Language overrides the language of the message labels for the chats
+	// of this route, e.g. "it".
+	Language string `yaml:"language"`
+
+	// Continue makes evaluation carry on with the following routes after this
+	// one matched. By default the first matching route wins.
+	Continue bool `yaml:"continue"`
+}
+
+// Escalation reposts the problems matching all of its non-empty criteria to
+// further chats, step by step, while they remain open and unacknowledged.
+type Escalation struct {
+	// Name is an optional label used in error messages.
+	Name string `yaml:"name"`
+
+	// Severities lists the alert severities the policy applies to. Matching
+	// is case-insensitive. When empty, every severity matches.
+	Severities []string `yaml:"severities"`
+
+	// HostGroups lists shell-style globs (e.g. "Databases/*") matched against
+	// the host groups of the alert; one match is enough. When empty, every
+	// host group matches.
+	HostGroups []string `yaml:"host_groups"`
+
+	// Steps lists the escalation steps in order of increasing delay.
+	Steps []EscalationStep `yaml:"steps"`
+}
+
+// EscalationStep reposts a problem to Destinations once it has been open for
+// After.
+type EscalationStep struct {
+	After        time.Duration `yaml:"after"`
+	Destinations []Destination `yaml:"destinations"`
+}
+
+// Destination identifies a Telegram chat, and optionally a forum topic
+// within it, an alert is delivered to.
+type Destination struct {
+	ChatID   int64 `yaml:"chat_id"`
+	ThreadID int   `yaml:"message_thread_id"`
 }
 
 // fileConfig mirrors the YAML structure of the optional config file.
 type fileConfig struct {
-	TelegramToken string `yaml:"telegram_bot_token"`
-	ChatID        string `yaml:"telegram_chat_id"`
-	ServerAddr    string `yaml:"server_addr"`
-	ServerSecret  string `yaml:"server_secret"`
-	RedisAddr     string `yaml:"redis_addr"`
-	RedisPassword string `yaml:"redis_password"`
-	RedisDB       string `yaml:"redis_db"`
+	TelegramToken         string            `yaml:"telegram_bot_token"`
+	ChatID                string            `yaml:"telegram_chat_id"`
+	ThreadID              string            `yaml:"telegram_thread_id"`
+	Updates               string            `yaml:"telegram_updates"`
+	ServerAddr            string            `yaml:"server_addr"`
+	ServerSecret          string            `yaml:"server_secret"`
+	RedisAddr             string            `yaml:"redis_addr"`
+	RedisSentinelMaster   string            `yaml:"redis_sentinel_master"`
+	RedisSentinelAddrs    string            `yaml:"redis_sentinel_addrs"`
+	RedisSentinelUsername string            `yaml:"redis_sentinel_username"`
+	RedisSentinelPassword string            `yaml:"redis_sentinel_password"`
+	RedisCluster          string            `yaml:"redis_cluster"`
+	RedisUsername         string            `yaml:"redis_username"`
+	RedisPassword         string            `yaml:"redis_password"`
+	RedisDB               string            `yaml:"redis_db"`
+	RedisKeyPrefix        string            `yaml:"redis_key_prefix"`
+	RedisEntryTTL         string            `yaml:"redis_entry_ttl"`
+	RedisMigrateKeys      string            `yaml:"redis_migrate_keys"`
+	RedisTLS              string            `yaml:"redis_tls"`
+	RedisTLSCA            string            `yaml:"redis_tls_ca_file"`
+	RedisTLSCert          string            `yaml:"redis_tls_cert_file"`
+	RedisTLSKey           string            `yaml:"redis_tls_key_file"`
+	StorePath             string            `yaml:"store_path"`
+	OutboxEnabled         string            `yaml:"outbox_enabled"`
+	OutboxMaxAttempts     string            `yaml:"outbox_max_attempts"`
+	OutboxConsumer        string            `yaml:"outbox_consumer"`
+	StormThreshold        string            `yaml:"storm_threshold"`
+	StormWindow           string            `yaml:"storm_window"`
+	StormDigestInterval   string            `yaml:"storm_digest_interval"`
+	FlapThreshold         string            `yaml:"flap_threshold"`
+	FlapWindow            string            `yaml:"flap_window"`
+	ReminderIntervals     string            `yaml:"reminder_intervals"`
+	ReminderMax           string            `yaml:"reminder_max"`
+	TimeZone              string            `yaml:"time_zone"`
+	TimeLayout            string            `yaml:"time_layout"`
+	Language              string            `yaml:"message_language"`
+	DetailsDocument       string            `yaml:"details_document"`
+	ZabbixAPIURL          string            `yaml:"zabbix_api_url"`
+	ZabbixAPIToken        string            `yaml:"zabbix_api_token"`
+	Routes                []Route           `yaml:"routes"`
+	Escalations           []Escalation      `yaml:"escalations"`
+	Templates             map[string]string `yaml:"templates"`
 }
 
 // Load reads configuration from an optional YAML file and environment variables.
@@ -58,11 +305,44 @@ type fileConfig struct {
 // Environment variables:
 //   - TELEGRAM_BOT_TOKEN (required if not set in the file)
 //   - TELEGRAM_CHAT_ID   (required if not set in the file, numeric)
+//   - TELEGRAM_THREAD_ID (optional, forum topic ID within the chat)
+//   - TELEGRAM_UPDATES   (optional, boolean, default true; polls for commands and button presses)
 //   - SERVER_ADDR        (optional, default ":8080")
 //   - SERVER_SECRET      (optional, shared secret for incoming requests)
-//   - REDIS_ADDR         (optional, host:port of Redis server; uses in-memory store when absent)
+//   - REDIS_ADDR         (optional, host:port or redis:// / rediss:// URL of Redis server; uses in-memory store when absent)
+//   - REDIS_SENTINEL_MASTER (optional, master name, with REDIS_SENTINEL_ADDRS instead of REDIS_ADDR)
+//   - REDIS_SENTINEL_ADDRS (optional, comma-separated host:port of the Sentinels)
+//   - REDIS_SENTINEL_USERNAME (optional, ACL user for the Sentinels)
+//   - REDIS_SENTINEL_PASSWORD (optional, password for the Sentinels)
+//   - REDIS_CLUSTER      (optional, boolean; REDIS_ADDR lists seed nodes of a Redis Cluster)
+//   - REDIS_USERNAME     (optional, Redis ACL user)
 //   - REDIS_PASSWORD     (optional, Redis server password)
 //   - REDIS_DB           (optional, Redis database index, default 0)
+//   - REDIS_KEY_PREFIX   (optional, key namespace, default "zbxtg:event:")
+//   - REDIS_ENTRY_TTL    (optional, maximum entry age as a Go duration, e.g. "168h")
+//   - REDIS_MIGRATE_KEYS (optional, boolean, migrate un-prefixed keys at startup)
+//   - REDIS_TLS          (optional, boolean, connect to Redis over TLS)
+//   - REDIS_TLS_CA_FILE, REDIS_TLS_CERT_FILE, REDIS_TLS_KEY_FILE (optional, PEM files; imply REDIS_TLS)
+//   - STORE_PATH         (optional, database file for persistence without Redis)
+//   - OUTBOX_ENABLED     (optional, boolean, default true with Redis or STORE_PATH; queue alerts and answer 202)
+//   - OUTBOX_MAX_ATTEMPTS (optional, delivery attempts before dead-lettering, default 10)
+//   - OUTBOX_CONSUMER    (optional, stable name of this process on a shared Redis outbox)
+//   - STORM_THRESHOLD    (optional, PROBLEMs per window before aggregating into a digest, 0 disables)
+//   - STORM_WINDOW       (optional, window of STORM_THRESHOLD as a Go duration, default "1m")
+//   - STORM_DIGEST_INTERVAL (optional, minimum time between digest edits, default "10s")
+//   - FLAP_THRESHOLD     (optional, transitions per window before a trigger is collapsed, 0 disables)
+//   - FLAP_WINDOW        (optional, window of FLAP_THRESHOLD as a Go duration, default "30m")
+//   - REMINDER_INTERVALS (optional, e.g. "Disaster=30m,High=1h,default=4h"; empty disables reminders)
+//   - REMINDER_MAX       (optional, reminders per problem, default 3)
+//   - TIME_ZONE          (optional, IANA time zone of displayed timestamps, e.g. "Europe/Rome"; default local)
+//   - TIME_LAYOUT        (optional, Go layout of displayed timestamps, default "2006-01-02 15:04:05 MST")
+//   - MESSAGE_LANGUAGE   (optional, language of the message labels: en, it or de; default "en")
+//   - DETAILS_DOCUMENT   (optional, boolean; send Details too long for a message as a .txt reply)
+//   - ZABBIX_API_URL     (optional, enables the Ack / Close buttons)
+//   - ZABBIX_API_TOKEN   (required with ZABBIX_API_URL, Zabbix API token)
+//
+// The routing table (routes) and the escalation policies (escalations) can
+// only be set in the YAML file.
 func Load() (*Config, error) {
 	fc, err := loadFile()
 	if err != nil {
@@ -89,6 +369,30 @@ func Load() (*Config, error) {
 		return nil, errors.New("TELEGRAM_CHAT_ID must be a valid integer")
 	}
 
+	threadIDStr := os.Getenv("TELEGRAM_THREAD_ID")
+	if threadIDStr == "" {
+		threadIDStr = fc.ThreadID
+	}
+	threadID := 0
+	if threadIDStr != "" {
+		threadID, err = strconv.Atoi(threadIDStr)
+		if err != nil {
+			return nil, errors.New("TELEGRAM_THREAD_ID must be a valid integer")
+		}
+	}
+
+	updatesStr := os.Getenv("TELEGRAM_UPDATES")
+	if updatesStr == "" {
+		updatesStr = fc.Updates
+	}
+	updates := true
+	if updatesStr != "" {
+		updates, err = strconv.ParseBool(updatesStr)
+		if err != nil {
+			return nil, errors.New("TELEGRAM_UPDATES must be a boolean")
+		}
+	}
+
 	addr := os.Getenv("SERVER_ADDR")
 	if addr == "" {
 		addr = fc.ServerAddr
@@ -107,11 +411,61 @@ func Load() (*Config, error) {
 		redisAddr = fc.RedisAddr
 	}
 
+	sentinelMaster := os.Getenv("REDIS_SENTINEL_MASTER")
+	if sentinelMaster == "" {
+		sentinelMaster = fc.RedisSentinelMaster
+	}
+
+	sentinelAddrsStr := os.Getenv("REDIS_SENTINEL_ADDRS")
+	if sentinelAddrsStr == "" {
+		sentinelAddrsStr = fc.RedisSentinelAddrs
+	}
+	sentinelAddrs := splitList(sentinelAddrsStr)
+	if (sentinelMaster == "") != (len(sentinelAddrs) == 0) {
+		return nil, errors.New("REDIS_SENTINEL_MASTER and REDIS_SENTINEL_ADDRS must be set together")
+	}
+	if sentinelMaster != "" && redisAddr != "" {
+		return nil, errors.New("REDIS_ADDR cannot be combined with REDIS_SENTINEL_ADDRS")
+	}
+
+	redisClusterStr := os.Getenv("REDIS_CLUSTER")
+	if redisClusterStr == "" {
+		redisClusterStr = fc.RedisCluster
+	}
+	redisCluster := false
+	if redisClusterStr != "" {
+		redisCluster, err = strconv.ParseBool(redisClusterStr)
+		if err != nil {
+			return nil, errors.New("REDIS_CLUSTER must be a boolean")
+		}
+	}
+	if redisCluster && redisAddr == "" {
+		return nil, errors.New("REDIS_CLUSTER requires the seed nodes in REDIS_ADDR")
+	}
+
+	redisUsername := os.Getenv("REDIS_USERNAME")
+	if redisUsername == "" {
+		redisUsername = fc.RedisUsername
+	}
+
 	redisPassword := os.Getenv("REDIS_PASSWORD")
 	if redisPassword == "" {
 		redisPassword = fc.RedisPassword
 	}
 
+	sentinelUsername := os.Getenv("REDIS_SENTINEL_USERNAME")
+	if sentinelUsername == "" {
+		sentinelUsername = fc.RedisSentinelUsername
+	}
+
+	sentinelPassword := os.Getenv("REDIS_SENTINEL_PASSWORD")
+	if sentinelPassword == "" {
+		sentinelPassword = fc.RedisSentinelPassword
+	}
+	if (sentinelUsername != "" || sentinelPassword != "") && sentinelMaster == "" {
+		return nil, errors.New("REDIS_SENTINEL_USERNAME and REDIS_SENTINEL_PASSWORD require REDIS_SENTINEL_MASTER")
+	}
+
 	redisDBStr := os.Getenv("REDIS_DB")
 	if redisDBStr == "" {
 		redisDBStr = fc.RedisDB
@@ -123,18 +477,353 @@ func Load() (*Config, error) {
 			return nil, errors.New("REDIS_DB must be a valid integer")
 		}
 	}
+	if redisCluster && redisDB != 0 {
+		return nil, errors.New("REDIS_DB must be 0 with REDIS_CLUSTER")
+	}
+
+	redisPrefix := os.Getenv("REDIS_KEY_PREFIX")
+	if redisPrefix == "" {
+		redisPrefix = fc.RedisKeyPrefix
+	}
+	if redisPrefix == "" {
+		redisPrefix = "zbxtg:event:"
+	}
+
+	redisTTLStr := os.Getenv("REDIS_ENTRY_TTL")
+	if redisTTLStr == "" {
+		redisTTLStr = fc.RedisEntryTTL
+	}
+	var redisTTL time.Duration
+	if redisTTLStr != "" {
+		redisTTL, err = time.ParseDuration(redisTTLStr)
+		if err != nil || (redisTTL != 0 && redisTTL < time.Second) {
+			return nil, errors.New("REDIS_ENTRY_TTL must be a duration of at least 1s (e.g. \"168h\")")
+		}
+	}
+
+	redisMigrateStr := os.Getenv("REDIS_MIGRATE_KEYS")
+	if redisMigrateStr == "" {
+		redisMigrateStr = fc.RedisMigrateKeys
+	}
+	redisMigrate := false
+	if redisMigrateStr != "" {
+		redisMigrate, err = strconv.ParseBool(redisMigrateStr)
+		if err != nil {
+			return nil, errors.New("REDIS_MIGRATE_KEYS must be a boolean")
+		}
+	}
+
+	redisTLSStr := os.Getenv("REDIS_TLS")
+	if redisTLSStr == "" {
+		redisTLSStr = fc.RedisTLS
+	}
+	redisTLS := false
+	if redisTLSStr != "" {
+		redisTLS, err = strconv.ParseBool(redisTLSStr)
+		if err != nil {
+			return nil, errors.New("REDIS_TLS must be a boolean")
+		}
+	}
+	redisTLSCA := os.Getenv("REDIS_TLS_CA_FILE")
+	if redisTLSCA == "" {
+		redisTLSCA = fc.RedisTLSCA
+	}
+	redisTLSCert := os.Getenv("REDIS_TLS_CERT_FILE")
+	if redisTLSCert == "" {
+		redisTLSCert = fc.RedisTLSCert
+	}
+	redisTLSKey := os.Getenv("REDIS_TLS_KEY_FILE")
+	if redisTLSKey == "" {
+		redisTLSKey = fc.RedisTLSKey
+	}
+	if (redisTLSCert == "") != (redisTLSKey == "") {
+		return nil, errors.New("REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE must be set together")
+	}
+	if redisTLSCA != "" || redisTLSCert != "" {
+		redisTLS = true
+	}
+
+	storePath := os.Getenv("STORE_PATH")
+	if storePath == "" {
+		storePath = fc.StorePath
+	}
+
+	outboxStr := os.Getenv("OUTBOX_ENABLED")
+	if outboxStr == "" {
+		outboxStr = fc.OutboxEnabled
+	}
+	// An outbox held in memory would answer 202 for alerts lost on restart,
+	// so it is only used by default when the queue is persistent.
+	outbox := redisAddr != "" || sentinelMaster != "" || storePath != ""
+	if outboxStr != "" {
+		outbox, err = strconv.ParseBool(outboxStr)
+		if err != nil {
+			return nil, errors.New("OUTBOX_ENABLED must be a boolean")
+		}
+	}
+
+	attemptsStr := os.Getenv("OUTBOX_MAX_ATTEMPTS")
+	if attemptsStr == "" {
+		attemptsStr = fc.OutboxMaxAttempts
+	}
+	attempts := 10
+	if attemptsStr != "" {
+		attempts, err = strconv.Atoi(attemptsStr)
+		if err != nil || attempts < 1 {
+			return nil, errors.New("OUTBOX_MAX_ATTEMPTS must be a positive integer")
+		}
+	}
+
+	consumer := os.Getenv("OUTBOX_CONSUMER")
+	if consumer == "" {
+		consumer = fc.OutboxConsumer
+	}
+
+	stormThresholdStr := os.Getenv("STORM_THRESHOLD")
+	if stormThresholdStr == "" {
+		stormThresholdStr = fc.StormThreshold
+	}
+	stormThreshold := 0
+	if stormThresholdStr != "" {
+		stormThreshold, err = strconv.Atoi(stormThresholdStr)
+		if err != nil || stormThreshold < 0 {
+			return nil, errors.New("STORM_THRESHOLD must be a non-negative integer")
+		}
+	}
+
+	stormWindowStr := os.Getenv("STORM_WINDOW")
+	if stormWindowStr == "" {
+		stormWindowStr = fc.StormWindow
+	}
+	stormWindow := time.Minute
+	if stormWindowStr != "" {
+		stormWindow, err = time.ParseDuration(stormWindowStr)
+		if err != nil || stormWindow <= 0 {
+			return nil, errors.New("STORM_WINDOW must be a positive duration (e.g. \"1m\")")
+		}
+	}
+
+	digestIntervalStr := os.Getenv("STORM_DIGEST_INTERVAL")
+	if digestIntervalStr == "" {
+		digestIntervalStr = fc.StormDigestInterval
+	}
+	digestInterval := 10 * time.Second
+	if digestIntervalStr != "" {
+		digestInterval, err = time.ParseDuration(digestIntervalStr)
+		if err != nil || digestInterval < 0 {
+			return nil, errors.New("STORM_DIGEST_INTERVAL must be a duration (e.g. \"10s\")")
+		}
+	}
+
+	flapThresholdStr := os.Getenv("FLAP_THRESHOLD")
+	if flapThresholdStr == "" {
+		flapThresholdStr = fc.FlapThreshold
+	}
+	flapThreshold := 0
+	if flapThresholdStr != "" {
+		flapThreshold, err = strconv.Atoi(flapThresholdStr)
+		if err != nil || flapThreshold < 0 {
+			return nil, errors.New("FLAP_THRESHOLD must be a non-negative integer")
+		}
+	}
+
+	flapWindowStr := os.Getenv("FLAP_WINDOW")
+	if flapWindowStr == "" {
+		flapWindowStr = fc.FlapWindow
+	}
+	flapWindow := 30 * time.Minute
+	if flapWindowStr != "" {
+		flapWindow, err = time.ParseDuration(flapWindowStr)
+		if err != nil || flapWindow <= 0 {
+			return nil, errors.New("FLAP_WINDOW must be a positive duration (e.g. \"30m\")")
+		}
+	}
+
+	reminderIntervalsStr := os.Getenv("REMINDER_INTERVALS")
+	if reminderIntervalsStr == "" {
+		reminderIntervalsStr = fc.ReminderIntervals
+	}
+	reminderIntervals, err := parseIntervals(reminderIntervalsStr)
+	if err != nil {
+		return nil, fmt.Errorf("REMINDER_INTERVALS: %w", err)
+	}
+
+	reminderMaxStr := os.Getenv("REMINDER_MAX")
+	if reminderMaxStr == "" {
+		reminderMaxStr = fc.ReminderMax
+	}
+	reminderMax := 3
+	if reminderMaxStr != "" {
+		reminderMax, err = strconv.Atoi(reminderMaxStr)
+		if err != nil || reminderMax < 1 {
+			return nil, errors.New("REMINDER_MAX must be a positive integer")
+		}
+	}
+
+	timeZoneStr := os.Getenv("TIME_ZONE")
+	if timeZoneStr == "" {
+		timeZoneStr = fc.TimeZone
+	}
+	timeZone := time.Local
+	if timeZoneStr != "" {
+		timeZone, err = time.LoadLocation(timeZoneStr)
+		if err != nil {
+			return nil, fmt.Errorf("TIME_ZONE must be an IANA time zone name (e.g. \"Europe/Rome\"): %w", err)
+		}
+	}
+
+	timeLayout := os.Getenv("TIME_LAYOUT")
+	if timeLayout == "" {
+		timeLayout = fc.TimeLayout
+	}
+	if timeLayout == "" {
+		timeLayout = "2006-01-02 15:04:05 MST"
+	}
+	if sample := time.Date(1999, 12, 31, 23, 59, 59, 0, time.UTC); sample.Format(timeLayout) == timeLayout {
+		return nil, errors.New("TIME_LAYOUT must be a Go time layout (e.g. \"02/01/2006 15:04\")")
+	}
+
+	language := os.Getenv("MESSAGE_LANGUAGE")
+	if language == "" {
+		language = fc.Language
+	}
+
+	detailsDocumentStr := os.Getenv("DETAILS_DOCUMENT")
+	if detailsDocumentStr == "" {
+		detailsDocumentStr = fc.DetailsDocument
+	}
+	detailsDocument := false
+	if detailsDocumentStr != "" {
+		detailsDocument, err = strconv.ParseBool(detailsDocumentStr)
+		if err != nil {
+			return nil, errors.New("DETAILS_DOCUMENT must be a boolean")
+		}
+	}
+
+	zabbixURL := os.Getenv("ZABBIX_API_URL")
+	if zabbixURL == "" {
+		zabbixURL = fc.ZabbixAPIURL
+	}
+
+	zabbixToken := os.Getenv("ZABBIX_API_TOKEN")
+	if zabbixToken == "" {
+		zabbixToken = fc.ZabbixAPIToken
+	}
+	if zabbixURL != "" && zabbixToken == "" {
+		return nil, errors.New("ZABBIX_API_TOKEN is required when ZABBIX_API_URL is set")
+	}
+
+	for i, r := range fc.Routes {
+		if len(r.Destinations) == 0 {
+			return nil, fmt.Errorf("routes[%d]: at least one destination is required", i)
+		}
+		for j, d := range r.Destinations {
+			if d.ChatID == 0 {
+				return nil, fmt.Errorf("routes[%d].destinations[%d]: chat_id is required", i, j)
+			}
+		}
+	}
+
+	for i, e := range fc.Escalations {
+		if len(e.Steps) == 0 {
+			return nil, fmt.Errorf("escalations[%d]: at least one step is required", i)
+		}
+		var prev time.Duration
+		for j, st := range e.Steps {
+			if st.After <= prev {
+				return nil, fmt.Errorf("escalations[%d].steps[%d]: after must be positive and greater than the previous step", i, j)
+			}
+			prev = st.After
+			if len(st.Destinations) == 0 {
+				return nil, fmt.Errorf("escalations[%d].steps[%d]: at least one destination is required", i, j)
+			}
+			for k, d := range st.Destinations {
+				if d.ChatID == 0 {
+					return nil, fmt.Errorf("escalations[%d].steps[%d].destinations[%d]: chat_id is required", i, j, k)
+				}
+			}
+		}
+	}
 
 	return &Config{
-		TelegramToken: token,
-		ChatID:        chatID,
-		ServerAddr:    addr,
-		ServerSecret:  secret,
-		RedisAddr:     redisAddr,
-		RedisPassword: redisPassword,
-		RedisDB:       redisDB,
+		TelegramToken:         token,
+		ChatID:                chatID,
+		ThreadID:              threadID,
+		TelegramUpdates:       updates,
+		Routes:                fc.Routes,
+		Escalations:           fc.Escalations,
+		Templates:             fc.Templates,
+		ServerAddr:            addr,
+		ServerSecret:          secret,
+		RedisAddr:             redisAddr,
+		RedisSentinelMaster:   sentinelMaster,
+		RedisSentinelAddrs:    sentinelAddrs,
+		RedisCluster:          redisCluster,
+		RedisUsername:         redisUsername,
+		RedisPassword:         redisPassword,
+		RedisSentinelUsername: sentinelUsername,
+		RedisSentinelPassword: sentinelPassword,
+		RedisDB:               redisDB,
+		RedisKeyPrefix:        redisPrefix,
+		RedisEntryTTL:         redisTTL,
+		RedisMigrateKeys:      redisMigrate,
+		RedisTLS:              redisTLS,
+		RedisTLSCA:            redisTLSCA,
+		RedisTLSCert:          redisTLSCert,
+		RedisTLSKey:           redisTLSKey,
+		StorePath:             storePath,
+		OutboxEnabled:         outbox,
+		OutboxMaxAttempts:     attempts,
+		OutboxConsumer:        consumer,
+		StormThreshold:        stormThreshold,
+		StormWindow:           stormWindow,
+		StormDigestInterval:   digestInterval,
+		FlapThreshold:         flapThreshold,
+		FlapWindow:            flapWindow,
+		ReminderIntervals:     reminderIntervals,
+		ReminderMax:           reminderMax,
+		TimeZone:              timeZone,
+		TimeLayout:            timeLayout,
+		Language:              language,
+		DetailsDocument:       detailsDocument,
+		ZabbixAPIURL:          zabbixURL,
+		ZabbixAPIToken:        zabbixToken,
 	}, nil
 }
 
+// parseIntervals parses a comma-separated list of name=duration pairs, e.g.
+// "Disaster=30m,High=1h". An empty string yields a nil map.
+func parseIntervals(s string) (map[string]time.Duration, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	intervals := make(map[string]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%q must be name=duration", strings.TrimSpace(pair))
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%s: interval must be a positive duration (e.g. \"1h\")", name)
+		}
+		intervals[name] = d
+	}
+	return intervals, nil
+}
+
+// splitList splits a comma-separated list, dropping blank items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // loadFile parses the YAML config file, if present.
 func loadFile() (fileConfig, error) {
 	path := os.Getenv("CONFIG_FILE")
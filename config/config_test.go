@@ -3,7 +3,9 @@ package config_test
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
 )
@@ -12,8 +14,15 @@ import (
 func clearEnv(t *testing.T) {
 	t.Helper()
 	for _, key := range []string{
-		"TELEGRAM_BOT_TOKEN", "TELEGRAM_CHAT_ID", "SERVER_ADDR", "SERVER_SECRET", "CONFIG_FILE",
-		"REDIS_ADDR", "REDIS_PASSWORD", "REDIS_DB",
+		"TELEGRAM_BOT_TOKEN", "TELEGRAM_CHAT_ID", "TELEGRAM_THREAD_ID", "TELEGRAM_UPDATES", "SERVER_ADDR", "SERVER_SECRET", "CONFIG_FILE",
+		"REDIS_ADDR", "REDIS_PASSWORD", "REDIS_DB", "REDIS_USERNAME", "REDIS_SENTINEL_MASTER", "REDIS_SENTINEL_ADDRS",
+		"REDIS_SENTINEL_USERNAME", "REDIS_SENTINEL_PASSWORD",
+		"REDIS_CLUSTER", "REDIS_TLS", "REDIS_TLS_CA_FILE", "REDIS_TLS_CERT_FILE", "REDIS_TLS_KEY_FILE",
+		"REDIS_KEY_PREFIX", "REDIS_ENTRY_TTL", "REDIS_MIGRATE_KEYS", "STORE_PATH", "ZABBIX_API_URL", "ZABBIX_API_TOKEN",
+		"OUTBOX_ENABLED", "OUTBOX_MAX_ATTEMPTS", "OUTBOX_CONSUMER",
+		"STORM_THRESHOLD", "STORM_WINDOW", "STORM_DIGEST_INTERVAL",
+		"FLAP_THRESHOLD", "FLAP_WINDOW", "REMINDER_INTERVALS", "REMINDER_MAX",
+		"TIME_ZONE", "TIME_LAYOUT", "MESSAGE_LANGUAGE", "DETAILS_DOCUMENT",
 	} {
 		os.Unsetenv(key)
 	}
@@ -375,3 +384,730 @@ func TestLoadInvalidRedisDB(t *testing.T) {
 		t.Fatal("expected error when REDIS_DB is not numeric")
 	}
 }
+
+func TestLoadRoutesFromYAML(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+routes:
+  - name: dba
+    severities: [Disaster, High]
+    host: "db-*"
+    trigger: "(?i)replication"
+    destinations:
+      - chat_id: -100111
+      - chat_id: -100222
+        message_thread_id: 7
+    continue: true
+  - host_regex: "^web-\\d+$"
+    destinations:
+      - chat_id: -100333
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(cfg.Routes))
+	}
+	r := cfg.Routes[0]
+	if r.Name != "dba" || r.Host != "db-*" || r.Trigger != "(?i)replication" || !r.Continue {
+		t.Errorf("unexpected first route: %+v", r)
+	}
+	if len(r.Severities) != 2 || r.Severities[0] != "Disaster" {
+		t.Errorf("unexpected severities: %v", r.Severities)
+	}
+	if len(r.Destinations) != 2 || r.Destinations[1].ChatID != -100222 || r.Destinations[1].ThreadID != 7 {
+		t.Errorf("unexpected destinations: %+v", r.Destinations)
+	}
+	if cfg.Routes[1].HostRegex != `^web-\d+$` {
+		t.Errorf("unexpected host_regex: %q", cfg.Routes[1].HostRegex)
+	}
+}
+
+func TestLoadRouteWithoutDestination(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+routes:
+  - host: "db-*"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	_, err := config.Load()
+	if err == nil {
+		t.Fatal("expected error when a route has no destinations")
+	}
+}
+
+func TestLoadEscalationsFromYAML(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+escalations:
+  - name: databases
+    severities: [Disaster, High]
+    host_groups: ["Databases/*"]
+    steps:
+      - after: 30m
+        destinations:
+          - chat_id: -100444
+      - after: 2h
+        destinations:
+          - chat_id: -100555
+            message_thread_id: 9
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Escalations) != 1 {
+		t.Fatalf("expected 1 escalation policy, got %d", len(cfg.Escalations))
+	}
+	e := cfg.Escalations[0]
+	if e.Name != "databases" || len(e.Severities) != 2 || len(e.HostGroups) != 1 || e.HostGroups[0] != "Databases/*" {
+		t.Errorf("unexpected policy: %+v", e)
+	}
+	if len(e.Steps) != 2 || e.Steps[0].After != 30*time.Minute || e.Steps[1].After != 2*time.Hour {
+		t.Fatalf("unexpected steps: %+v", e.Steps)
+	}
+	if d := e.Steps[1].Destinations; len(d) != 1 || d[0].ChatID != -100555 || d[0].ThreadID != 9 {
+		t.Errorf("unexpected destinations: %+v", d)
+	}
+}
+
+func TestLoadTemplatesFromYAML(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+templates:
+  problem: "{{.Host}}"
+  resolved: |
+    {{emoji .Status}} {{.TriggerName}}
+routes:
+  - host: "db-*"
+    destinations:
+      - chat_id: -100222
+    templates:
+      default: "{{.EventID}}"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Templates["problem"] != "{{.Host}}" || cfg.Templates["resolved"] != "{{emoji .Status}} {{.TriggerName}}\n" {
+		t.Errorf("unexpected templates: %q", cfg.Templates)
+	}
+	if got := cfg.Routes[0].Templates["default"]; got != "{{.EventID}}" {
+		t.Errorf("unexpected route template: %q", got)
+	}
+}
+
+func TestLoadInvalidEscalations(t *testing.T) {
+	for name, yml := range map[string]string{
+		"no steps": `
+escalations:
+  - severities: [High]
+`,
+		"decreasing delay": `
+escalations:
+  - steps:
+      - after: 1h
+        destinations: [{chat_id: -1}]
+      - after: 30m
+        destinations: [{chat_id: -2}]
+`,
+		"no destination": `
+escalations:
+  - steps:
+      - after: 1h
+`,
+		"missing chat_id": `
+escalations:
+  - steps:
+      - after: 1h
+        destinations: [{message_thread_id: 3}]
+`,
+	} {
+		clearEnv(t)
+		os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+		os.Setenv("TELEGRAM_CHAT_ID", "1")
+		os.Setenv("CONFIG_FILE", writeYAML(t, yml))
+		if _, err := config.Load(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	clearEnv(t)
+}
+
+func TestLoadThreadID(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+telegram_thread_id: "12"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ThreadID != 12 {
+		t.Errorf("expected thread ID 12, got %d", cfg.ThreadID)
+	}
+
+	os.Setenv("TELEGRAM_THREAD_ID", "not-a-number")
+	defer os.Unsetenv("TELEGRAM_THREAD_ID")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error when TELEGRAM_THREAD_ID is not numeric")
+	}
+}
+
+func TestLoadZabbixAPIFromYAML(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+zabbix_api_url: "https://zabbix.example.com/api_jsonrpc.php"
+zabbix_api_token: "api-token"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ZabbixAPIURL != "https://zabbix.example.com/api_jsonrpc.php" {
+		t.Errorf("unexpected zabbix_api_url %q", cfg.ZabbixAPIURL)
+	}
+	if cfg.ZabbixAPIToken != "api-token" {
+		t.Errorf("unexpected zabbix_api_token %q", cfg.ZabbixAPIToken)
+	}
+}
+
+func TestLoadZabbixAPIURLWithoutToken(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	os.Setenv("ZABBIX_API_URL", "https://zabbix.example.com/api_jsonrpc.php")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+	defer os.Unsetenv("ZABBIX_API_URL")
+
+	_, err := config.Load()
+	if err == nil {
+		t.Fatal("expected error when ZABBIX_API_URL is set without ZABBIX_API_TOKEN")
+	}
+}
+
+func TestLoadTelegramUpdates(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.TelegramUpdates {
+		t.Error("expected Telegram updates to be enabled by default")
+	}
+
+	os.Setenv("TELEGRAM_UPDATES", "false")
+	defer os.Unsetenv("TELEGRAM_UPDATES")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TelegramUpdates {
+		t.Error("expected Telegram updates to be disabled")
+	}
+
+	os.Setenv("TELEGRAM_UPDATES", "maybe")
+	if _, err := config.Load(); err == nil {
+		t.Fatal("expected error when TELEGRAM_UPDATES is not a boolean")
+	}
+}
+
+func TestLoadRedisKeyOptions(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+redis_key_prefix: "team:"
+redis_entry_ttl: "168h"
+redis_migrate_keys: "true"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RedisKeyPrefix != "team:" {
+		t.Errorf("expected prefix 'team:', got %q", cfg.RedisKeyPrefix)
+	}
+	if cfg.RedisEntryTTL != 168*time.Hour {
+		t.Errorf("expected TTL 168h, got %v", cfg.RedisEntryTTL)
+	}
+	if !cfg.RedisMigrateKeys {
+		t.Error("expected key migration to be enabled")
+	}
+}
+
+func TestLoadRedisSentinelAndTLS(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+redis_sentinel_master: "main"
+redis_sentinel_addrs: "s1:26379, s2:26379"
+redis_username: "bot"
+redis_password: "secret"
+redis_sentinel_username: "watcher"
+redis_tls_ca_file: "/etc/redis/ca.pem"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RedisSentinelMaster != "main" || strings.Join(cfg.RedisSentinelAddrs, " ") != "s1:26379 s2:26379" {
+		t.Errorf("unexpected Sentinels %q %q", cfg.RedisSentinelMaster, cfg.RedisSentinelAddrs)
+	}
+	if cfg.RedisUsername != "bot" {
+		t.Errorf("expected ACL user 'bot', got %q", cfg.RedisUsername)
+	}
+	if cfg.RedisSentinelUsername != "watcher" || cfg.RedisSentinelPassword != "" {
+		t.Errorf("expected the Sentinel user alone, got %q %q", cfg.RedisSentinelUsername, cfg.RedisSentinelPassword)
+	}
+	if !cfg.RedisTLS || cfg.RedisTLSCA != "/etc/redis/ca.pem" {
+		t.Errorf("expected TLS with the CA file, got %v %q", cfg.RedisTLS, cfg.RedisTLSCA)
+	}
+}
+
+func TestLoadRedisSentinelCredentialsWithoutSentinel(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	os.Setenv("REDIS_ADDR", "redis:6379")
+	os.Setenv("REDIS_SENTINEL_PASSWORD", "pw")
+	defer clearEnv(t)
+
+	if _, err := config.Load(); err == nil || !strings.Contains(err.Error(), "REDIS_SENTINEL_MASTER") {
+		t.Fatalf("expected an error naming REDIS_SENTINEL_MASTER, got %v", err)
+	}
+}
+
+func TestLoadRedisCluster(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	os.Setenv("REDIS_ADDR", "n1:6379,n2:6379")
+	os.Setenv("REDIS_CLUSTER", "true")
+	defer clearEnv(t)
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.RedisCluster || cfg.RedisAddr != "n1:6379,n2:6379" {
+		t.Errorf("expected cluster mode on the seed nodes, got %v %q", cfg.RedisCluster, cfg.RedisAddr)
+	}
+}
+
+func TestLoadInvalidRedisConnection(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"master without Sentinels": {"REDIS_SENTINEL_MASTER": "main"},
+		"Sentinels without master": {"REDIS_SENTINEL_ADDRS": "s1:26379"},
+		"Sentinels and address":    {"REDIS_SENTINEL_MASTER": "main", "REDIS_SENTINEL_ADDRS": "s1:26379", "REDIS_ADDR": "r:6379"},
+		"cluster without address":  {"REDIS_CLUSTER": "true"},
+		"cluster database":         {"REDIS_CLUSTER": "true", "REDIS_ADDR": "n1:6379", "REDIS_DB": "1"},
+		"invalid cluster flag":     {"REDIS_CLUSTER": "maybe", "REDIS_ADDR": "n1:6379"},
+		"invalid TLS flag":         {"REDIS_TLS": "maybe"},
+		"certificate without key":  {"REDIS_TLS_CERT_FILE": "/etc/redis/cert.pem"},
+	} {
+		clearEnv(t)
+		os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+		os.Setenv("TELEGRAM_CHAT_ID", "1")
+		for k, v := range env {
+			os.Setenv(k, v)
+		}
+		if _, err := config.Load(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	clearEnv(t)
+}
+
+func TestLoadRedisKeyDefaults(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RedisKeyPrefix != "zbxtg:event:" {
+		t.Errorf("expected default prefix 'zbxtg:event:', got %q", cfg.RedisKeyPrefix)
+	}
+	if cfg.RedisEntryTTL != 0 || cfg.RedisMigrateKeys {
+		t.Errorf("expected no TTL and no migration by default, got %v / %v", cfg.RedisEntryTTL, cfg.RedisMigrateKeys)
+	}
+}
+
+func TestLoadInvalidRedisEntryTTL(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	for _, v := range []string{"a week", "500ms"} {
+		os.Setenv("REDIS_ENTRY_TTL", v)
+		if _, err := config.Load(); err == nil {
+			t.Errorf("expected error for REDIS_ENTRY_TTL %q", v)
+		}
+	}
+	os.Unsetenv("REDIS_ENTRY_TTL")
+}
+
+func TestLoadStorePath(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+store_path: "/var/lib/zbx-notifier/events.db"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StorePath != "/var/lib/zbx-notifier/events.db" {
+		t.Errorf("unexpected store_path %q", cfg.StorePath)
+	}
+
+	os.Setenv("STORE_PATH", "/tmp/events.db")
+	defer os.Unsetenv("STORE_PATH")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StorePath != "/tmp/events.db" {
+		t.Errorf("expected env STORE_PATH to override yaml, got %q", cfg.StorePath)
+	}
+}
+
+func TestLoadOutbox(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+outbox_max_attempts: "3"
+outbox_consumer: "bot-a"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.OutboxEnabled {
+		t.Error("expected the outbox to be disabled by default without a persistent queue")
+	}
+	if cfg.OutboxMaxAttempts != 3 || cfg.OutboxConsumer != "bot-a" {
+		t.Errorf("unexpected outbox settings: attempts=%d consumer=%q", cfg.OutboxMaxAttempts, cfg.OutboxConsumer)
+	}
+
+	os.Setenv("OUTBOX_ENABLED", "true")
+	defer os.Unsetenv("OUTBOX_ENABLED")
+	if cfg, err = config.Load(); err != nil || !cfg.OutboxEnabled {
+		t.Errorf("expected OUTBOX_ENABLED=true to enable the outbox, got %v (%v)", cfg.OutboxEnabled, err)
+	}
+
+	os.Unsetenv("OUTBOX_ENABLED")
+	os.Setenv("STORE_PATH", "/tmp/events.db")
+	defer os.Unsetenv("STORE_PATH")
+	if cfg, err = config.Load(); err != nil || !cfg.OutboxEnabled {
+		t.Errorf("expected the outbox to be enabled by default with STORE_PATH, got %v (%v)", cfg.OutboxEnabled, err)
+	}
+
+	os.Setenv("OUTBOX_ENABLED", "false")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.OutboxEnabled {
+		t.Error("expected OUTBOX_ENABLED=false to disable the outbox")
+	}
+}
+
+func TestLoadInvalidOutboxMaxAttempts(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	for _, v := range []string{"ten", "0"} {
+		os.Setenv("OUTBOX_MAX_ATTEMPTS", v)
+		if _, err := config.Load(); err == nil {
+			t.Errorf("expected error for OUTBOX_MAX_ATTEMPTS %q", v)
+		}
+	}
+	os.Unsetenv("OUTBOX_MAX_ATTEMPTS")
+}
+
+func TestLoadStorm(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StormThreshold != 0 || cfg.StormWindow != time.Minute || cfg.StormDigestInterval != 10*time.Second {
+		t.Errorf("unexpected storm defaults: %d %s %s", cfg.StormThreshold, cfg.StormWindow, cfg.StormDigestInterval)
+	}
+
+	path := writeYAML(t, `
+storm_threshold: "20"
+storm_window: "2m"
+storm_digest_interval: "30s"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.StormThreshold != 20 || cfg.StormWindow != 2*time.Minute || cfg.StormDigestInterval != 30*time.Second {
+		t.Errorf("unexpected storm settings: %d %s %s", cfg.StormThreshold, cfg.StormWindow, cfg.StormDigestInterval)
+	}
+
+	for key, v := range map[string]string{"STORM_THRESHOLD": "-1", "STORM_WINDOW": "0s"} {
+		os.Setenv(key, v)
+		if _, err := config.Load(); err == nil {
+			t.Errorf("expected error for %s %q", key, v)
+		}
+		os.Unsetenv(key)
+	}
+}
+
+func TestLoadFlap(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FlapThreshold != 0 || cfg.FlapWindow != 30*time.Minute {
+		t.Errorf("unexpected flap defaults: %d %s", cfg.FlapThreshold, cfg.FlapWindow)
+	}
+
+	path := writeYAML(t, `
+flap_threshold: "6"
+flap_window: "1h"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+	os.Setenv("FLAP_THRESHOLD", "8")
+	defer os.Unsetenv("FLAP_THRESHOLD")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FlapThreshold != 8 || cfg.FlapWindow != time.Hour {
+		t.Errorf("unexpected flap settings: %d %s", cfg.FlapThreshold, cfg.FlapWindow)
+	}
+
+	for key, v := range map[string]string{"FLAP_THRESHOLD": "x", "FLAP_WINDOW": "-5m"} {
+		os.Setenv(key, v)
+		if _, err := config.Load(); err == nil {
+			t.Errorf("expected error for %s %q", key, v)
+		}
+		os.Unsetenv(key)
+	}
+}
+
+func TestLoadReminders(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer os.Unsetenv("TELEGRAM_BOT_TOKEN")
+	defer os.Unsetenv("TELEGRAM_CHAT_ID")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.ReminderIntervals != nil || cfg.ReminderMax != 3 {
+		t.Errorf("unexpected reminder defaults: %v %d", cfg.ReminderIntervals, cfg.ReminderMax)
+	}
+
+	path := writeYAML(t, `
+reminder_intervals: "Disaster=30m, High=1h,default=4h"
+reminder_max: "5"
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]time.Duration{"Disaster": 30 * time.Minute, "High": time.Hour, "default": 4 * time.Hour}
+	if len(cfg.ReminderIntervals) != len(want) || cfg.ReminderMax != 5 {
+		t.Fatalf("unexpected reminder settings: %v %d", cfg.ReminderIntervals, cfg.ReminderMax)
+	}
+	for sev, d := range want {
+		if cfg.ReminderIntervals[sev] != d {
+			t.Errorf("expected %s interval %s, got %s", sev, d, cfg.ReminderIntervals[sev])
+		}
+	}
+
+	for key, v := range map[string]string{"REMINDER_INTERVALS": "High", "REMINDER_MAX": "0"} {
+		os.Setenv(key, v)
+		if _, err := config.Load(); err == nil {
+			t.Errorf("expected error for %s %q", key, v)
+		}
+		os.Unsetenv(key)
+	}
+	os.Setenv("REMINDER_INTERVALS", "High=soon")
+	defer os.Unsetenv("REMINDER_INTERVALS")
+	if _, err := config.Load(); err == nil {
+		t.Error("expected error for an invalid reminder interval")
+	}
+}
+
+func TestLoadTimeDisplay(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer clearEnv(t)
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TimeZone != time.Local || cfg.TimeLayout != "2006-01-02 15:04:05 MST" {
+		t.Errorf("unexpected defaults: %v %q", cfg.TimeZone, cfg.TimeLayout)
+	}
+
+	os.Setenv("TIME_ZONE", "Europe/Rome")
+	os.Setenv("TIME_LAYOUT", "02/01/2006 15:04")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.TimeZone.String() != "Europe/Rome" || cfg.TimeLayout != "02/01/2006 15:04" {
+		t.Errorf("unexpected display settings: %v %q", cfg.TimeZone, cfg.TimeLayout)
+	}
+
+	for env, value := range map[string]string{"TIME_ZONE": "Europe/Nowhere", "TIME_LAYOUT": "dd/mm/yyyy"} {
+		clearEnv(t)
+		os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+		os.Setenv("TELEGRAM_CHAT_ID", "1")
+		os.Setenv(env, value)
+		if _, err := config.Load(); err == nil || !strings.Contains(err.Error(), env) {
+			t.Errorf("expected an error about %s, got %v", env, err)
+		}
+	}
+}
+
+func TestLoadLanguage(t *testing.T) {
+	clearEnv(t)
+	path := writeYAML(t, `
+telegram_bot_token: "tok"
+telegram_chat_id: "1"
+message_language: "it"
+routes:
+  - host: "muc-*"
+    language: de
+    destinations:
+      - chat_id: -100222
+`)
+	os.Setenv("CONFIG_FILE", path)
+	defer os.Unsetenv("CONFIG_FILE")
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Language != "it" || cfg.Routes[0].Language != "de" {
+		t.Errorf("unexpected languages: %q, route %q", cfg.Language, cfg.Routes[0].Language)
+	}
+
+	os.Setenv("MESSAGE_LANGUAGE", "en")
+	defer os.Unsetenv("MESSAGE_LANGUAGE")
+	cfg, err = config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Language != "en" {
+		t.Errorf("expected MESSAGE_LANGUAGE to override the file, got %q", cfg.Language)
+	}
+}
+
+func TestLoadDetailsDocument(t *testing.T) {
+	clearEnv(t)
+	os.Setenv("TELEGRAM_BOT_TOKEN", "tok")
+	os.Setenv("TELEGRAM_CHAT_ID", "1")
+	defer clearEnv(t)
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.DetailsDocument {
+		t.Error("expected details documents to be off by default")
+	}
+
+	os.Setenv("DETAILS_DOCUMENT", "true")
+	if cfg, err = config.Load(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cfg.DetailsDocument {
+		t.Error("expected DETAILS_DOCUMENT to enable details documents")
+	}
+
+	os.Setenv("DETAILS_DOCUMENT", "sometimes")
+	if _, err := config.Load(); err == nil {
+		t.Error("expected an error for a non-boolean DETAILS_DOCUMENT")
+	}
+}
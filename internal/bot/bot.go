@@ -1,42 +1,217 @@
-// Package bot wraps the Telegram Bot API to send and edit messages.
+// Package bot wraps the Telegram Bot API to send and edit messages and to
+// receive button presses and commands from the chats the bot posts to.
 package bot
 
 import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// pollTimeout is the long-polling timeout, in seconds, for getUpdates.
+const pollTimeout = 60
+
 // Bot is a thin wrapper around the Telegram Bot API client.
 type Bot struct {
-	api    *tgbotapi.BotAPI
-	chatID int64
+	api *tgbotapi.BotAPI
+}
+
+// Button is an inline keyboard button that sends Data back to the bot as a
+// callback query when pressed.
+type Button struct {
+	Text string
+	Data string
+}
+
+// Keyboard is a single row of inline keyboard buttons attached to a message.
+// A nil Keyboard sends or leaves the message without buttons.
+type Keyboard []Button
+
+// Callback is a press of an inline keyboard button.
+type Callback struct {
+	// ID must be passed to AnswerCallback.
+	ID        string
+	ChatID    int64
+	MessageID int
+	Data      string
+	// From is the display name of the user who pressed the button.
+	From string
+}
+
+// Command is a bot command (e.g. "/status") sent in a chat.
+type Command struct {
+	ChatID    int64
+	MessageID int
+	// Name is the command without the leading slash and bot mention.
+	Name string
+	// Args is the text following the command.
+	Args string
+	From string
 }
 
-// New creates a Bot using the provided token and target chat ID.
-func New(token string, chatID int64) (*Bot, error) {
+// UpdateHandler receives the updates consumed by Listen. HandleCallback is
+// called on a goroutine of its own, so it may run concurrently with itself
+// and with HandleCommand.
+type UpdateHandler interface {
+	HandleCallback(cb Callback)
+	HandleCommand(cmd Command)
+}
+
+// New creates a Bot using the provided token.
+func New(token string) (*Bot, error) {
 	api, err := tgbotapi.NewBotAPI(token)
 	if err != nil {
 		return nil, err
 	}
-	return &Bot{api: api, chatID: chatID}, nil
+	return &Bot{api: api}, nil
+}
+
+// SendMessage sends a new text message to the given chat and returns the
+// Telegram message ID assigned to it. threadID selects the forum topic to post
+// in; zero posts to the chat's General topic.
+func (b *Bot) SendMessage(chatID int64, threadID int, text string, kb Keyboard) (int, error) {
+	return b.send(chatID, threadID, 0, text, kb)
+}
+
+// ReplyMessage sends text as a reply to the message replyTo in the given chat
+// and forum topic and returns the Telegram message ID assigned to it.
+func (b *Bot) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	return b.send(chatID, threadID, replyTo, text, nil)
+}
+
+// send calls sendMessage directly because telegram-bot-api v5.5.1 predates
+// forum topics and has no message_thread_id field.
+func (b *Bot) send(chatID int64, threadID, replyTo int, text string, kb Keyboard) (int, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", chatID)
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddNonZero("reply_to_message_id", replyTo)
+	params.AddNonEmpty("text", text)
+	params.AddNonEmpty("parse_mode", tgbotapi.ModeHTML)
+	if kb != nil {
+		if err := params.AddInterface("reply_markup", kb.markup()); err != nil {
+			return 0, err
+		}
+	}
+
+	resp, err := b.api.MakeRequest("sendMessage", params)
+	if err != nil {
+		return 0, err
+	}
+	var sent tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &sent); err != nil {
+		return 0, err
+	}
+	return sent.MessageID, nil
 }
 
-// SendMessage sends a new text message to the configured chat and returns the
-// Telegram message ID assigned to it.
-func (b *Bot) SendMessage(text string) (int, error) {
-	msg := tgbotapi.NewMessage(b.chatID, text)
-	msg.ParseMode = tgbotapi.ModeHTML
-	sent, err := b.api.Send(msg)
+// ReplyDocument uploads data as a file named name, in reply to the message
+// replyTo in the given chat and forum topic, and returns the Telegram message
+// ID assigned to it.
+func (b *Bot) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	params := tgbotapi.Params{}
+	params.AddNonZero64("chat_id", chatID)
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddNonZero("reply_to_message_id", replyTo)
+	files := []tgbotapi.RequestFile{{Name: "document", Data: tgbotapi.FileBytes{Name: name, Bytes: data}}}
+
+	resp, err := b.api.UploadFiles("sendDocument", params, files)
 	if err != nil {
 		return 0, err
 	}
+	var sent tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &sent); err != nil {
+		return 0, err
+	}
 	return sent.MessageID, nil
 }
 
 // EditMessage replaces the text of an existing message (identified by
-// messageID) in the configured chat.
-func (b *Bot) EditMessage(messageID int, text string) error {
-	edit := tgbotapi.NewEditMessageText(b.chatID, messageID, text)
+// messageID) in the given chat. Message IDs are unique per chat, so no forum
+// topic is needed to address a message posted inside one. Any keyboard on the
+// message is replaced by kb, or removed when kb is nil.
+func (b *Bot) EditMessage(chatID int64, messageID int, text string, kb Keyboard) error {
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
 	edit.ParseMode = tgbotapi.ModeHTML
+	if kb != nil {
+		markup := kb.markup()
+		edit.ReplyMarkup = &markup
+	}
 	_, err := b.api.Send(edit)
 	return err
 }
+
+// AnswerCallback acknowledges a callback query, showing text to the user who
+// pressed the button as a short notification.
+func (b *Bot) AnswerCallback(callbackID, text string) error {
+	_, err := b.api.Request(tgbotapi.NewCallback(callbackID, text))
+	return err
+}
+
+// Listen long-polls Telegram for updates and dispatches them to h. It blocks
+// for the lifetime of the process.
+func (b *Bot) Listen(h UpdateHandler) {
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = pollTimeout
+	u.AllowedUpdates = []string{"message", "callback_query"}
+
+	for update := range b.api.GetUpdatesChan(u) {
+		switch {
+		case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+			// A button press calls the Zabbix API before it is answered;
+			// it must not hold up the updates that follow it.
+			cq := update.CallbackQuery
+			go h.HandleCallback(Callback{
+				ID:        cq.ID,
+				ChatID:    cq.Message.Chat.ID,
+				MessageID: cq.Message.MessageID,
+				Data:      cq.Data,
+				From:      displayName(cq.From),
+			})
+		case update.Message != nil && update.Message.IsCommand():
+			msg := update.Message
+			h.HandleCommand(Command{
+				ChatID:    msg.Chat.ID,
+				MessageID: msg.MessageID,
+				Name:      msg.Command(),
+				Args:      strings.TrimSpace(msg.CommandArguments()),
+				From:      displayName(msg.From),
+			})
+		}
+	}
+	log.Printf("Telegram update channel closed")
+}
+
+// RetryAfter reports the delay Telegram asked for when err is a rate limit
+// (HTTP 429) response.
+func RetryAfter(err error) (time.Duration, bool) {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second, true
+	}
+	return 0, false
+}
+
+func (kb Keyboard) markup() tgbotapi.InlineKeyboardMarkup {
+	row := make([]tgbotapi.InlineKeyboardButton, 0, len(kb))
+	for _, btn := range kb {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData(btn.Text, btn.Data))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(row)
+}
+
+// displayName returns "@username" when the user has one, otherwise their
+// first and last name.
+func displayName(u *tgbotapi.User) string {
+	if u == nil {
+		return "unknown"
+	}
+	if u.UserName != "" {
+		return "@" + u.UserName
+	}
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
@@ -0,0 +1,363 @@
+package bot
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Telegram's limits for bots: about 30 messages per second overall and 20
+// messages per minute in the same group. Edits count like messages.
+const (
+	DefaultGlobalLimit  = 30
+	DefaultGlobalPeriod = time.Second
+	DefaultChatLimit    = 20
+	DefaultChatPeriod   = time.Minute
+)
+
+// Messenger is the part of the Bot API that posts to chats. It is implemented
+// by Bot and Scheduler.
+type Messenger interface {
+	SendMessage(chatID int64, threadID int, text string, kb Keyboard) (int, error)
+	EditMessage(chatID int64, messageID int, text string, kb Keyboard) error
+	ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error)
+	ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error)
+	AnswerCallback(callbackID, text string) error
+}
+
+// Priority orders the requests waiting in a Scheduler. Higher values are
+// served first; requests of equal priority are served in arrival order.
+type Priority int
+
+// Scheduler delays the requests of a Messenger so they stay within Telegram's
+// global and per-chat rate limits, serving waiting requests by priority. A
+// chat that is over its limit does not hold back requests for other chats.
+// Run must be running for requests to be sent.
+type Scheduler struct {
+	next Messenger
+	wake chan struct{}
+
+	mu         sync.Mutex
+	global     *bucket
+	chats      map[int64]*bucket
+	chatLimit  int
+	chatPeriod time.Duration
+	pruned     time.Time
+	waiting    []*request
+	seq        uint64
+}
+
+// SchedulerOption configures optional Scheduler behaviour.
+type SchedulerOption func(*Scheduler)
+
+// WithGlobalLimit allows n requests per period across all chats
+// (DefaultGlobalLimit per DefaultGlobalPeriod by default).
+func WithGlobalLimit(n int, period time.Duration) SchedulerOption {
+	return func(s *Scheduler) { s.global = newBucket(n, period, time.Now()) }
+}
+
+// WithChatLimit allows n requests per period in each chat
+// (DefaultChatLimit per DefaultChatPeriod by default).
+func WithChatLimit(n int, period time.Duration) SchedulerOption {
+	return func(s *Scheduler) { s.chatLimit, s.chatPeriod = n, period }
+}
+
+// request is a call waiting for its turn; ready is closed when it may run.
+type request struct {
+	chatID   int64
+	priority Priority
+	seq      uint64
+	ready    chan struct{}
+}
+
+// NewScheduler creates a Scheduler sending through next.
+func NewScheduler(next Messenger, opts ...SchedulerOption) *Scheduler {
+	s := &Scheduler{
+		next:       next,
+		wake:       make(chan struct{}, 1),
+		global:     newBucket(DefaultGlobalLimit, DefaultGlobalPeriod, time.Now()),
+		chats:      make(map[int64]*bucket),
+		chatLimit:  DefaultChatLimit,
+		chatPeriod: DefaultChatPeriod,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithPriority returns a Messenger whose requests wait in s with priority p.
+func (s *Scheduler) WithPriority(p Priority) Messenger {
+	return s.WithContext(context.Background(), p)
+}
+
+// WithContext returns a Messenger whose requests wait in s with priority p
+// and give up, returning the context's error, when ctx is done before their
+// turn comes.
+func (s *Scheduler) WithContext(ctx context.Context, p Priority) Messenger {
+	return prioritized{s: s, ctx: ctx, p: p}
+}
+
+// SendMessage sends a message with the default (zero) priority.
+func (s *Scheduler) SendMessage(chatID int64, threadID int, text string, kb Keyboard) (int, error) {
+	return s.WithPriority(0).SendMessage(chatID, threadID, text, kb)
+}
+
+// EditMessage edits a message with the default (zero) priority.
+func (s *Scheduler) EditMessage(chatID int64, messageID int, text string, kb Keyboard) error {
+	return s.WithPriority(0).EditMessage(chatID, messageID, text, kb)
+}
+
+// ReplyMessage sends a reply with the default (zero) priority.
+func (s *Scheduler) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	return s.WithPriority(0).ReplyMessage(chatID, threadID, replyTo, text)
+}
+
+// ReplyDocument sends a document reply with the default (zero) priority.
+func (s *Scheduler) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	return s.WithPriority(0).ReplyDocument(chatID, threadID, replyTo, name, data)
+}
+
+// AnswerCallback is not a chat message and is passed through immediately.
+func (s *Scheduler) AnswerCallback(callbackID, text string) error {
+	return s.next.AnswerCallback(callbackID, text)
+}
+
+// QueueDepth returns the number of requests waiting for their turn.
+func (s *Scheduler) QueueDepth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.waiting)
+}
+
+// Run hands out turns to waiting requests until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		s.mu.Lock()
+		wait := s.dispatch(time.Now())
+		s.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-s.wake:
+		case <-expired:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// dispatch lets every waiting request run that fits in the limits, highest
+// priority first, and returns the time until the next one can, or -1 when
+// nothing is waiting. The caller holds s.mu.
+func (s *Scheduler) dispatch(now time.Time) time.Duration {
+	if now.Sub(s.pruned) >= s.chatPeriod {
+		s.prune(now)
+	}
+	sort.Slice(s.waiting, func(i, j int) bool {
+		a, b := s.waiting[i], s.waiting[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		return a.seq < b.seq
+	})
+
+	next := time.Duration(-1)
+	earliest := func(d time.Duration) {
+		if next < 0 || d < next {
+			next = d
+		}
+	}
+	kept := s.waiting[:0]
+	for i, r := range s.waiting {
+		if d := s.global.wait(now); d > 0 {
+			// Every request needs a global token: keep the rest waiting
+			// rather than letting lower priorities take the next one.
+			earliest(d)
+			kept = append(kept, s.waiting[i:]...)
+			break
+		}
+		chat := s.chat(r.chatID, now)
+		if d := chat.wait(now); d > 0 {
+			earliest(d)
+			kept = append(kept, r)
+			continue
+		}
+		s.global.take()
+		chat.take()
+		close(r.ready)
+	}
+	clear(s.waiting[len(kept):])
+	s.waiting = kept
+	return next
+}
+
+// prune drops the buckets of the chats that have been idle long enough for
+// them to be full again, as a new bucket is. The caller holds s.mu.
+func (s *Scheduler) prune(now time.Time) {
+	for id, b := range s.chats {
+		if b.full(now) {
+			delete(s.chats, id)
+		}
+	}
+	s.pruned = now
+}
+
+func (s *Scheduler) chat(chatID int64, now time.Time) *bucket {
+	b, ok := s.chats[chatID]
+	if !ok {
+		b = newBucket(s.chatLimit, s.chatPeriod, now)
+		s.chats[chatID] = b
+	}
+	return b
+}
+
+// acquire blocks until a request for chatID may be sent, or until ctx is
+// done and it returns ctx's error.
+func (s *Scheduler) acquire(ctx context.Context, chatID int64, p Priority) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r := &request{chatID: chatID, priority: p, ready: make(chan struct{})}
+	s.mu.Lock()
+	s.seq++
+	r.seq = s.seq
+	s.waiting = append(s.waiting, r)
+	s.mu.Unlock()
+	s.signal()
+
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, w := range s.waiting {
+		if w == r {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	return ctx.Err()
+}
+
+// observe pauses the chat when Telegram answered with a rate limit error, so
+// the following requests wait for the delay Telegram asked for.
+func (s *Scheduler) observe(chatID int64, err error) {
+	d, ok := RetryAfter(err)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	s.mu.Lock()
+	s.chat(chatID, now).pausedUntil = now.Add(d)
+	s.mu.Unlock()
+	s.signal()
+}
+
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// prioritized is a Messenger view of a Scheduler with a fixed priority and
+// context.
+type prioritized struct {
+	s   *Scheduler
+	ctx context.Context
+	p   Priority
+}
+
+func (m prioritized) SendMessage(chatID int64, threadID int, text string, kb Keyboard) (int, error) {
+	if err := m.s.acquire(m.ctx, chatID, m.p); err != nil {
+		return 0, err
+	}
+	id, err := m.s.next.SendMessage(chatID, threadID, text, kb)
+	m.s.observe(chatID, err)
+	return id, err
+}
+
+func (m prioritized) EditMessage(chatID int64, messageID int, text string, kb Keyboard) error {
+	if err := m.s.acquire(m.ctx, chatID, m.p); err != nil {
+		return err
+	}
+	err := m.s.next.EditMessage(chatID, messageID, text, kb)
+	m.s.observe(chatID, err)
+	return err
+}
+
+func (m prioritized) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	if err := m.s.acquire(m.ctx, chatID, m.p); err != nil {
+		return 0, err
+	}
+	id, err := m.s.next.ReplyMessage(chatID, threadID, replyTo, text)
+	m.s.observe(chatID, err)
+	return id, err
+}
+
+func (m prioritized) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	if err := m.s.acquire(m.ctx, chatID, m.p); err != nil {
+		return 0, err
+	}
+	id, err := m.s.next.ReplyDocument(chatID, threadID, replyTo, name, data)
+	m.s.observe(chatID, err)
+	return id, err
+}
+
+func (m prioritized) AnswerCallback(callbackID, text string) error {
+	return m.s.next.AnswerCallback(callbackID, text)
+}
+
+// bucket is a token bucket refilled continuously at rate tokens per second up
+// to burst tokens.
+type bucket struct {
+	tokens      float64
+	burst       float64
+	rate        float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newBucket(n int, period time.Duration, now time.Time) *bucket {
+	return &bucket{tokens: float64(n), burst: float64(n), rate: float64(n) / period.Seconds(), last: now}
+}
+
+// wait returns how long until a token is available, zero if one is.
+func (b *bucket) wait(now time.Time) time.Duration {
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// full reports whether the bucket has refilled to its burst and is not
+// paused.
+func (b *bucket) full(now time.Time) bool {
+	return !now.Before(b.pausedUntil) && b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+func (b *bucket) take() {
+	b.tokens--
+}
@@ -0,0 +1,235 @@
+package bot_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+)
+
+// fakeMessenger records the order of the messages sent through it.
+type fakeMessenger struct {
+	mu    sync.Mutex
+	sent  []string
+	times map[string]time.Time
+	err   error
+}
+
+func (f *fakeMessenger) record(text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, text)
+	if f.times == nil {
+		f.times = make(map[string]time.Time)
+	}
+	f.times[text] = time.Now()
+}
+
+func (f *fakeMessenger) SendMessage(chatID int64, threadID int, text string, kb bot.Keyboard) (int, error) {
+	f.record(text)
+	return 1, f.err
+}
+
+func (f *fakeMessenger) EditMessage(chatID int64, messageID int, text string, kb bot.Keyboard) error {
+	f.record(text)
+	return f.err
+}
+
+func (f *fakeMessenger) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	f.record(text)
+	return 1, f.err
+}
+
+func (f *fakeMessenger) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	f.record(name)
+	return 1, f.err
+}
+
+func (f *fakeMessenger) AnswerCallback(callbackID, text string) error {
+	return nil
+}
+
+func start(t *testing.T, s *bot.Scheduler) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go s.Run(ctx)
+}
+
+// waitQueued waits until n requests are waiting in s.
+func waitQueued(t *testing.T, s *bot.Scheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for s.QueueDepth() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued requests, got %d", n, s.QueueDepth())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerServesHigherPriorityFirst(t *testing.T) {
+	f := &fakeMessenger{}
+	s := bot.NewScheduler(f, bot.WithGlobalLimit(1, 20*time.Millisecond))
+
+	// Queue the requests before the scheduler runs so they compete.
+	var wg sync.WaitGroup
+	send := func(p bot.Priority, text string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.WithPriority(p).SendMessage(-1, 0, text, nil)
+		}()
+	}
+	send(1, "warning")
+	waitQueued(t, s, 1)
+	send(6, "disaster")
+	waitQueued(t, s, 2)
+	send(1, "warning 2")
+	waitQueued(t, s, 3)
+	send(10, "resolved")
+	waitQueued(t, s, 4)
+
+	start(t, s)
+	wg.Wait()
+
+	want := []string{"resolved", "disaster", "warning", "warning 2"}
+	for i, text := range want {
+		if f.sent[i] != text {
+			t.Fatalf("expected order %v, got %v", want, f.sent)
+		}
+	}
+	if s.QueueDepth() != 0 {
+		t.Errorf("expected an empty queue, got %d", s.QueueDepth())
+	}
+}
+
+func TestSchedulerOrdersConcurrentCallers(t *testing.T) {
+	f := &fakeMessenger{}
+	s := bot.NewScheduler(f, bot.WithGlobalLimit(1, 5*time.Millisecond))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for _, p := range []bot.Priority{1, 6} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.WithPriority(p).SendMessage(int64(-i), 0, fmt.Sprintf("%d/%d", p, i), nil)
+			}()
+		}
+	}
+	waitQueued(t, s, 20)
+	start(t, s)
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, text := range f.sent {
+		if high := strings.HasPrefix(text, "6/"); high != (i < 10) {
+			t.Fatalf("expected the 10 higher priority messages first, got %v", f.sent)
+		}
+	}
+}
+
+func TestSchedulerGivesUpOnCancellation(t *testing.T) {
+	f := &fakeMessenger{}
+	s := bot.NewScheduler(f, bot.WithChatLimit(1, time.Hour))
+	start(t, s)
+
+	if _, err := s.SendMessage(-1, 0, "first", nil); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.WithContext(ctx, 0).SendMessage(-1, 0, "second", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to give up with the context, got %v", err)
+	}
+	if n := s.QueueDepth(); n != 0 {
+		t.Errorf("expected the request to leave the queue, got %d waiting", n)
+	}
+	if _, err := s.WithContext(ctx, 0).SendMessage(-2, 0, "third", nil); err == nil {
+		t.Error("expected a request with a done context not to be sent")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.sent) != 1 {
+		t.Errorf("expected only the first message to be sent, got %v", f.sent)
+	}
+}
+
+func TestSchedulerChatLimit(t *testing.T) {
+	f := &fakeMessenger{}
+	s := bot.NewScheduler(f, bot.WithChatLimit(2, 200*time.Millisecond))
+	start(t, s)
+
+	began := time.Now()
+	var wg sync.WaitGroup
+	for _, text := range []string{"a1", "a2", "a3"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.SendMessage(-1, 0, text, nil)
+		}()
+	}
+	waitQueued(t, s, 1)
+	s.SendMessage(-2, 0, "b1", nil)
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if d := f.times["b1"].Sub(began); d > 50*time.Millisecond {
+		t.Errorf("a chat over its limit must not delay other chats, b1 waited %s", d)
+	}
+	late := 0
+	for _, text := range []string{"a1", "a2", "a3"} {
+		if f.times[text].Sub(began) >= 80*time.Millisecond {
+			late++
+		}
+	}
+	if late != 1 {
+		t.Errorf("expected exactly one message of chat -1 to wait for a token, got %d", late)
+	}
+}
+
+func TestSchedulerPausesChatOnRetryAfter(t *testing.T) {
+	f := &fakeMessenger{err: &tgbotapi.Error{
+		Code:               429,
+		Message:            "Too Many Requests: retry after 1",
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1},
+	}}
+	s := bot.NewScheduler(f)
+	start(t, s)
+
+	if _, err := s.SendMessage(-1, 0, "first", nil); err == nil {
+		t.Fatal("expected the Telegram error to be returned")
+	}
+	if d, ok := bot.RetryAfter(f.err); !ok || d != time.Second {
+		t.Fatalf("RetryAfter: got %s, %v", d, ok)
+	}
+	f.err = nil
+
+	done := make(chan struct{})
+	go func() {
+		s.SendMessage(-1, 0, "second", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the chat to be paused after a 429")
+	case <-time.After(300 * time.Millisecond):
+	}
+	s.SendMessage(-2, 0, "other chat", nil)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the chat to resume after retry_after")
+	}
+}
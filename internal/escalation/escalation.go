@@ -0,0 +1,104 @@
+// Package escalation selects the escalation steps of a problem, based on the
+// escalation policies from the configuration.
+package escalation
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+)
+
+// Step reposts a problem to Destinations once it has been open for After.
+type Step struct {
+	After        time.Duration
+	Destinations []router.Destination
+}
+
+// Policies matches problems against an ordered list of escalation policies.
+type Policies struct {
+	policies []policy
+}
+
+type policy struct {
+	severities map[string]bool
+	hostGroups []string
+	steps      []Step
+}
+
+// New compiles the given policies. An error is returned if a host group glob
+// is invalid.
+func New(escalations []config.Escalation) (*Policies, error) {
+	p := &Policies{}
+	for i, ce := range escalations {
+		label := ce.Name
+		if label == "" {
+			label = fmt.Sprintf("escalations[%d]", i)
+		}
+
+		pol := policy{hostGroups: ce.HostGroups}
+		if len(ce.Severities) > 0 {
+			pol.severities = make(map[string]bool, len(ce.Severities))
+			for _, sev := range ce.Severities {
+				pol.severities[strings.ToUpper(sev)] = true
+			}
+		}
+		for _, g := range ce.HostGroups {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid host group glob %q: %w", label, g, err)
+			}
+		}
+		for _, cs := range ce.Steps {
+			st := Step{After: cs.After}
+			for _, d := range cs.Destinations {
+				st.Destinations = append(st.Destinations, router.Destination{ChatID: d.ChatID, ThreadID: d.ThreadID})
+			}
+			pol.steps = append(pol.steps, st)
+		}
+		p.policies = append(p.policies, pol)
+	}
+	return p, nil
+}
+
+// Match returns the steps of the first policy matching a problem with the
+// given severity and host groups, or nil when none matches.
+func (p *Policies) Match(severity string, hostGroups []string) []Step {
+	for _, pol := range p.policies {
+		if pol.matches(severity, hostGroups) {
+			return pol.steps
+		}
+	}
+	return nil
+}
+
+// Shortest returns the delay of the earliest step of any policy, zero when
+// there are no policies.
+func (p *Policies) Shortest() time.Duration {
+	var d time.Duration
+	for _, pol := range p.policies {
+		if len(pol.steps) > 0 && (d == 0 || pol.steps[0].After < d) {
+			d = pol.steps[0].After
+		}
+	}
+	return d
+}
+
+func (pol *policy) matches(severity string, hostGroups []string) bool {
+	if pol.severities != nil && !pol.severities[strings.ToUpper(severity)] {
+		return false
+	}
+	if len(pol.hostGroups) == 0 {
+		return true
+	}
+	for _, pattern := range pol.hostGroups {
+		for _, g := range hostGroups {
+			if ok, _ := path.Match(pattern, g); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package escalation_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/escalation"
+)
+
+func step(after time.Duration, chatID int64) config.EscalationStep {
+	return config.EscalationStep{After: after, Destinations: []config.Destination{{ChatID: chatID}}}
+}
+
+func TestMatchFirstPolicyWins(t *testing.T) {
+	p, err := escalation.New([]config.Escalation{
+		{Severities: []string{"Disaster"}, HostGroups: []string{"Databases/*"}, Steps: []config.EscalationStep{step(10*time.Minute, 1)}},
+		{Severities: []string{"disaster", "HIGH"}, Steps: []config.EscalationStep{step(30*time.Minute, 2), step(time.Hour, 3)}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		severity string
+		groups   []string
+		want     []int64
+	}{
+		{"Disaster", []string{"Linux servers", "Databases/MySQL"}, []int64{1}},
+		{"Disaster", []string{"Linux servers"}, []int64{2, 3}},
+		{"high", nil, []int64{2, 3}},
+		{"Warning", []string{"Databases/MySQL"}, nil},
+	}
+	for _, tt := range tests {
+		steps := p.Match(tt.severity, tt.groups)
+		var got []int64
+		for _, st := range steps {
+			got = append(got, st.Destinations[0].ChatID)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.severity, tt.groups, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Match(%q, %v) = %v, want %v", tt.severity, tt.groups, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if d := p.Shortest(); d != 10*time.Minute {
+		t.Errorf("expected the shortest delay to be 10m, got %s", d)
+	}
+}
+
+func TestInvalidHostGroupGlob(t *testing.T) {
+	_, err := escalation.New([]config.Escalation{
+		{Name: "dba", HostGroups: []string{"[db"}, Steps: []config.EscalationStep{step(time.Minute, 1)}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an invalid glob")
+	}
+}
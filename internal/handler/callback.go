@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/zabbix"
+)
+
+// Callback data prefixes of the inline buttons; the event ID follows a colon.
+const (
+	callbackAck   = "ack"
+	callbackClose = "close"
+
+	ackTimeout = 10 * time.Second
+)
+
+// problemKeyboard returns the inline buttons for an open PROBLEM message in
+// its current acknowledgement state, or nil when acknowledging is disabled or
+// a close was already requested.
+func (h *Handler) problemKeyboard(eventID string, ack *store.Acknowledgement) bot.Keyboard {
+	if h.acker == nil || (ack != nil && ack.Closed) {
+		return nil
+	}
+	var kb bot.Keyboard
+	if ack == nil {
+		kb = append(kb, bot.Button{Text: "✔️ Ack", Data: callbackAck + ":" + eventID})
+	}
+	return append(kb, bot.Button{Text: "🔒 Close", Data: callbackClose + ":" + eventID})
+}
+
+// HandleCallback processes a press of the "Ack" / "Close" buttons: the event
+// is acknowledged (or closed) in Zabbix and every message tracked for it is
+// edited to show who did it and when.
+func (h *Handler) HandleCallback(cb bot.Callback) {
+	kind, eventID, _ := strings.Cut(cb.Data, ":")
+
+	var action zabbix.Action
+	var verb string
+	switch kind {
+	case callbackAck:
+		action, verb = zabbix.ActionAcknowledge|zabbix.ActionMessage, "Acknowledged"
+	case callbackClose:
+		action, verb = zabbix.ActionClose|zabbix.ActionMessage, "Closed"
+	default:
+		h.answer(cb, "Unknown action")
+		return
+	}
+	if h.acker == nil {
+		h.answer(cb, "Acknowledging from Telegram is not enabled")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ackTimeout)
+	defer cancel()
+	unlock, err := h.lockEvent(ctx, eventID)
+	if err != nil {
+		h.answer(cb, callbackError(err))
+		return
+	}
+	defer unlock()
+
+	entry, ok, err := h.getEntry(ctx, eventID)
+	if err != nil {
+		h.answer(cb, callbackError(err))
+		return
+	}
+	if !ok || !h.tracks(entry, cb) {
+		h.answer(cb, "This problem is no longer open")
+		return
+	}
+
+	if err := h.acker.Acknowledge(ctx, eventID, action, fmt.Sprintf("%s via Telegram by %s", verb, cb.From)); err != nil {
+		log.Printf("ERROR acknowledging event %s in Zabbix: %v", eventID, err)
+		h.answer(cb, "Zabbix API error, see bot logs")
+		return
+	}
+
+	entry.Ack = &store.Acknowledgement{By: cb.From, At: time.Now(), Closed: kind == callbackClose}
+	if err := h.save(context.Background(), eventID, entry); err != nil {
+		h.answer(cb, callbackError(err))
+		return
+	}
+
+	now := time.Now()
+	kb := h.problemKeyboard(eventID, entry.Ack)
+	for _, m := range h.messages(entry) {
+		text := h.renderMessage(entryAlert(eventID, entry), now, entry, m)
+		if err := h.sender(ctx, priorityInteractive).EditMessage(m.ChatID, m.MessageID, text, kb); err != nil {
+			log.Printf("ERROR editing Telegram message %d in chat %d for event %s: %v", m.MessageID, m.ChatID, eventID, err)
+		}
+	}
+	log.Printf("%s event %s by %s", strings.ToUpper(verb), eventID, cb.From)
+	h.answer(cb, verb)
+}
+
+// tracks reports whether the message the button belongs to is one of the
+// messages tracked for entry, so buttons cannot act on other events.
+func (h *Handler) tracks(entry store.Entry, cb bot.Callback) bool {
+	for _, m := range h.messages(entry) {
+		if m.ChatID == cb.ChatID && m.MessageID == cb.MessageID {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackError returns the answer to a button press that failed with err,
+// from lockEvent or the store.
+func callbackError(err error) string {
+	var se *storeError
+	switch {
+	case errors.As(err, &se):
+		return "Store unavailable, try again"
+	case errors.Is(err, errEntryChanged):
+		return "This problem is no longer open"
+	}
+	return "Busy, try again"
+}
+
+func (h *Handler) answer(cb bot.Callback, text string) {
+	if err := h.bot.AnswerCallback(cb.ID, text); err != nil {
+		log.Printf("ERROR answering Telegram callback %s: %v", cb.ID, err)
+	}
+}
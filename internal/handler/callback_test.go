@@ -0,0 +1,145 @@
+package handler_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/zabbix"
+)
+
+// mockAcker records the last event.acknowledge call.
+type mockAcker struct {
+	eventID string
+	action  zabbix.Action
+	message string
+	err     error
+}
+
+func (m *mockAcker) Acknowledge(ctx context.Context, eventID string, action zabbix.Action, message string) error {
+	m.eventID = eventID
+	m.action = action
+	m.message = message
+	return m.err
+}
+
+func TestProblemHasNoButtonsWithoutAcknowledger(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-1", Status: handler.StatusProblem})
+
+	if mb.sentKB != nil {
+		t.Fatalf("expected no keyboard, got %v", mb.sentKB)
+	}
+}
+
+func TestProblemHasAckAndCloseButtons(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithAcknowledger(&mockAcker{}))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-1", Status: handler.StatusProblem})
+
+	want := bot.Keyboard{{Text: "✔️ Ack", Data: "ack:evt-1"}, {Text: "🔒 Close", Data: "close:evt-1"}}
+	if len(mb.sentKB) != 2 || mb.sentKB[0] != want[0] || mb.sentKB[1] != want[1] {
+		t.Fatalf("expected keyboard %v, got %v", want, mb.sentKB)
+	}
+}
+
+func TestAckCallbackAcknowledgesAndEditsMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	acker := &mockAcker{}
+	h := handler.New(mb, s, newRouter(t), "", handler.WithAcknowledger(acker))
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID:     "evt-2",
+		TriggerName: "High CPU",
+		Host:        "server1",
+		Status:      handler.StatusProblem,
+	})
+	h.HandleCallback(bot.Callback{ID: "cb", ChatID: defaultChatID, MessageID: mb.sentMsgID, Data: "ack:evt-2", From: "@alice"})
+
+	if acker.eventID != "evt-2" || acker.action != zabbix.ActionAcknowledge|zabbix.ActionMessage {
+		t.Fatalf("unexpected acknowledge call: %+v", acker)
+	}
+	if !strings.Contains(acker.message, "@alice") {
+		t.Errorf("expected Zabbix message to name the user, got %q", acker.message)
+	}
+	if !strings.Contains(mb.editedText, "Acknowledged") || !strings.Contains(mb.editedText, "@alice") {
+		t.Fatalf("expected edited message to show the acknowledgement, got: %s", mb.editedText)
+	}
+	if !strings.Contains(mb.editedText, "High CPU") || !strings.Contains(mb.editedText, "server1") {
+		t.Fatalf("expected edited message to keep trigger and host, got: %s", mb.editedText)
+	}
+	if len(mb.editedKB) != 1 || mb.editedKB[0].Data != "close:evt-2" {
+		t.Fatalf("expected only the Close button to remain, got %v", mb.editedKB)
+	}
+	entry, _ := s.Get(t.Context(), "evt-2")
+	if entry.Ack == nil || entry.Ack.By != "@alice" || entry.Ack.Closed {
+		t.Fatalf("expected acknowledgement to be stored, got %+v", entry.Ack)
+	}
+	if mb.answered != "Acknowledged" {
+		t.Errorf("expected callback answer 'Acknowledged', got %q", mb.answered)
+	}
+}
+
+func TestCloseCallbackRemovesButtons(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	acker := &mockAcker{}
+	h := handler.New(mb, s, newRouter(t), "", handler.WithAcknowledger(acker))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-3", Status: handler.StatusProblem})
+	h.HandleCallback(bot.Callback{ID: "cb", ChatID: defaultChatID, MessageID: mb.sentMsgID, Data: "close:evt-3", From: "Bob"})
+
+	if acker.action != zabbix.ActionClose|zabbix.ActionMessage {
+		t.Fatalf("expected close action, got %d", acker.action)
+	}
+	if mb.editedKB != nil {
+		t.Fatalf("expected keyboard to be removed, got %v", mb.editedKB)
+	}
+	if !strings.Contains(mb.editedText, "Close requested") {
+		t.Fatalf("expected edited message to show the close request, got: %s", mb.editedText)
+	}
+}
+
+func TestCallbackForUnknownMessageIsRejected(t *testing.T) {
+	mb := &mockBot{}
+	acker := &mockAcker{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithAcknowledger(acker))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-4", Status: handler.StatusProblem})
+	// Button pressed on a different message than the one tracked for the event.
+	h.HandleCallback(bot.Callback{ID: "cb", ChatID: defaultChatID, MessageID: 999, Data: "ack:evt-4", From: "@eve"})
+
+	if acker.eventID != "" {
+		t.Fatal("expected Zabbix not to be called for an untracked message")
+	}
+	if mb.editedText != "" {
+		t.Fatal("expected no message to be edited")
+	}
+}
+
+func TestAckCallbackZabbixError(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithAcknowledger(&mockAcker{err: errors.New("boom")}))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-5", Status: handler.StatusProblem})
+	h.HandleCallback(bot.Callback{ID: "cb", ChatID: defaultChatID, MessageID: mb.sentMsgID, Data: "ack:evt-5", From: "@alice"})
+
+	if mb.editedText != "" {
+		t.Fatal("expected no edit when Zabbix rejects the acknowledgement")
+	}
+	if entry, _ := s.Get(t.Context(), "evt-5"); entry.Ack != nil {
+		t.Fatal("expected no acknowledgement to be stored")
+	}
+	if !strings.Contains(mb.answered, "error") {
+		t.Errorf("expected an error answer, got %q", mb.answered)
+	}
+}
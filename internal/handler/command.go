@@ -0,0 +1,217 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// maxActiveListed caps the number of problems listed by /active. Fewer are
+// listed when their lines would not fit in one message.
+const maxActiveListed = 50
+
+// moreLength is room kept for the "… and N more" line of /active.
+const moreLength = 32
+
+// commandTimeout bounds the store access of a command.
+const commandTimeout = 10 * time.Second
+
+// storeUnavailableText answers a command the store could not serve.
+const storeUnavailableText = "⚠️ Store unavailable, try again later"
+
+const helpText = `<b>Commands</b>
+/active – list the open problems
+/problem &lt;event_id&gt; – show an open problem and link to its message
+/status – uptime, store backend, queues and counts`
+
+// HandleCommand answers the bot commands sent in one of the chats the router
+// delivers to. Commands from any other chat are ignored.
+func (h *Handler) HandleCommand(cmd bot.Command) {
+	if !h.allowedChat(cmd.ChatID) {
+		log.Printf("ignoring /%s from %s in unconfigured chat %d", cmd.Name, cmd.From, cmd.ChatID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	switch cmd.Name {
+	case "active":
+		h.reply(ctx, cmd, h.activeText(ctx))
+	case "problem":
+		h.problemCommand(ctx, cmd)
+	case "status":
+		h.reply(ctx, cmd, h.statusText(ctx))
+	case "help", "start":
+		h.reply(ctx, cmd, helpText)
+	}
+}
+
+func (h *Handler) allowedChat(chatID int64) bool {
+	for _, id := range h.router.Chats() {
+		if id == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// reply answers cmd with text, shortened to fit in a message.
+func (h *Handler) reply(ctx context.Context, cmd bot.Command, text string) {
+	text, _ = fitMessage(text)
+	if _, err := h.sender(ctx, priorityInteractive).ReplyMessage(cmd.ChatID, 0, cmd.MessageID, text); err != nil {
+		log.Printf("ERROR answering /%s in chat %d: %v", cmd.Name, cmd.ChatID, err)
+	}
+}
+
+// activeText lists the open problems held in the store, oldest event first.
+func (h *Handler) activeText(ctx context.Context) string {
+	// Collect into a map: a Redis SCAN may return the same entry twice.
+	all := make(map[string]store.Entry)
+	err := h.store.Scan(ctx, store.Filter{}, func(r store.Record) bool {
+		all[r.EventID] = r.Entry
+		return true
+	})
+	if err != nil {
+		log.Printf("ERROR listing open problems: %v", err)
+		return storeUnavailableText
+	}
+	if len(all) == 0 {
+		return "✅ No open problems"
+	}
+
+	ids := make([]string, 0, len(all))
+	for id := range all {
+		ids = append(ids, id)
+	}
+	store.SortEventIDs(ids)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🔴 <b>%d open problem(s)</b>\n", len(ids)))
+	n := textLength(sb.String())
+	for i, id := range ids {
+		e := all[id]
+		line := fmt.Sprintf("%s <b>%s</b> %s (event %s)", severityEmoji(e.Severity), escapeHTML(e.Host), escapeHTML(e.TriggerName), escapeHTML(id))
+		if !e.StartTime.IsZero() {
+			line += " since " + h.formatTime(e.StartTime)
+		}
+		line += "\n"
+		if n += textLength(line); i == maxActiveListed || n > maxMessageLength-moreLength {
+			sb.WriteString(fmt.Sprintf("… and %d more\n", len(ids)-i))
+			break
+		}
+		sb.WriteString(line)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// problemCommand re-posts the details of one open problem. When the original
+// message lives in the same chat the re-post replies to it, otherwise links
+// to the original messages are appended.
+func (h *Handler) problemCommand(ctx context.Context, cmd bot.Command) {
+	eventID, _, _ := strings.Cut(cmd.Args, " ")
+	if eventID == "" {
+		h.reply(ctx, cmd, "Usage: /problem &lt;event_id&gt;")
+		return
+	}
+	entry, ok, err := h.getEntry(ctx, eventID)
+	if err != nil {
+		h.reply(ctx, cmd, storeUnavailableText)
+		return
+	}
+	if !ok {
+		h.reply(ctx, cmd, fmt.Sprintf("No open problem with event ID %s", escapeHTML(eventID)))
+		return
+	}
+
+	alert, now := entryAlert(eventID, entry), time.Now()
+	msgs := h.messages(entry)
+	for _, m := range msgs {
+		if m.ChatID == cmd.ChatID {
+			text := h.renderMessage(alert, now, entry, m)
+			if _, err := h.sender(ctx, priorityInteractive).ReplyMessage(m.ChatID, m.ThreadID, m.MessageID, text); err != nil {
+				log.Printf("ERROR answering /problem in chat %d: %v", cmd.ChatID, err)
+			}
+			return
+		}
+	}
+	var links strings.Builder
+	for _, m := range msgs {
+		if link := messageLink(m); link != "" {
+			links.WriteString(fmt.Sprintf("\n🔗 <a href=\"%s\">Original message</a>", link))
+		}
+	}
+	// The links are kept: the rendered problem is shortened to make room.
+	text, _ := fitLength(h.render(alert, now, entry, router.Destination{ChatID: cmd.ChatID}), maxMessageLength-textLength(links.String()))
+	h.reply(ctx, cmd, text+links.String())
+}
+
+// statusText reports uptime, the store backend, the delivery queues and open
+// problem counts.
+func (h *Handler) statusText(ctx context.Context) string {
+	total := 0
+	bySeverity := make(map[string]int)
+	scanErr := h.store.Scan(ctx, store.Filter{}, func(r store.Record) bool {
+		total++
+		bySeverity[r.Entry.Severity]++
+		return true
+	})
+	if scanErr != nil {
+		log.Printf("ERROR counting open problems: %v", scanErr)
+	}
+	severities := make([]string, 0, len(bySeverity))
+	for sev := range bySeverity {
+		severities = append(severities, sev)
+	}
+	sort.Strings(severities)
+
+	backend := "unknown"
+	if s, ok := h.store.(fmt.Stringer); ok {
+		backend = s.String()
+	}
+
+	var sb strings.Builder
+	sb.WriteString("ℹ️ <b>Status</b>\n")
+	sb.WriteString(fmt.Sprintf("⏱ <b>Uptime:</b> %s\n", time.Since(h.started).Round(time.Second)))
+	sb.WriteString(fmt.Sprintf("🗄 <b>Store:</b> %s\n", escapeHTML(backend)))
+	sb.WriteString(fmt.Sprintf("💬 <b>Chats:</b> %d\n", len(h.router.Chats())))
+	if q, ok := h.bot.(interface{ QueueDepth() int }); ok {
+		sb.WriteString(fmt.Sprintf("🚦 <b>Telegram queue:</b> %d\n", q.QueueDepth()))
+	}
+	if h.outbox != nil {
+		if st, err := h.outbox.Stats(); err != nil {
+			log.Printf("ERROR reading outbox stats: %v", err)
+		} else {
+			sb.WriteString(fmt.Sprintf("📤 <b>Outbox:</b> %d pending, %d dead\n", st.Pending, st.Dead))
+		}
+	}
+	if scanErr != nil {
+		sb.WriteString("🔴 <b>Open problems:</b> unknown, store unavailable")
+		return sb.String()
+	}
+	sb.WriteString(fmt.Sprintf("🔴 <b>Open problems:</b> %d", total))
+	for _, sev := range severities {
+		label := sev
+		if label == "" {
+			label = "unknown"
+		}
+		sb.WriteString(fmt.Sprintf("\n%s %s: %d", severityEmoji(sev), escapeHTML(label), bySeverity[sev]))
+	}
+	return sb.String()
+}
+
+// messageLink returns the t.me link to a message in a supergroup, or "" for
+// chats that have no public message links.
+func messageLink(m store.Message) string {
+	const supergroupPrefix = -1000000000000
+	if m.ChatID > supergroupPrefix {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/c/%d/%d", -(m.ChatID - supergroupPrefix), m.MessageID)
+}
@@ -0,0 +1,205 @@
+package handler_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestCommandFromUnconfiguredChatIsIgnored(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	h.HandleCommand(bot.Command{ChatID: 12345, MessageID: 1, Name: "status"})
+
+	if len(mb.replies) != 0 {
+		t.Fatalf("expected no reply outside the configured chats, got %+v", mb.replies)
+	}
+}
+
+func TestActiveListsOpenProblems(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	s.Set(t.Context(), "101", store.Entry{Host: "db-01", TriggerName: "Replication lag", Severity: "Disaster"})
+	s.Set(t.Context(), "99", store.Entry{Host: "web-01", TriggerName: "High <CPU>", Severity: "High"})
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 5, Name: "active"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	r := mb.replies[0]
+	if r.replyTo != 5 {
+		t.Errorf("expected reply to the command message, got %d", r.replyTo)
+	}
+	if !strings.Contains(r.text, "2 open problem") {
+		t.Errorf("expected problem count, got: %s", r.text)
+	}
+	if !strings.Contains(r.text, "High &lt;CPU&gt;") {
+		t.Errorf("expected escaped trigger name, got: %s", r.text)
+	}
+	if strings.Index(r.text, "event 99") > strings.Index(r.text, "event 101") {
+		t.Errorf("expected events in numeric order, got: %s", r.text)
+	}
+}
+
+func TestActiveFitsInOneMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	for i := range 60 {
+		s.Set(t.Context(), fmt.Sprint(1000+i), store.Entry{
+			Host:        fmt.Sprintf("prod-eu-west-database-replica-%02d.example.com", i),
+			TriggerName: "MySQL replication lag is too high on the secondary node for more than 15 minutes",
+			Severity:    "High",
+			StartTime:   time.Now(),
+		})
+	}
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 5, Name: "active"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	text := mb.replies[0].text
+	if n := visibleLength(text); n > 4096 {
+		t.Fatalf("expected the list within 4096 characters, got %d", n)
+	}
+	listed := strings.Count(text, "(event ")
+	if want := fmt.Sprintf("… and %d more", 60-listed); listed == 0 || !strings.HasSuffix(text, want) {
+		t.Errorf("expected %q after %d problems, got: %s", want, listed, text)
+	}
+}
+
+func TestActiveWithNoProblems(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 5, Name: "active"})
+
+	if len(mb.replies) != 1 || !strings.Contains(mb.replies[0].text, "No open problems") {
+		t.Fatalf("unexpected replies: %+v", mb.replies)
+	}
+}
+
+func TestProblemCommandRepliesToOriginalMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID:     "300",
+		TriggerName: "Disk full",
+		Host:        "server1",
+		Status:      handler.StatusProblem,
+	})
+	original := mb.sentMsgID
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 50, Name: "problem", Args: "300"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	r := mb.replies[0]
+	if r.replyTo != original {
+		t.Errorf("expected reply to original message %d, got %d", original, r.replyTo)
+	}
+	if !strings.Contains(r.text, "Disk full") || !strings.Contains(r.text, "server1") {
+		t.Errorf("expected problem details, got: %s", r.text)
+	}
+}
+
+func TestProblemCommandLinksToOtherChat(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	s.Set(t.Context(), "301", store.Entry{Messages: []store.Message{{ChatID: -1001234567890, MessageID: 77}}})
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 50, Name: "problem", Args: "301"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	if !strings.Contains(mb.replies[0].text, "https://t.me/c/1234567890/77") {
+		t.Errorf("expected link to the original message, got: %s", mb.replies[0].text)
+	}
+}
+
+func TestProblemCommandKeepsLinksOfLongProblem(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	s.Set(t.Context(), "302", store.Entry{
+		Message:  strings.Repeat("x", 4090),
+		Messages: []store.Message{{ChatID: -1001234567890, MessageID: 77}},
+	})
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 50, Name: "problem", Args: "302"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	text := mb.replies[0].text
+	if n := visibleLength(text); n > 4096 {
+		t.Errorf("expected the reply within 4096 characters, got %d", n)
+	}
+	if !strings.HasSuffix(text, `<a href="https://t.me/c/1234567890/77">Original message</a>`) {
+		t.Errorf("expected the link to be kept, got: …%s", text[len(text)-200:])
+	}
+}
+
+func TestProblemCommandUnknownEvent(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 50, Name: "problem", Args: "404"})
+
+	if len(mb.replies) != 1 || !strings.Contains(mb.replies[0].text, "No open problem") {
+		t.Fatalf("unexpected replies: %+v", mb.replies)
+	}
+}
+
+func TestStatusReportsCounts(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	s.Set(t.Context(), "1", store.Entry{Severity: "High"})
+	s.Set(t.Context(), "2", store.Entry{Severity: "High"})
+	s.Set(t.Context(), "3", store.Entry{Severity: "Disaster"})
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 5, Name: "status"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	text := mb.replies[0].text
+	for _, want := range []string{"Uptime", "in-memory", "Open problems:</b> 3", "High: 2", "Disaster: 1"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("expected status to contain %q, got: %s", want, text)
+		}
+	}
+}
+
+func TestStatusReportsOutbox(t *testing.T) {
+	mb := &mockBot{}
+	ob := &mockOutbox{payloads: [][]byte{[]byte("{}"), []byte("{}")}}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithOutbox(ob))
+
+	h.HandleCommand(bot.Command{ChatID: defaultChatID, MessageID: 5, Name: "status"})
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reply, got %d", len(mb.replies))
+	}
+	if !strings.Contains(mb.replies[0].text, "Outbox:</b> 2 pending, 0 dead") {
+		t.Errorf("expected outbox counts in status, got: %s", mb.replies[0].text)
+	}
+}
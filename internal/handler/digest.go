@@ -0,0 +1,400 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// maxDigestHosts caps the number of hosts named in a digest message.
+const maxDigestHosts = 10
+
+// storm counts PROBLEM arrivals to detect alert storms and tracks the digest
+// messages the PROBLEMs of a storm are aggregated into.
+type storm struct {
+	threshold int
+	window    time.Duration
+	interval  time.Duration
+
+	mu       sync.Mutex
+	arrivals []time.Time
+	// digest is the digest of the ongoing storm, nil outside of one.
+	digest *digest
+	// digests holds the digests posted by this process that still have open
+	// events, by ID.
+	digests map[string]*digest
+	// dirty maps the digest messages waiting to be re-rendered to the ID of
+	// their digest.
+	dirty       map[store.Message]string
+	timer       *time.Timer
+	lastRefresh time.Time
+}
+
+// digest is one rolling summary message per destination chat.
+type digest struct {
+	id       string
+	messages map[router.Destination]*digestMessage
+	// members are the open events aggregated into the digest.
+	members map[string]store.Entry
+}
+
+// digestMessage is the digest message of one destination. ready is closed
+// once the message is posted, or failed to be when ok is false.
+type digestMessage struct {
+	ready chan struct{}
+	msg   store.Message
+	ok    bool
+}
+
+// WithStormDigest aggregates PROBLEMs into a single digest message per chat
+// once more than threshold of them arrive within window, until the rate drops
+// again. Digest messages are edited at most once per interval; zero edits
+// them on every change.
+func WithStormDigest(threshold int, window, interval time.Duration) Option {
+	return func(h *Handler) {
+		h.storm = &storm{
+			threshold: threshold,
+			window:    window,
+			interval:  interval,
+			digests:   make(map[string]*digest),
+			dirty:     make(map[store.Message]string),
+		}
+	}
+}
+
+// arrive records a PROBLEM arriving at now and reports whether it is part of
+// a storm. The digest of a storm that has calmed down is closed, so the next
+// storm starts a new one.
+func (s *storm) arrive(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := now.Add(-s.window)
+	i := 0
+	for i < len(s.arrivals) && !s.arrivals[i].After(cutoff) {
+		i++
+	}
+	s.arrivals = append(s.arrivals[i:], now)
+	if len(s.arrivals) > s.threshold {
+		return true
+	}
+	if s.digest != nil {
+		d := s.digest
+		s.digest = nil
+		s.forget(d.id)
+	}
+	return false
+}
+
+// forget drops digest id once it is closed and has no open event left; its
+// messages have then been rendered as resolved. The caller holds s.mu.
+func (s *storm) forget(id string) {
+	if d, ok := s.digests[id]; ok && d != s.digest && len(d.members) == 0 {
+		delete(s.digests, id)
+	}
+}
+
+// records returns the open events of digest id shown in message m. ok is
+// false when the digest was not posted by this process, or before a restart.
+func (s *storm) records(id string, m store.Message) (records []store.Record, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.digests[id]
+	if !ok {
+		return nil, false
+	}
+	for eventID, e := range d.members {
+		if hasMessage(e.Messages, m) {
+			records = append(records, store.Record{EventID: eventID, Entry: e})
+		}
+	}
+	return records, true
+}
+
+// aggregate adds a PROBLEM to the digest of the ongoing storm, posting the
+// digest message to the destinations that do not have one yet. The storm is
+// only locked to update the digest, not while Telegram is called.
+func (h *Handler) aggregate(ctx context.Context, alert ZabbixAlert, now time.Time) error {
+	entry := h.problemEntry(alert, now)
+	s := h.storm
+	s.mu.Lock()
+	if s.digest == nil {
+		s.digest = &digest{
+			id:       fmt.Sprintf("storm-%d", now.UnixNano()),
+			messages: make(map[router.Destination]*digestMessage),
+			members:  make(map[string]store.Entry),
+		}
+		s.digests[s.digest.id] = s.digest
+	}
+	d := s.digest
+	entry.Digest = d.id
+	// The first PROBLEM routed to a destination posts its digest message;
+	// the others wait for it and have it edited.
+	var post, wait []router.Destination
+	for _, dst := range h.router.Match(alert.Severity, alert.Host, alert.TriggerName) {
+		if _, ok := d.messages[dst]; ok {
+			wait = append(wait, dst)
+			continue
+		}
+		d.messages[dst] = &digestMessage{ready: make(chan struct{})}
+		post = append(post, dst)
+	}
+	dms := maps.Clone(d.messages)
+	s.mu.Unlock()
+
+	var lastErr error
+	for _, dst := range post {
+		text := h.formatDigest([]store.Record{{EventID: alert.EventID, Entry: entry}}, now, h.destinationCatalog(dst))
+		msgID, err := h.sender(ctx, alertPriority(alert)).SendMessage(dst.ChatID, dst.ThreadID, text, nil)
+		dm := dms[dst]
+		s.mu.Lock()
+		if err != nil {
+			log.Printf("ERROR sending digest message to chat %d (topic %d) for event %s: %v", dst.ChatID, dst.ThreadID, alert.EventID, err)
+			lastErr = err
+			// The next PROBLEM for the destination tries again.
+			delete(d.messages, dst)
+		} else {
+			dm.msg, dm.ok = store.Message{ChatID: dst.ChatID, ThreadID: dst.ThreadID, MessageID: msgID}, true
+			entry.Messages = append(entry.Messages, dm.msg)
+			// Counted before the PROBLEMs waiting for the message edit it.
+			d.members[alert.EventID] = entry
+		}
+		close(dm.ready)
+		s.mu.Unlock()
+	}
+	var existing []store.Message
+	for _, dst := range wait {
+		dm := dms[dst]
+		select {
+		case <-dm.ready:
+		case <-ctx.Done():
+			lastErr = ctx.Err()
+			continue
+		}
+		if dm.ok {
+			entry.Messages = append(entry.Messages, dm.msg)
+			existing = append(existing, dm.msg)
+		}
+	}
+
+	if len(entry.Messages) == 0 {
+		if lastErr == nil {
+			lastErr = errors.New("no digest message could be posted")
+		}
+		return &deliveryError{msg: "failed to send Telegram message", err: lastErr}
+	}
+	s.mu.Lock()
+	d.members[alert.EventID] = entry
+	s.mu.Unlock()
+	// A retry finds the digest messages posted, so it only stores the entry.
+	ctx = context.WithoutCancel(ctx)
+	if err := h.store.Set(ctx, alert.EventID, entry); err != nil {
+		return storeFailed(alert.EventID, err)
+	}
+	h.scheduleDigest(ctx, entry.Digest, existing...)
+	log.Printf("PROBLEM alert for event %s aggregated into digest %s", alert.EventID, entry.Digest)
+	return nil
+}
+
+// refreshDigest records that event eventID of the digest of entry changed,
+// or was resolved when open is false, and schedules the digest messages of
+// the event to be re-rendered.
+func (h *Handler) refreshDigest(ctx context.Context, eventID string, entry store.Entry, open bool) {
+	if s := h.storm; s != nil {
+		s.mu.Lock()
+		if d, ok := s.digests[entry.Digest]; ok {
+			if open {
+				d.members[eventID] = entry
+			} else {
+				delete(d.members, eventID)
+			}
+		}
+		s.mu.Unlock()
+	}
+	h.scheduleDigest(ctx, entry.Digest, entry.Messages...)
+}
+
+// scheduleDigest schedules the digest messages msgs of digest id to be
+// re-rendered, at most once per storm interval.
+func (h *Handler) scheduleDigest(ctx context.Context, id string, msgs ...store.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	s := h.storm
+	if s == nil || s.interval <= 0 {
+		// Entries aggregated while digests were enabled are still resolved
+		// after they have been turned off.
+		for _, m := range msgs {
+			h.editDigest(ctx, id, m)
+		}
+		if s != nil {
+			s.mu.Lock()
+			s.forget(id)
+			s.mu.Unlock()
+		}
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range msgs {
+		s.dirty[m] = id
+	}
+	if s.timer == nil {
+		delay := max(time.Until(s.lastRefresh.Add(s.interval)), 0)
+		s.timer = time.AfterFunc(delay, h.flushDigests)
+	}
+}
+
+// flushDigests re-renders every digest message scheduled by scheduleDigest.
+func (h *Handler) flushDigests() {
+	s := h.storm
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[store.Message]string)
+	s.timer = nil
+	s.lastRefresh = time.Now()
+	s.mu.Unlock()
+
+	for m, id := range dirty {
+		h.editDigest(context.Background(), id, m)
+	}
+	s.mu.Lock()
+	for _, id := range dirty {
+		s.forget(id)
+	}
+	s.mu.Unlock()
+}
+
+// editDigest renders digest message m from its open events and edits it in
+// place. The events of a digest this process does not hold are read from the
+// store; the message is left as is when the store cannot be read, rather
+// than shown as resolved.
+func (h *Handler) editDigest(ctx context.Context, id string, m store.Message) {
+	var records []store.Record
+	var ok bool
+	if h.storm != nil {
+		records, ok = h.storm.records(id, m)
+	}
+	if !ok {
+		seen := make(map[string]bool)
+		err := h.store.Scan(ctx, store.Filter{Digest: id}, func(r store.Record) bool {
+			if !seen[r.EventID] && hasMessage(r.Entry.Messages, m) {
+				seen[r.EventID] = true
+				records = append(records, r)
+			}
+			return true
+		})
+		if err != nil {
+			log.Printf("ERROR reading digest %s, message %d in chat %d not edited: %v", id, m.MessageID, m.ChatID, err)
+			return
+		}
+	}
+
+	lang := h.destinationCatalog(router.Destination{ChatID: m.ChatID, ThreadID: m.ThreadID})
+	if err := h.sender(ctx, digestPriority(records)).EditMessage(m.ChatID, m.MessageID, h.formatDigest(records, time.Now(), lang), nil); err != nil {
+		log.Printf("ERROR editing digest message %d in chat %d for digest %s: %v", m.MessageID, m.ChatID, id, err)
+	}
+}
+
+func hasMessage(msgs []store.Message, m store.Message) bool {
+	for _, x := range msgs {
+		if x.ChatID == m.ChatID && x.MessageID == m.MessageID {
+			return true
+		}
+	}
+	return false
+}
+
+// formatDigest builds the digest message summarising the open problems in
+// records: counts by severity, the most affected hosts and when the storm
+// began, labelled with lang. An empty records renders the digest as
+// resolved.
+func (h *Handler) formatDigest(records []store.Record, now time.Time, lang *i18n.Catalog) string {
+	if len(records) == 0 {
+		return fmt.Sprintf("✅ <b>%s</b>\n%s\n🕑 <b>%s:</b> %s", lang.Label("storm_resolved"), lang.Label("storm_resolved_text"), lang.Label("end_time"), h.formatTime(now))
+	}
+
+	bySeverity := make(map[string]int)
+	byHost := make(map[string]int)
+	var since time.Time
+	for _, r := range records {
+		bySeverity[r.Entry.Severity]++
+		byHost[r.Entry.Host]++
+		if since.IsZero() || r.Entry.StartTime.Before(since) {
+			since = r.Entry.StartTime
+		}
+	}
+
+	severities := make([]string, 0, len(bySeverity))
+	for sev := range bySeverity {
+		severities = append(severities, sev)
+	}
+	sort.Slice(severities, func(i, j int) bool {
+		a, b := severities[i], severities[j]
+		if pa, pb := severityPriority(a), severityPriority(b); pa != pb {
+			return pa > pb
+		}
+		return a < b
+	})
+
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		a, b := hosts[i], hosts[j]
+		if byHost[a] != byHost[b] {
+			return byHost[a] > byHost[b]
+		}
+		return a < b
+	})
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("🌩 <b>%s</b>\n", lang.Label("alert_storm")))
+	sb.WriteString(fmt.Sprintf("🔴 <b>%s</b>\n", fmt.Sprintf(lang.Label("storm_problems"), len(records), len(hosts))))
+	for _, sev := range severities {
+		label := lang.Severity(sev)
+		if label == "" {
+			label = lang.Label("unknown")
+		}
+		sb.WriteString(fmt.Sprintf("%s %s: %d\n", severityEmoji(sev), escapeHTML(label), bySeverity[sev]))
+	}
+	names := make([]string, 0, maxDigestHosts)
+	for i, host := range hosts {
+		if i == maxDigestHosts {
+			names = append(names, fmt.Sprintf(lang.Label("and_more"), len(hosts)-maxDigestHosts))
+			break
+		}
+		if host == "" {
+			host = lang.Label("unknown")
+		}
+		names = append(names, fmt.Sprintf("%s (%d)", escapeHTML(host), byHost[hosts[i]]))
+	}
+	sb.WriteString(fmt.Sprintf("🖥 <b>%s:</b> %s\n", lang.Label("hosts"), strings.Join(names, ", ")))
+	sb.WriteString(fmt.Sprintf("🕐 <b>%s:</b> %s", lang.Label("since"), h.formatTime(since)))
+	return sb.String()
+}
+
+// digestPriority is the priority of an edit of a digest message: that of its
+// most severe problem, or of a RESOLVED edit once every problem is resolved.
+func digestPriority(records []store.Record) bot.Priority {
+	if len(records) == 0 {
+		return priorityResolved
+	}
+	p := severityPriority(records[0].Entry.Severity)
+	for _, r := range records[1:] {
+		p = max(p, severityPriority(r.Entry.Severity))
+	}
+	return p
+}
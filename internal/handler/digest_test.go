@@ -0,0 +1,161 @@
+package handler_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestStormAggregatesIntoDigest(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithStormDigest(2, time.Minute, 0))
+
+	for i, sev := range []string{"High", "High", "Disaster", "High", "Warning"} {
+		resp := postAlert(t, h, handler.ZabbixAlert{
+			EventID:  fmt.Sprint(i + 1),
+			Status:   handler.StatusProblem,
+			Severity: sev,
+			Host:     fmt.Sprintf("host-%d", i%2),
+		})
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", resp.Code)
+		}
+	}
+
+	// Two individual messages, then one digest for the remaining three.
+	if len(mb.sentChats) != 3 {
+		t.Fatalf("expected 3 messages to be sent, got %d", len(mb.sentChats))
+	}
+	digestID := mb.sentMsgID
+	for _, id := range []string{"3", "4", "5"} {
+		e, _ := s.Get(t.Context(), id)
+		if e.Digest == "" || len(e.Messages) != 1 || e.Messages[0].MessageID != digestID {
+			t.Fatalf("expected event %s to reference digest message %d, got %+v", id, digestID, e)
+		}
+	}
+	if mb.editedMsgID != digestID {
+		t.Fatalf("expected the digest message to be edited, got %d", mb.editedMsgID)
+	}
+	for _, want := range []string{"3 problem(s) on 2 host(s)", "Disaster: 1", "High: 1", "Warning: 1"} {
+		if !strings.Contains(mb.editedText, want) {
+			t.Errorf("expected digest to contain %q, got: %s", want, mb.editedText)
+		}
+	}
+	if i, j := strings.Index(mb.editedText, "Disaster"), strings.Index(mb.editedText, "Warning"); i > j {
+		t.Errorf("expected severities ordered from Disaster down, got: %s", mb.editedText)
+	}
+}
+
+func TestStormResolvedUpdatesDigest(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithStormDigest(1, time.Minute, 0))
+
+	for _, id := range []string{"1", "2", "3"} {
+		postAlert(t, h, handler.ZabbixAlert{EventID: id, Status: handler.StatusProblem, Severity: "High", Host: "sw-" + id})
+	}
+	sent := len(mb.sentChats)
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusResolved})
+	if len(mb.sentChats) != sent {
+		t.Fatal("expected no new message for a RESOLVED of an aggregated event")
+	}
+	if _, err := s.Get(t.Context(), "2"); err == nil {
+		t.Error("expected the resolved event to be removed from the store")
+	}
+	if !strings.Contains(mb.editedText, "1 problem(s) on 1 host(s)") {
+		t.Errorf("expected the digest counts to drop, got: %s", mb.editedText)
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "3", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "Alert storm resolved") {
+		t.Errorf("expected the digest to be marked resolved, got: %s", mb.editedText)
+	}
+}
+
+func TestStormDigestInRouteLanguage(t *testing.T) {
+	routes := []config.Route{{Host: "sw-*", Language: "de", Destinations: []config.Destination{{ChatID: routeChatID}}}}
+	langs, err := handler.NewLanguages("", routes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, routes...), "", handler.WithLanguages(langs), handler.WithStormDigest(1, time.Minute, 0))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "sw-1"})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem, Severity: "High", Host: "sw-2"})
+	if len(mb.sentChats) != 2 || mb.sentChats[1] != routeChatID {
+		t.Fatalf("expected the digest in the route's chat, got %v", mb.sentChats)
+	}
+	for _, want := range []string{"🌩 <b>Alarmsturm</b>", "1 Problem(e) auf 1 Host(s)", "Hoch: 1", "<b>Hosts:</b> sw-2 (1)", "<b>Seit:</b>"} {
+		if !strings.Contains(mb.sentText, want) {
+			t.Errorf("expected the German digest to contain %q, got: %s", want, mb.sentText)
+		}
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "✅ <b>Alarmsturm behoben</b>") || !strings.Contains(mb.editedText, "<b>Ende:</b>") {
+		t.Errorf("expected the German resolved digest, got: %s", mb.editedText)
+	}
+}
+
+func TestStormEndsWhenRateDrops(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithStormDigest(1, 20*time.Millisecond, 0))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem})
+	if e, _ := s.Get(t.Context(), "2"); e.Digest == "" {
+		t.Fatal("expected the second PROBLEM to be aggregated")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "3", Status: handler.StatusProblem})
+	if e, _ := s.Get(t.Context(), "3"); e.Digest != "" {
+		t.Error("expected PROBLEMs to be posted individually after the storm")
+	}
+}
+
+// scanCountingStore is a MessageStore counting the calls to Scan.
+type scanCountingStore struct {
+	*store.MessageStore
+	scans int
+}
+
+func (c *scanCountingStore) Scan(ctx context.Context, f store.Filter, fn func(store.Record) bool) error {
+	c.scans++
+	return c.MessageStore.Scan(ctx, f, fn)
+}
+
+func TestStormDigestKeepsItsEvents(t *testing.T) {
+	mb := &mockBot{}
+	s := &scanCountingStore{MessageStore: store.New()}
+	h := handler.New(mb, s, newRouter(t), "", handler.WithStormDigest(1, time.Minute, 0))
+
+	for _, id := range []string{"1", "2", "3"} {
+		postAlert(t, h, handler.ZabbixAlert{EventID: id, Status: handler.StatusProblem, Severity: "High", Host: "sw-" + id})
+	}
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "1 problem(s) on 1 host(s)") {
+		t.Fatalf("expected the digest counts to drop, got: %s", mb.editedText)
+	}
+	if s.scans != 0 {
+		t.Errorf("expected the digest to be rendered without reading the store, got %d scan(s)", s.scans)
+	}
+
+	// After a restart the open events of the digest are read from the store.
+	h = handler.New(mb, s, newRouter(t), "", handler.WithStormDigest(1, time.Minute, 0))
+	postAlert(t, h, handler.ZabbixAlert{EventID: "3", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "Alert storm resolved") || s.scans != 1 {
+		t.Errorf("expected the digest to be resolved from the store, got %d scan(s): %s", s.scans, mb.editedText)
+	}
+}
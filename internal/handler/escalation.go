@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/escalation"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// priorityEscalation is the priority of escalation reposts: they are only
+// made for problems that have already waited too long.
+const priorityEscalation = priorityInteractive
+
+// WithEscalations makes RunEscalations repost the problems that stay open
+// and unacknowledged to the chats of the matching policy's steps.
+func WithEscalations(p *escalation.Policies) Option {
+	return func(h *Handler) { h.escalations = p }
+}
+
+// RunEscalations takes the due escalation steps, starting with those that
+// fell due while the bot was down, until ctx is cancelled. It returns at once
+// when escalations are not enabled.
+func (h *Handler) RunEscalations(ctx context.Context) {
+	if h.escalations == nil {
+		return
+	}
+	// A walk under way is completed on shutdown.
+	walk := context.WithoutCancel(ctx)
+	h.escalate(walk, time.Now())
+	check := min(maxCheckInterval, h.escalations.Shortest())
+	if check <= 0 {
+		return
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.escalate(walk, now)
+		}
+	}
+}
+
+// dueEscalation lists the escalation steps due for an open problem.
+type dueEscalation struct {
+	entry store.Entry
+	steps []escalation.Step
+	open  time.Duration
+}
+
+// escalate walks the open problems and takes the escalation steps that are
+// due. Each step reposts the problem to its destinations; the new messages
+// are tracked with the event, so they are resolved and acknowledged with it.
+func (h *Handler) escalate(ctx context.Context, now time.Time) {
+	var pending []string
+	work := make(map[string]dueEscalation)
+	err := h.store.Scan(ctx, store.Filter{}, func(r store.Record) bool {
+		e := r.Entry
+		if e.Ack != nil || e.Digest != "" || e.StartTime.IsZero() {
+			return true
+		}
+		open := e.OpenFor(now)
+		steps := h.escalations.Match(e.Severity, e.HostGroups)
+		n := 0
+		for n < len(steps) && steps[n].After <= open {
+			n++
+		}
+		if _, seen := work[r.EventID]; !seen && n > e.Escalation {
+			pending = append(pending, r.EventID)
+			work[r.EventID] = dueEscalation{entry: e, steps: steps[e.Escalation:n], open: open}
+		}
+		return true
+	})
+	if err != nil {
+		// The problems walked so far are still escalated.
+		log.Printf("ERROR walking open problems for escalations: %v", err)
+	}
+
+	for _, id := range pending {
+		h.escalateEvent(ctx, id, work[id], now)
+	}
+}
+
+// escalateEvent takes the due steps of one event, holding its lock.
+func (h *Handler) escalateEvent(ctx context.Context, id string, w dueEscalation, now time.Time) {
+	unlock, err := h.lockEvent(ctx, id)
+	if err != nil {
+		return // retried on the next walk
+	}
+	defer unlock()
+
+	// The event may have been resolved, acknowledged or escalated by another
+	// replica since the walk, or still be being posted.
+	entry, ok, err := h.getEntry(ctx, id)
+	if err != nil || !ok || entry.Ack != nil || entry.Escalation != w.entry.Escalation || h.pending(entry) {
+		return
+	}
+	alert := entryAlert(id, entry)
+	kb := h.problemKeyboard(id, nil)
+	var posted []store.Message
+	failed := false
+	for _, st := range w.steps {
+		for _, d := range st.Destinations {
+			if hasChat(h.messages(entry), d.ChatID) || hasChat(posted, d.ChatID) {
+				continue
+			}
+			text := h.renderWithHeader(formatEscalation(w.open, h.catalogOf(alert, entry, d)), alert, now, entry, d)
+			msgID, err := h.sender(ctx, priorityEscalation).SendMessage(d.ChatID, d.ThreadID, text, kb)
+			if err != nil {
+				log.Printf("ERROR escalating event %s to chat %d (topic %d): %v", id, d.ChatID, d.ThreadID, err)
+				failed = true
+				continue
+			}
+			posted = append(posted, store.Message{ChatID: d.ChatID, ThreadID: d.ThreadID, MessageID: msgID})
+		}
+	}
+
+	entry.Messages = append(h.messages(entry), posted...)
+	entry.MessageID = 0
+	if !failed {
+		// Otherwise the steps are retried on the next walk; the chats
+		// already reached are skipped then.
+		entry.Escalation += len(w.steps)
+	}
+	if h.save(context.WithoutCancel(ctx), id, entry) != nil {
+		return
+	}
+	log.Printf("event %s escalated to step %d (%d new message(s))", id, entry.Escalation, len(posted))
+}
+
+func hasChat(msgs []store.Message, chatID int64) bool {
+	for _, m := range msgs {
+		if m.ChatID == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+// formatEscalation returns the header prepended to an escalation repost,
+// labelled with lang.
+func formatEscalation(open time.Duration, lang *i18n.Catalog) string {
+	return fmt.Sprintf("🚨 <b>%s</b> – %s\n", lang.Label("escalated"), fmt.Sprintf(lang.Label("escalated_open_for"), formatDuration(open.Truncate(time.Minute))))
+}
@@ -0,0 +1,156 @@
+package handler_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/escalation"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+const (
+	managersChatID  = -200
+	directorsChatID = -300
+)
+
+func newEscalations(t *testing.T) *escalation.Policies {
+	t.Helper()
+	p, err := escalation.New([]config.Escalation{{
+		Severities: []string{"Disaster", "High"},
+		HostGroups: []string{"Databases/*"},
+		Steps: []config.EscalationStep{
+			{After: 30 * time.Minute, Destinations: []config.Destination{{ChatID: managersChatID}}},
+			{After: 2 * time.Hour, Destinations: []config.Destination{{ChatID: directorsChatID, ThreadID: 3}}},
+		},
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return p
+}
+
+// escalateOnce runs one walk of the open problems.
+func escalateOnce(h *handler.Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.RunEscalations(ctx)
+}
+
+func TestEscalationSteps(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithEscalations(newEscalations(t)))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "db-01", HostGroup: "Linux servers, Databases/MySQL"})
+	e, _ := s.Get(t.Context(), "1")
+	if len(e.HostGroups) != 2 || e.HostGroups[1] != "Databases/MySQL" {
+		t.Fatalf("expected the host groups to be stored, got %v", e.HostGroups)
+	}
+
+	escalateOnce(h)
+	if len(mb.sentChats) != 1 {
+		t.Fatalf("expected no escalation before the first step, got %d messages", len(mb.sentChats))
+	}
+
+	e.StartTime = time.Now().Add(-45 * time.Minute)
+	s.Set(t.Context(), "1", e)
+	escalateOnce(h)
+	if len(mb.sentChats) != 2 || mb.sentChats[1] != managersChatID {
+		t.Fatalf("expected a repost to the managers' chat, got %v", mb.sentChats)
+	}
+	if !strings.Contains(mb.sentText, "ESCALATED</b> – open for 45m") || !strings.Contains(mb.sentText, "db-01") {
+		t.Errorf("unexpected escalation message: %s", mb.sentText)
+	}
+	escalateOnce(h)
+	if len(mb.sentChats) != 2 {
+		t.Fatalf("expected a step to be taken once, got %v", mb.sentChats)
+	}
+
+	e, _ = s.Get(t.Context(), "1")
+	if e.Escalation != 1 || len(e.Messages) != 2 {
+		t.Fatalf("expected the progress and the repost to be stored, got %+v", e)
+	}
+	e.StartTime = time.Now().Add(-3 * time.Hour)
+	s.Set(t.Context(), "1", e)
+	escalateOnce(h)
+	if len(mb.sentChats) != 3 || mb.sentChats[2] != directorsChatID || mb.sentThreads[2] != 3 {
+		t.Fatalf("expected a repost to the third chat, got %v", mb.sentChats)
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusResolved})
+	if len(mb.editedChats) != 3 {
+		t.Errorf("expected the RESOLVED to edit every escalated message, got %v", mb.editedChats)
+	}
+	escalateOnce(h)
+	if len(mb.sentChats) != 3 {
+		t.Errorf("expected no escalation after RESOLVED, got %v", mb.sentChats)
+	}
+}
+
+func TestEscalationSkipsAcknowledgedAndUnmatched(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithEscalations(newEscalations(t)))
+
+	start := time.Now().Add(-time.Hour)
+	s.Set(t.Context(), "1", store.Entry{StartTime: start, Severity: "High", HostGroups: []string{"Databases/MySQL"},
+		Ack: &store.Acknowledgement{By: "alice", At: time.Now()}})
+	s.Set(t.Context(), "2", store.Entry{StartTime: start, Severity: "Warning", HostGroups: []string{"Databases/MySQL"}})
+	s.Set(t.Context(), "3", store.Entry{StartTime: start, Severity: "High", HostGroups: []string{"Web servers"}})
+	escalateOnce(h)
+	if len(mb.sentChats) != 0 {
+		t.Errorf("expected no escalation, got %v", mb.sentChats)
+	}
+}
+
+func TestEscalationInLanguage(t *testing.T) {
+	langs, err := handler.NewLanguages("it", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithLanguages(langs), handler.WithEscalations(newEscalations(t)))
+
+	s.Set(t.Context(), "1", store.Entry{
+		StartTime:  time.Now().Add(-45 * time.Minute),
+		Severity:   "High",
+		Host:       "db-01",
+		HostGroups: []string{"Databases/MySQL"},
+		Messages:   []store.Message{{ChatID: defaultChatID, MessageID: 1}},
+	})
+	escalateOnce(h)
+	if !strings.Contains(mb.sentText, "🚨 <b>ESCALATO</b> – aperto da 45m") {
+		t.Errorf("expected the Italian escalation header, got: %s", mb.sentText)
+	}
+}
+
+func TestEscalationOfLongDetailsFits(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithEscalations(newEscalations(t)))
+
+	s.Set(t.Context(), "1", store.Entry{
+		StartTime:  time.Now().Add(-time.Hour),
+		Severity:   "High",
+		Host:       "db-01",
+		HostGroups: []string{"Databases/MySQL"},
+		// Fits in a message, but not together with the ESCALATED header.
+		Message:  strings.Repeat("x", 3980),
+		Messages: []store.Message{{ChatID: defaultChatID, MessageID: 1}},
+	})
+	escalateOnce(h)
+	if len(mb.sentChats) != 1 || !strings.Contains(mb.sentText, "ESCALATED") {
+		t.Fatalf("expected an escalation repost, got %v", mb.sentChats)
+	}
+	if n := visibleLength(mb.sentText); n > 4096 {
+		t.Errorf("expected the repost within 4096 characters, got %d", n)
+	}
+	if !strings.Contains(mb.sentText, "x…\n") || !strings.Contains(mb.sentText, "Start Time:") {
+		t.Errorf("expected the Details to be shortened, keeping the rest: ...%s", mb.sentText[len(mb.sentText)-200:])
+	}
+}
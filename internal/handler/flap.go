@@ -0,0 +1,295 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// flapTracker counts the PROBLEM / RESOLVED transitions of every trigger over
+// a sliding window to detect flapping triggers.
+type flapTracker struct {
+	threshold int
+	window    time.Duration
+
+	mu       sync.Mutex
+	triggers map[string]*flapState
+}
+
+// flapState is the transition history of one trigger. Its mutex is held while
+// an alert of the trigger is handled, so alerts of the same trigger are
+// processed one at a time.
+type flapState struct {
+	mu          sync.Mutex
+	transitions []time.Time
+	timer       *time.Timer
+	// removed is set once the state has been dropped from the tracker.
+	removed bool
+
+	// messages are the collapsed messages of a flapping trigger, nil while
+	// the trigger is not flapping.
+	messages []store.Message
+	alert    ZabbixAlert
+	since    time.Time
+	total    int
+}
+
+// WithFlapDetection collapses a trigger into a single message, edited with a
+// transition counter, once it changes state more than threshold times within
+// window. It is posted normally again once it has stabilised.
+func WithFlapDetection(threshold int, window time.Duration) Option {
+	return func(h *Handler) {
+		h.flaps = &flapTracker{threshold: threshold, window: window, triggers: make(map[string]*flapState)}
+	}
+}
+
+// lock returns the locked state of a trigger, creating it if needed.
+func (f *flapTracker) lock(triggerID string) *flapState {
+	for {
+		f.mu.Lock()
+		st, ok := f.triggers[triggerID]
+		if !ok {
+			st = &flapState{}
+			f.triggers[triggerID] = st
+		}
+		f.mu.Unlock()
+
+		st.mu.Lock()
+		if !st.removed {
+			return st
+		}
+		st.mu.Unlock()
+	}
+}
+
+// prune drops the transitions that left the window.
+func (st *flapState) prune(now time.Time, window time.Duration) {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(st.transitions) && !st.transitions[i].After(cutoff) {
+		i++
+	}
+	st.transitions = st.transitions[i:]
+}
+
+// flap records a transition of the alert's trigger. It reports whether the
+// alert was handled as part of a flapping trigger; otherwise the caller
+// processes it normally.
+func (h *Handler) flap(ctx context.Context, alert ZabbixAlert, now time.Time) (bool, error) {
+	f := h.flaps
+	st := f.lock(alert.TriggerID)
+	defer st.mu.Unlock()
+
+	st.prune(now, f.window)
+	st.transitions = append(st.transitions, now)
+	if st.timer == nil {
+		id := alert.TriggerID
+		st.timer = time.AfterFunc(f.window, func() { h.settleFlap(id) })
+	} else {
+		st.timer.Reset(f.window)
+	}
+	st.alert = mergeFlapAlert(st.alert, alert)
+
+	if len(st.transitions) <= f.threshold {
+		if st.messages != nil {
+			h.editFlap(ctx, st, now, true)
+			st.messages = nil
+			log.Printf("trigger %s stopped flapping", alert.TriggerID)
+		}
+		return false, nil
+	}
+
+	if st.messages == nil {
+		return true, h.startFlap(ctx, st, alert, now)
+	}
+
+	st.total++
+	switch alert.Status {
+	case StatusProblem:
+		entry := h.problemEntry(alert, now)
+		entry.Messages = st.messages
+		if err := h.store.Set(ctx, alert.EventID, entry); err != nil {
+			return true, storeFailed(alert.EventID, err)
+		}
+	case StatusResolved:
+		entry, ok, err := h.getEntry(ctx, alert.EventID)
+		if err != nil {
+			return true, err
+		}
+		if ok {
+			if !collapsed(st.messages, h.messages(entry)) {
+				if err := h.resolve(ctx, alert, now); err != nil {
+					return true, err
+				}
+			} else if err := h.store.Delete(ctx, alert.EventID); err != nil {
+				return true, storeFailed(alert.EventID, err)
+			}
+		}
+	}
+	h.editFlap(ctx, st, now, false)
+	log.Printf("%s alert for event %s collapsed into flapping trigger %s", alert.Status, alert.EventID, alert.TriggerID)
+	return true, nil
+}
+
+// startFlap posts the collapsed message of a trigger that just started
+// flapping. A RESOLVED first resolves the message of its own PROBLEM.
+func (h *Handler) startFlap(ctx context.Context, st *flapState, alert ZabbixAlert, now time.Time) error {
+	if alert.Status == StatusResolved {
+		if err := h.resolve(ctx, alert, now); err != nil {
+			return err
+		}
+	}
+
+	st.since = now
+	st.total = len(st.transitions)
+	text := func(d router.Destination) string {
+		return h.formatFlap(st, h.flaps.window, now, false, h.catalogOf(st.alert, store.Entry{}, d))
+	}
+	msgs, err := h.sendAll(ctx, st.alert, text, nil)
+	if len(msgs) == 0 {
+		return &deliveryError{msg: "failed to send Telegram message", err: err}
+	}
+	st.messages = msgs
+	if alert.Status == StatusProblem {
+		entry := h.problemEntry(alert, now)
+		entry.Messages = msgs
+		// A retry finds the trigger flapping, so it only stores the entry.
+		if err := h.store.Set(context.WithoutCancel(ctx), alert.EventID, entry); err != nil {
+			return storeFailed(alert.EventID, err)
+		}
+	}
+	log.Printf("trigger %s is flapping (%d transitions in %s)", alert.TriggerID, len(st.transitions), formatDuration(h.flaps.window))
+	return nil
+}
+
+// settleFlap runs once a trigger has had no transition for a whole window:
+// its state is dropped and, if it was flapping, its message is finalised.
+func (h *Handler) settleFlap(triggerID string) {
+	f := h.flaps
+	f.mu.Lock()
+	st, ok := f.triggers[triggerID]
+	if !ok {
+		f.mu.Unlock()
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	st.prune(now, f.window)
+	if len(st.transitions) > 0 {
+		// A transition arrived meanwhile and rescheduled the timer.
+		f.mu.Unlock()
+		return
+	}
+	st.removed = true
+	delete(f.triggers, triggerID)
+	f.mu.Unlock()
+
+	if st.messages != nil {
+		h.editFlap(context.Background(), st, now, true)
+		log.Printf("trigger %s stopped flapping", triggerID)
+	}
+}
+
+// editFlap re-renders the collapsed messages of a trigger.
+func (h *Handler) editFlap(ctx context.Context, st *flapState, now time.Time, stopped bool) {
+	for _, m := range st.messages {
+		d := router.Destination{ChatID: m.ChatID, ThreadID: m.ThreadID}
+		text := h.formatFlap(st, h.flaps.window, now, stopped, h.catalogOf(st.alert, store.Entry{}, d))
+		if err := h.sender(ctx, severityPriority(st.alert.Severity)).EditMessage(m.ChatID, m.MessageID, text, nil); err != nil {
+			log.Printf("ERROR editing flapping message %d in chat %d for trigger %s: %v", m.MessageID, m.ChatID, st.alert.TriggerID, err)
+		}
+	}
+}
+
+// collapses reports whether msgs are the collapsed messages of trigger
+// triggerID while it is flapping.
+func (f *flapTracker) collapses(triggerID string, msgs []store.Message) bool {
+	f.mu.Lock()
+	st, ok := f.triggers[triggerID]
+	f.mu.Unlock()
+	if !ok {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return collapsed(st.messages, msgs)
+}
+
+// collapsed reports whether msgs are the collapsed messages of a trigger, as
+// opposed to the messages of a PROBLEM posted before it started flapping.
+func collapsed(flapping, msgs []store.Message) bool {
+	for _, m := range msgs {
+		if hasMessage(flapping, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFlapAlert returns the latest alert of a trigger, keeping the details a
+// RESOLVED may omit from the previous one.
+func mergeFlapAlert(prev, next ZabbixAlert) ZabbixAlert {
+	if next.TriggerName == "" {
+		next.TriggerName = prev.TriggerName
+	}
+	if next.Host == "" {
+		next.Host = prev.Host
+	}
+	if next.Severity == "" {
+		next.Severity = prev.Severity
+	}
+	return next
+}
+
+// formatFlap builds the collapsed message of a flapping trigger, or of one
+// that stopped flapping, labelled with lang.
+func (h *Handler) formatFlap(st *flapState, window time.Duration, now time.Time, stopped bool, lang *i18n.Catalog) string {
+	a := st.alert
+	var sb strings.Builder
+	if stopped {
+		sb.WriteString(fmt.Sprintf("✅ <b>%s</b>\n", lang.Label("stopped_flapping_header")))
+	} else {
+		sb.WriteString(fmt.Sprintf("🔁 <b>%s</b>\n", lang.Label("flapping_header")))
+	}
+	if a.TriggerName != "" {
+		sb.WriteString(fmt.Sprintf("🔔 <b>%s:</b> %s\n", lang.Label("trigger"), escapeHTML(a.TriggerName)))
+	}
+	if a.Host != "" {
+		sb.WriteString(fmt.Sprintf("🖥 <b>%s:</b> %s\n", lang.Label("host"), escapeHTML(a.Host)))
+	}
+	if a.Severity != "" {
+		sb.WriteString(fmt.Sprintf("%s <b>%s:</b> %s\n", severityEmoji(a.Severity), lang.Label("severity"), escapeHTML(lang.Severity(a.Severity))))
+	}
+	state := fmt.Sprintf("%s %s", statusEmoji(a.Status), escapeHTML(lang.Status(string(a.Status))))
+	if stopped {
+		sb.WriteString(fmt.Sprintf("🔄 <b>%s:</b> %s\n", lang.Label("flapped"), fmt.Sprintf(lang.Label("transitions"), st.total)))
+		sb.WriteString(fmt.Sprintf("📍 <b>%s:</b> %s\n", lang.Label("last_state"), state))
+		sb.WriteString(fmt.Sprintf("🕐 <b>%s:</b> %s\n", lang.Label("flapping_since"), h.formatTime(st.since)))
+		sb.WriteString(fmt.Sprintf("🕑 <b>%s:</b> %s", lang.Label("stable_since"), h.formatTime(now)))
+	} else {
+		sb.WriteString(fmt.Sprintf("🔄 <b>%s:</b> %s\n", lang.Label("flapping"), fmt.Sprintf(lang.Label("transitions_in"), len(st.transitions), formatDuration(window))))
+		sb.WriteString(fmt.Sprintf("📍 <b>%s:</b> %s\n", lang.Label("current_state"), state))
+		sb.WriteString(fmt.Sprintf("🕐 <b>%s:</b> %s", lang.Label("flapping_since"), h.formatTime(st.since)))
+	}
+	return sb.String()
+}
+
+// formatDuration formats d without zero trailing units ("30m", "1h30m").
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
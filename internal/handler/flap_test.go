@@ -0,0 +1,141 @@
+package handler_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// toggle posts a PROBLEM or a RESOLVED of trigger "t1", event n, alternately.
+func toggle(t *testing.T, h *handler.Handler, n int) {
+	t.Helper()
+	status := handler.StatusProblem
+	if n%2 == 0 {
+		status = handler.StatusResolved
+	}
+	postAlert(t, h, handler.ZabbixAlert{
+		TriggerID:   "t1",
+		TriggerName: "Link down",
+		EventID:     fmt.Sprint((n + 1) / 2),
+		Status:      status,
+		Severity:    "High",
+		Host:        "sw-1",
+	})
+}
+
+func TestFlappingTriggerCollapsed(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithFlapDetection(3, 30*time.Minute))
+
+	// Three transitions are posted normally: PROBLEM, RESOLVED (edit), PROBLEM.
+	for n := 1; n <= 3; n++ {
+		toggle(t, h, n)
+	}
+	if len(mb.sentChats) != 2 {
+		t.Fatalf("expected 2 messages before flapping, got %d", len(mb.sentChats))
+	}
+
+	// The fourth starts flapping: event 2 is resolved and one flap message sent.
+	toggle(t, h, 4)
+	if len(mb.sentChats) != 3 {
+		t.Fatalf("expected one flapping message, got %d messages", len(mb.sentChats))
+	}
+	flapID := mb.sentMsgID
+	if !strings.Contains(mb.sentText, "FLAPPING") || !strings.Contains(mb.sentText, "4 transitions in 30m") {
+		t.Errorf("unexpected flapping message: %s", mb.sentText)
+	}
+	if _, err := s.Get(t.Context(), "2"); err == nil {
+		t.Error("expected the PROBLEM posted before flapping to be resolved")
+	}
+
+	for n := 5; n <= 9; n++ {
+		toggle(t, h, n)
+	}
+	if len(mb.sentChats) != 3 {
+		t.Fatalf("expected no new message while flapping, got %d", len(mb.sentChats))
+	}
+	if mb.editedMsgID != flapID || !strings.Contains(mb.editedText, "9 transitions in 30m") {
+		t.Errorf("expected the flap counter to be edited, got message %d: %s", mb.editedMsgID, mb.editedText)
+	}
+	if !strings.Contains(mb.editedText, "Current state:</b> 🔴 PROBLEM") {
+		t.Errorf("expected the current state in the flap message, got: %s", mb.editedText)
+	}
+	if e, err := s.Get(t.Context(), "5"); err != nil || e.Messages[0].MessageID != flapID {
+		t.Fatalf("expected the open PROBLEM to reference the flap message, got %+v", e)
+	}
+
+	toggle(t, h, 10)
+	if _, err := s.Get(t.Context(), "5"); err == nil {
+		t.Error("expected the RESOLVED to remove the collapsed event")
+	}
+	if len(mb.sentChats) != 3 {
+		t.Errorf("expected no new message for a collapsed RESOLVED, got %d", len(mb.sentChats))
+	}
+}
+
+func TestFlappingInRouteLanguage(t *testing.T) {
+	routes := []config.Route{{Host: "sw-*", Language: "de", Destinations: []config.Destination{{ChatID: routeChatID}}}}
+	langs, err := handler.NewLanguages("", routes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, routes...), "", handler.WithLanguages(langs), handler.WithFlapDetection(1, 30*time.Minute))
+
+	toggle(t, h, 1)
+	toggle(t, h, 2)
+	if len(mb.sentChats) != 2 || mb.sentChats[1] != routeChatID {
+		t.Fatalf("expected the flapping message in the route's chat, got %v", mb.sentChats)
+	}
+	for _, want := range []string{"🔁 <b>FLATTERN</b>", "<b>Schweregrad:</b> Hoch", "2 Wechsel in 30m", "<b>Aktueller Zustand:</b> ✅ BEHOBEN"} {
+		if !strings.Contains(mb.sentText, want) {
+			t.Errorf("expected the German flapping message to contain %q, got: %s", want, mb.sentText)
+		}
+	}
+}
+
+func TestFlappingOtherTriggersUnaffected(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithFlapDetection(1, 30*time.Minute))
+
+	for i := 1; i <= 3; i++ {
+		postAlert(t, h, handler.ZabbixAlert{TriggerID: fmt.Sprint(i), EventID: fmt.Sprint(i), Status: handler.StatusProblem})
+	}
+	if len(mb.sentChats) != 3 || strings.Contains(mb.sentText, "FLAPPING") {
+		t.Errorf("expected one regular message per trigger, got %d: %s", len(mb.sentChats), mb.sentText)
+	}
+}
+
+func TestFlappingStopsWhenStable(t *testing.T) {
+	mb := &mockBot{edits: make(chan string, 10)}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithFlapDetection(1, 30*time.Millisecond))
+
+	toggle(t, h, 1)
+	toggle(t, h, 2)
+	flapID := mb.sentMsgID
+
+	// The flap message is finalised by a timer once the window has passed.
+	for text := ""; !strings.Contains(text, "STOPPED FLAPPING"); {
+		select {
+		case text = <-mb.edits:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the flap message to be finalised")
+		}
+	}
+	if mb.editedMsgID != flapID || !strings.Contains(mb.editedText, "STOPPED FLAPPING") {
+		t.Errorf("expected the flap message to be finalised, got message %d: %s", mb.editedMsgID, mb.editedText)
+	}
+
+	sent := len(mb.sentChats)
+	toggle(t, h, 3)
+	if len(mb.sentChats) != sent+1 || strings.Contains(mb.sentText, "FLAPPING") {
+		t.Errorf("expected a stable trigger to be posted normally, got: %s", mb.sentText)
+	}
+}
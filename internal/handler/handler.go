@@ -3,21 +3,59 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/escalation"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/outbox"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/zabbix"
 )
 
 // Sender is the interface the handler uses to interact with Telegram.
 // Using an interface makes the handler easy to test without a real bot.
 type Sender interface {
-	SendMessage(text string) (int, error)
-	EditMessage(messageID int, text string) error
+	SendMessage(chatID int64, threadID int, text string, kb bot.Keyboard) (int, error)
+	EditMessage(chatID int64, messageID int, text string, kb bot.Keyboard) error
+	ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error)
+	ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error)
+	AnswerCallback(callbackID, text string) error
+}
+
+// prioritizer is implemented by senders that queue requests by priority,
+// giving up on the requests whose context is done before their turn.
+type prioritizer interface {
+	WithContext(ctx context.Context, p bot.Priority) bot.Messenger
+}
+
+// Request priorities: edits resolving a problem and answers to users go
+// before new messages, which are ordered by severity (see severityPriority).
+const (
+	priorityResolved    bot.Priority = 10
+	priorityInteractive bot.Priority = 10
+)
+
+// Acknowledger is the interface the handler uses to acknowledge and close
+// events in Zabbix when the inline buttons are pressed.
+type Acknowledger interface {
+	Acknowledge(ctx context.Context, eventID string, action zabbix.Action, message string) error
+}
+
+// Enqueuer is the interface the handler uses to hand alerts over to the
+// outbox for asynchronous delivery.
+type Enqueuer interface {
+	Enqueue(key string, payload []byte) error
+	Stats() (outbox.Stats, error)
 }
 
 // AlertStatus represents the status field sent by Zabbix.
@@ -26,8 +64,13 @@ type AlertStatus string
 const (
 	StatusProblem  AlertStatus = "PROBLEM"
 	StatusResolved AlertStatus = "RESOLVED"
+	StatusUpdate   AlertStatus = "UPDATE"
 
 	timeFormat = "2006-01-02 15:04:05 MST"
+
+	// zabbixTimeLayout is the layout of Zabbix's {EVENT.DATE} and
+	// {EVENT.TIME} macros, joined by a space.
+	zabbixTimeLayout = "2006.01.02 15:04:05"
 )
 
 // ZabbixAlert is the JSON payload POSTed by Zabbix.
@@ -37,23 +80,156 @@ type ZabbixAlert struct {
 	Status      AlertStatus `json:"status"`
 	Severity    string      `json:"severity"`
 	Host        string      `json:"host"`
+	HostGroup   string      `json:"host_group"`
 	EventID     string      `json:"event_id"`
 	Message     string      `json:"message"`
 	Secret      string      `json:"secret"`
+
+	// Update operations (status UPDATE) carry who made the update, what was
+	// done and the comment, from {USER.FULLNAME}, {EVENT.UPDATE.ACTION} and
+	// {EVENT.UPDATE.MESSAGE}.
+	UpdateUser    string `json:"update_user"`
+	UpdateAction  string `json:"update_action"`
+	UpdateMessage string `json:"update_message"`
+
+	// The clock of the event in Zabbix, from {EVENT.DATE} and {EVENT.TIME},
+	// and of its recovery, from {EVENT.RECOVERY.DATE} and
+	// {EVENT.RECOVERY.TIME}, in the bot's local time zone. The Unix
+	// timestamps take precedence when set. Without them the time the alert
+	// is received is used.
+	EventDate              string    `json:"event_date"`
+	EventTime              string    `json:"event_time"`
+	EventRecoveryDate      string    `json:"event_recovery_date"`
+	EventRecoveryTime      string    `json:"event_recovery_time"`
+	EventTimestamp         Timestamp `json:"event_timestamp"`
+	EventRecoveryTimestamp Timestamp `json:"event_recovery_timestamp"`
+}
+
+// Timestamp is a Unix time in seconds, accepted as a JSON number or string.
+// Values that are not a number, such as macros Zabbix left unexpanded,
+// decode as zero.
+type Timestamp int64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		n = 0
+	}
+	*t = Timestamp(n)
+	return nil
+}
+
+// startTime returns when the event started in Zabbix, or zero when the alert
+// does not say. A date and time without a timestamp are read in loc.
+func (a ZabbixAlert) startTime(loc *time.Location) time.Time {
+	return eventClock(a.EventTimestamp, a.EventDate, a.EventTime, loc)
+}
+
+// recoveryTime returns when the event recovered in Zabbix, or zero when the
+// alert does not say. A date and time without a timestamp are read in loc.
+func (a ZabbixAlert) recoveryTime(loc *time.Location) time.Time {
+	return eventClock(a.EventRecoveryTimestamp, a.EventRecoveryDate, a.EventRecoveryTime, loc)
+}
+
+func eventClock(ts Timestamp, date, clock string, loc *time.Location) time.Time {
+	if ts > 0 {
+		return time.Unix(int64(ts), 0)
+	}
+	if date == "" || clock == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(zabbixTimeLayout, date+" "+clock, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// eventSpan returns the start and, for RESOLVED, the end of the event an
+// alert received at now belongs to: the stored start of its PROBLEM, else the
+// Zabbix clock carried by the alert, read in loc, else now. The start of a
+// RESOLVED is zero when unknown.
+func eventSpan(a ZabbixAlert, now time.Time, entry store.Entry, loc *time.Location) (start, end time.Time) {
+	start = entry.StartTime
+	if start.IsZero() {
+		start = a.startTime(loc)
+	}
+	if a.Status != StatusResolved {
+		if start.IsZero() {
+			start = now
+		}
+		return start, time.Time{}
+	}
+	end = a.recoveryTime(loc)
+	if end.IsZero() {
+		end = now
+	}
+	return start, end
 }
 
 // Handler processes incoming Zabbix alerts.
 type Handler struct {
-	bot    Sender
-	store  store.Store
-	secret string
+	bot             Sender
+	store           store.Store
+	router          *router.Router
+	secret          string
+	acker           Acknowledger
+	outbox          Enqueuer
+	storm           *storm
+	flaps           *flapTracker
+	reminders       *reminders
+	escalations     *escalation.Policies
+	templates       *Templates
+	detailsDocument bool
+	languages       *Languages
+	location        *time.Location
+	timeLayout      string
+	locks           *store.KeyedMutex
+	started         time.Time
 }
 
-// New creates a Handler wired to the given Telegram sender and message store.
-// If secret is non-empty every incoming request must carry a matching "secret"
-// field in its JSON body; otherwise the request is rejected with 401.
-func New(bot Sender, s store.Store, secret string) *Handler {
-	return &Handler{bot: bot, store: s, secret: secret}
+// Option configures optional Handler behaviour.
+type Option func(*Handler)
+
+// WithAcknowledger attaches "Ack" / "Close" buttons to PROBLEM messages and
+// forwards presses to Zabbix through a.
+func WithAcknowledger(a Acknowledger) Option {
+	return func(h *Handler) { h.acker = a }
+}
+
+// WithOutbox makes ServeHTTP queue alerts in q and answer 202 Accepted
+// instead of delivering them before responding. The outbox worker must call
+// Deliver for every queued alert.
+func WithOutbox(q Enqueuer) Option {
+	return func(h *Handler) { h.outbox = q }
+}
+
+// WithDisplayTime shows timestamps in loc with layout instead of the local
+// time zone and timeFormat. Zabbix dates and times sent without a timestamp
+// are read in loc too; a nil loc keeps the local time zone.
+func WithDisplayTime(loc *time.Location, layout string) Option {
+	return func(h *Handler) {
+		if loc != nil {
+			h.location = loc
+		}
+		h.timeLayout = layout
+	}
+}
+
+// New creates a Handler wired to the given Telegram sender, message store and
+// router. If secret is non-empty every incoming request must carry a matching
+// "secret" field in its JSON body; otherwise the request is rejected with 401.
+func New(bot Sender, s store.Store, r *router.Router, secret string, opts ...Option) *Handler {
+	h := &Handler{bot: bot, store: s, router: r, secret: secret, location: time.Local, timeLayout: timeFormat, locks: store.NewKeyedMutex(), started: time.Now()}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.templates != nil {
+		h.templates = h.templates.withTime(h.formatTime)
+	}
+	return h
 }
 
 // ServeHTTP handles POST /zabbix/alert requests.
@@ -79,111 +255,563 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch alert.Status {
-	case StatusProblem:
-		now := time.Now()
-		text := formatMessage(alert, now, "", "")
-		msgID, err := h.bot.SendMessage(text)
+	if h.outbox != nil {
+		alert.Secret = ""
+		payload, err := json.Marshal(alert)
+		if err == nil {
+			err = h.outbox.Enqueue(alert.EventID, payload)
+		}
 		if err != nil {
-			log.Printf("ERROR sending Telegram message for event %s: %v", alert.EventID, err)
-			http.Error(w, "failed to send Telegram message", http.StatusInternalServerError)
+			log.Printf("ERROR queueing alert for event %s: %v", alert.EventID, err)
+			http.Error(w, "failed to queue alert", http.StatusInternalServerError)
 			return
 		}
-		h.store.Set(alert.EventID, store.Entry{
-			MessageID: msgID,
-			StartTime: now.Format(timeFormat),
-			Message:   alert.Message,
-			Severity:  alert.Severity,
-		})
-		log.Printf("PROBLEM alert sent for event %s (message %d)", alert.EventID, msgID)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 
-	case StatusResolved:
-		if entry, ok := h.store.Get(alert.EventID); ok {
-			if alert.Severity == "" && entry.Severity != "" {
-				alert.Severity = entry.Severity
-			}
-			text := formatMessage(alert, time.Now(), entry.StartTime, entry.Message)
-			if err := h.bot.EditMessage(entry.MessageID, text); err != nil {
-				log.Printf("ERROR editing Telegram message %d for event %s: %v", entry.MessageID, alert.EventID, err)
-				http.Error(w, "failed to edit Telegram message", http.StatusInternalServerError)
-				return
-			}
-			h.store.Delete(alert.EventID)
-			log.Printf("RESOLVED alert updated for event %s (message %d)", alert.EventID, entry.MessageID)
-		} else {
-			// No tracked message found – send a new one so the resolution is not lost.
-			text := formatMessage(alert, time.Now(), "", "")
-			msgID, err := h.bot.SendMessage(text)
-			if err != nil {
-				log.Printf("ERROR sending Telegram message for resolved event %s: %v", alert.EventID, err)
-				http.Error(w, "failed to send Telegram message", http.StatusInternalServerError)
-				return
-			}
-			log.Printf("RESOLVED alert sent (no prior message tracked) for event %s (message %d)", alert.EventID, msgID)
+	if err := h.process(r.Context(), alert); err != nil {
+		var se *storeError
+		if errors.As(err, &se) {
+			http.Error(w, "store unavailable, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		msg := err.Error()
+		var de *deliveryError
+		if errors.As(err, &de) {
+			msg = de.msg // the cause is logged already
 		}
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Deliver processes an alert queued by ServeHTTP. It is the delivery function
+// of the outbox worker, which retries it while it returns an error.
+func (h *Handler) Deliver(payload []byte) error {
+	var alert ZabbixAlert
+	if err := json.Unmarshal(payload, &alert); err != nil {
+		return fmt.Errorf("decoding queued alert: %w", err)
+	}
+	return h.process(context.Background(), alert)
+}
+
+// deliveryError reports that Telegram could not be reached for an alert.
+type deliveryError struct {
+	msg string
+	err error
+}
+
+func (e *deliveryError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return e.msg + ": " + e.err.Error()
+}
+
+func (e *deliveryError) Unwrap() error { return e.err }
+
+// storeError reports that the store could not be reached for an alert, as
+// opposed to the event having no entry (store.ErrNotFound). The webhook
+// answers 503 so that it is retried rather than taken for an untracked event.
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string { return "store unavailable: " + e.err.Error() }
+
+func (e *storeError) Unwrap() error { return e.err }
+
+// storeFailed logs an error returned by the store for an event and wraps it
+// in a *storeError.
+func storeFailed(eventID string, err error) error {
+	log.Printf("ERROR store access for event %s: %v", eventID, err)
+	return &storeError{err: err}
+}
+
+// getEntry returns the entry of eventID and whether it exists. It fails only
+// when the store could not be reached.
+func (h *Handler) getEntry(ctx context.Context, eventID string) (store.Entry, bool, error) {
+	entry, err := h.store.Get(ctx, eventID)
+	if errors.Is(err, store.ErrNotFound) {
+		return store.Entry{}, false, nil
+	}
+	if err != nil {
+		return store.Entry{}, false, storeFailed(eventID, err)
+	}
+	return entry, true, nil
+}
+
+// errEntryChanged reports that an entry was written, e.g. by another
+// replica, between being read and written back.
+var errEntryChanged = &deliveryError{msg: "event changed concurrently, retry later"}
+
+// errProblemPending reports that the PROBLEM of an event is still being sent,
+// by another replica.
+var errProblemPending = &deliveryError{msg: "PROBLEM still being sent, retry later"}
+
+// pending reports whether entry is the claim of a PROBLEM whose messages are
+// still being sent (see problem).
+func (h *Handler) pending(entry store.Entry) bool {
+	return entry.Digest == "" && len(h.messages(entry)) == 0
+}
+
+// abandoned reports whether entry is a claim left by a process that stopped
+// before tracking the messages of its PROBLEM. Claims are written and
+// completed holding the lock of their event, so when that lock is shared
+// through the store, a claim seen by the next holder was abandoned.
+// Otherwise another replica may still be posting, and a claim only counts as
+// abandoned once older than lockTimeout.
+func (h *Handler) abandoned(entry store.Entry, now time.Time) bool {
+	if !h.pending(entry) {
+		return false
+	}
+	if _, shared := h.store.(store.Locker); shared {
+		return true
+	}
+	return entry.Claimed == nil || now.Sub(*entry.Claimed) > lockTimeout
+}
+
+// trackedEntry is getEntry for an alert of the event, holding its lock. An
+// abandoned claim is deleted and reported missing, so that the alert is
+// posted on its own instead of waiting for messages that never come; a claim
+// still being completed fails with errProblemPending.
+func (h *Handler) trackedEntry(ctx context.Context, eventID string, now time.Time) (store.Entry, bool, error) {
+	entry, ok, err := h.getEntry(ctx, eventID)
+	if err != nil || !ok || !h.pending(entry) {
+		return entry, ok, err
+	}
+	if !h.abandoned(entry, now) {
+		return store.Entry{}, false, errProblemPending
+	}
+	log.Printf("ERROR event %s was claimed by a PROBLEM whose messages were never tracked, dropping the claim", eventID)
+	if err := h.store.Delete(ctx, eventID); err != nil {
+		return store.Entry{}, false, storeFailed(eventID, err)
+	}
+	return store.Entry{}, false, nil
+}
+
+// save writes back an entry read from the store, failing with
+// errEntryChanged when it was written or removed in the meantime.
+func (h *Handler) save(ctx context.Context, eventID string, entry store.Entry) error {
+	ok, err := h.store.CompareAndSet(ctx, eventID, entry)
+	if err != nil {
+		return storeFailed(eventID, err)
+	}
+	if !ok {
+		log.Printf("ERROR event %s changed concurrently, not saved", eventID)
+		return errEntryChanged
+	}
+	return nil
+}
+
+// process sends or edits the Telegram messages for one alert and updates the
+// store, holding the lock of its event. It returns a *deliveryError when the
+// alert should be retried, or a *storeError when the store is unavailable.
+// Cancelling ctx abandons the alert, and the requests to Telegram still
+// waiting for their turn; the store is updated regardless, so that the
+// messages already sent remain tracked.
+func (h *Handler) process(ctx context.Context, alert ZabbixAlert) error {
+	unlock, err := h.lockEvent(ctx, alert.EventID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := ctx.Err(); err != nil {
+		// Zabbix gave up on the request while it waited for the lock.
+		return &deliveryError{msg: "request cancelled", err: err}
+	}
+
+	now := time.Now()
+	if alert.Status == StatusProblem {
+		// Checked first so a duplicate counts neither as a flap transition
+		// nor towards a storm.
+		entry, ok, err := h.trackedEntry(ctx, alert.EventID, now)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return h.repeatProblem(ctx, alert, now, entry)
+		}
+	}
+	if h.flaps != nil && alert.TriggerID != "" && (alert.Status == StatusProblem || alert.Status == StatusResolved) {
+		if handled, err := h.flap(ctx, alert, now); handled {
+			return err
+		}
+	}
 
+	switch alert.Status {
+	case StatusProblem:
+		return h.problem(ctx, alert, now)
+	case StatusResolved:
+		return h.resolve(ctx, alert, now)
+	case StatusUpdate:
+		return h.update(ctx, alert, now)
 	default:
 		// Unknown status – send as a plain informational message.
-		text := formatMessage(alert, time.Now(), "", "")
-		msgID, err := h.bot.SendMessage(text)
+		msgs, err := h.sendAll(ctx, alert, h.renderAll(alert, now, store.Entry{}), nil)
+		if len(msgs) == 0 {
+			return &deliveryError{msg: "failed to send Telegram message", err: err}
+		}
+		h.sendDetails(ctx, alert, now, store.Entry{}, msgs)
+		log.Printf("INFO alert sent for event %s (%d message(s))", alert.EventID, len(msgs))
+		return nil
+	}
+}
+
+// problem posts a new PROBLEM, or adds it to the storm digest during a storm.
+func (h *Handler) problem(ctx context.Context, alert ZabbixAlert, now time.Time) error {
+	if h.storm != nil && h.storm.arrive(now) {
+		return h.aggregate(ctx, alert, now)
+	}
+	// The event is claimed before its messages are sent, so that of several
+	// replicas racing on it only one posts them.
+	entry := h.problemEntry(alert, now)
+	entry.Claimed = &now
+	claimed, err := h.store.SetIfAbsent(ctx, alert.EventID, entry)
+	if err != nil {
+		return storeFailed(alert.EventID, err)
+	}
+	if !claimed {
+		current, ok, err := h.trackedEntry(ctx, alert.EventID, now)
 		if err != nil {
-			log.Printf("ERROR sending Telegram message for event %s: %v", alert.EventID, err)
-			http.Error(w, "failed to send Telegram message", http.StatusInternalServerError)
-			return
+			return err
 		}
-		log.Printf("INFO alert sent for event %s (message %d)", alert.EventID, msgID)
+		if ok {
+			return h.repeatProblem(ctx, alert, now, current)
+		}
+		return errEntryChanged
 	}
+	entry.Version++ // as stored
 
-	w.WriteHeader(http.StatusOK)
+	// The sends give up when the request is cancelled, but the claim must
+	// then be released or completed whatever happens.
+	detached := context.WithoutCancel(ctx)
+	msgs, err := h.sendAll(ctx, alert, h.renderAll(alert, now, store.Entry{}), h.problemKeyboard(alert.EventID, nil))
+	if len(msgs) == 0 {
+		if err := h.store.Delete(detached, alert.EventID); err != nil {
+			log.Printf("ERROR releasing event %s after its PROBLEM failed: %v", alert.EventID, err)
+		}
+		return &deliveryError{msg: "failed to send Telegram message", err: err}
+	}
+	entry.Messages = msgs
+	entry.Claimed = nil
+	if ok, err := h.store.CompareAndSet(detached, alert.EventID, entry); err != nil {
+		log.Printf("ERROR event %s could not be updated after its PROBLEM was sent, its message(s) are not tracked: %v", alert.EventID, err)
+	} else if !ok {
+		log.Printf("ERROR event %s changed while its PROBLEM was sent, its message(s) are not tracked", alert.EventID)
+	}
+	h.sendDetails(ctx, alert, now, store.Entry{}, msgs)
+	log.Printf("PROBLEM alert sent for event %s (%d message(s))", alert.EventID, len(msgs))
+	return nil
+}
+
+// repeatProblem handles a PROBLEM for an event that already has an entry, as
+// when Zabbix retries a webhook that timed out: the stored details are
+// refreshed and the messages already posted are edited instead of posting new
+// ones.
+func (h *Handler) repeatProblem(ctx context.Context, alert ZabbixAlert, now time.Time, entry store.Entry) error {
+	fresh := h.problemEntry(alert, now)
+	if fresh.Message != "" {
+		entry.Message = fresh.Message
+	}
+	if fresh.Severity != "" {
+		entry.Severity = fresh.Severity
+	}
+	if fresh.TriggerName != "" {
+		entry.TriggerName = fresh.TriggerName
+	}
+	if fresh.Host != "" {
+		entry.Host = fresh.Host
+	}
+	if len(fresh.HostGroups) > 0 {
+		entry.HostGroups = fresh.HostGroups
+	}
+	if entry.StartTime.IsZero() {
+		entry.StartTime = fresh.StartTime
+	}
+	if err := h.save(ctx, alert.EventID, entry); err != nil {
+		return err
+	}
+
+	if entry.Digest != "" {
+		h.refreshDigest(context.WithoutCancel(ctx), alert.EventID, entry, true)
+		log.Printf("Repeated PROBLEM alert for event %s recorded in digest %s", alert.EventID, entry.Digest)
+		return nil
+	}
+	if h.flaps != nil && alert.TriggerID != "" && h.flaps.collapses(alert.TriggerID, h.messages(entry)) {
+		log.Printf("Repeated PROBLEM alert for event %s recorded for flapping trigger %s", alert.EventID, alert.TriggerID)
+		return nil
+	}
+	if err := h.editProblem(ctx, alert.EventID, entry, now); err != nil {
+		return err
+	}
+	log.Printf("Repeated PROBLEM alert for event %s applied to its %d message(s)", alert.EventID, len(h.messages(entry)))
+	return nil
+}
+
+// editProblem re-renders every message of an open problem from its entry.
+func (h *Handler) editProblem(ctx context.Context, eventID string, entry store.Entry, now time.Time) error {
+	alert := entryAlert(eventID, entry)
+	kb := h.problemKeyboard(eventID, entry.Ack)
+	var lastErr error
+	for _, m := range h.messages(entry) {
+		text := h.renderMessage(alert, now, entry, m)
+		if err := h.sender(ctx, severityPriority(entry.Severity)).EditMessage(m.ChatID, m.MessageID, text, kb); err != nil {
+			log.Printf("ERROR editing Telegram message %d in chat %d for event %s: %v", m.MessageID, m.ChatID, eventID, err)
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return &deliveryError{msg: "failed to edit Telegram message", err: lastErr}
+	}
+	return nil
+}
+
+// resolve edits the messages tracked for a RESOLVED event, or posts a new
+// message when none are tracked.
+func (h *Handler) resolve(ctx context.Context, alert ZabbixAlert, now time.Time) error {
+	if _, _, err := h.trackedEntry(ctx, alert.EventID, now); err != nil {
+		return err
+	}
+	// Taken out of the store at once, so that of several replicas racing
+	// on the event only one edits its messages.
+	entry, err := h.store.GetAndDelete(ctx, alert.EventID)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return storeFailed(alert.EventID, err)
+	}
+	detached := context.WithoutCancel(ctx)
+	if err != nil {
+		// No tracked message found – send a new one so the resolution is not lost.
+		msgs, err := h.sendAll(ctx, alert, h.renderAll(alert, now, store.Entry{}), nil)
+		if len(msgs) == 0 {
+			return &deliveryError{msg: "failed to send Telegram message", err: err}
+		}
+		h.sendDetails(ctx, alert, now, store.Entry{}, msgs)
+		log.Printf("RESOLVED alert sent (no prior message tracked) for event %s (%d message(s))", alert.EventID, len(msgs))
+		return nil
+	}
+
+	if entry.Digest != "" {
+		h.refreshDigest(detached, alert.EventID, entry, false)
+		log.Printf("RESOLVED alert for event %s removed from digest %s", alert.EventID, entry.Digest)
+		return nil
+	}
+	if alert.Severity == "" && entry.Severity != "" {
+		alert.Severity = entry.Severity
+	}
+	var failed []store.Message
+	var lastErr error
+	for _, m := range h.messages(entry) {
+		text := h.renderMessage(alert, now, entry, m)
+		if err := h.sender(ctx, priorityResolved).EditMessage(m.ChatID, m.MessageID, text, nil); err != nil {
+			log.Printf("ERROR editing Telegram message %d in chat %d for event %s: %v", m.MessageID, m.ChatID, alert.EventID, err)
+			failed = append(failed, m)
+			lastErr = err
+		}
+	}
+	if len(failed) > 0 {
+		// Keep only the messages that still need editing so a retry
+		// does not touch the ones already resolved.
+		entry.Messages = failed
+		entry.MessageID = 0
+		if _, err := h.store.SetIfAbsent(detached, alert.EventID, entry); err != nil {
+			log.Printf("ERROR event %s could not be restored, its unresolved message(s) are not tracked: %v", alert.EventID, err)
+		}
+		return &deliveryError{msg: "failed to edit Telegram message", err: lastErr}
+	}
+	log.Printf("RESOLVED alert updated for event %s", alert.EventID)
+	return nil
+}
+
+// problemEntry returns the store entry of a PROBLEM arriving at now, without
+// its messages.
+func (h *Handler) problemEntry(alert ZabbixAlert, now time.Time) store.Entry {
+	start, _ := eventSpan(alert, now, store.Entry{}, h.location)
+	return store.Entry{
+		StartTime:   start,
+		Message:     alert.Message,
+		Severity:    alert.Severity,
+		TriggerName: alert.TriggerName,
+		Host:        alert.Host,
+		HostGroups:  hostGroups(alert.HostGroup),
+	}
+}
+
+// hostGroups splits the comma-separated host groups of an alert, as expanded
+// by Zabbix from {TRIGGER.HOSTGROUP.NAME}.
+func hostGroups(s string) []string {
+	var groups []string
+	for _, g := range strings.Split(s, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
 }
 
-// formatMessage builds a human-readable HTML message from the alert payload.
-// now is the current time used as Start Time (PROBLEM) or End Time (RESOLVED).
-// startTime, if non-empty, is the Start Time preserved from the original PROBLEM event.
-// origMessage, if non-empty, is the Details preserved from the original PROBLEM event.
-func formatMessage(a ZabbixAlert, now time.Time, startTime, origMessage string) string {
+// sendAll posts the text returned by text to every destination the alert is
+// routed to and returns the messages that were delivered together with the
+// last error. Failures are logged; the result is empty only when no
+// destination could be reached.
+func (h *Handler) sendAll(ctx context.Context, alert ZabbixAlert, text func(router.Destination) string, kb bot.Keyboard) ([]store.Message, error) {
+	var msgs []store.Message
+	var lastErr error
+	sender := h.sender(ctx, alertPriority(alert))
+	for _, d := range h.router.Match(alert.Severity, alert.Host, alert.TriggerName) {
+		msgID, err := sender.SendMessage(d.ChatID, d.ThreadID, text(d), kb)
+		if err != nil {
+			log.Printf("ERROR sending Telegram message to chat %d (topic %d) for event %s: %v", d.ChatID, d.ThreadID, alert.EventID, err)
+			lastErr = err
+			continue
+		}
+		msgs = append(msgs, store.Message{ChatID: d.ChatID, ThreadID: d.ThreadID, MessageID: msgID})
+	}
+	return msgs, lastErr
+}
+
+// sender returns the sender to use for a request of priority p. Senders that
+// queue requests, such as bot.Scheduler, serve higher priorities first.
+func (h *Handler) sender(ctx context.Context, p bot.Priority) Sender {
+	if ps, ok := h.bot.(prioritizer); ok {
+		return ps.WithContext(ctx, p)
+	}
+	return h.bot
+}
+
+// messages returns the Telegram messages tracked for entry. Entries written
+// before routing was introduced only carry a message ID, which always refers
+// to the default chat.
+func (h *Handler) messages(entry store.Entry) []store.Message {
+	if len(entry.Messages) == 0 && entry.MessageID != 0 {
+		d := h.router.Default()
+		return []store.Message{{ChatID: d.ChatID, ThreadID: d.ThreadID, MessageID: entry.MessageID}}
+	}
+	return entry.Messages
+}
+
+// entryAlert rebuilds the PROBLEM alert for a stored entry so its message can
+// be rendered again outside of a webhook request.
+func entryAlert(eventID string, entry store.Entry) ZabbixAlert {
+	return ZabbixAlert{
+		EventID:     eventID,
+		TriggerName: entry.TriggerName,
+		Host:        entry.Host,
+		HostGroup:   strings.Join(entry.HostGroups, ", "),
+		Severity:    entry.Severity,
+		Message:     entry.Message,
+		Status:      StatusProblem,
+	}
+}
+
+// formatMessage builds a human-readable HTML message from the alert payload,
+// labelled in the language of lang.
+// now is the current time used as Start Time (PROBLEM) or End Time (RESOLVED)
+// when the alert does not carry the Zabbix event clock. entry is the data
+// stored for the original PROBLEM event, if any: its Start Time, Details,
+// acknowledgement and updates are preserved in the rendered message.
+// header is put before the message. Details too long for a Telegram message,
+// header included, are shortened.
+func (h *Handler) formatMessage(a ZabbixAlert, now time.Time, entry store.Entry, lang *i18n.Catalog, header string) string {
+	details := alertDetails(a, entry)
+	text := header + h.layoutMessage(a, now, entry, lang, details)
+	if over := textLength(text) - maxMessageLength; over > 0 && details != "" {
+		keep := textLength(escapeHTML(details)) - over - 1 // room for "…"
+		text = header + h.layoutMessage(a, now, entry, lang, cutText(details, max(keep, 0))+"…")
+	}
+	text, _ = fitMessage(text)
+	return text
+}
+
+// alertDetails returns the Details shown for an alert. A RESOLVED keeps the
+// Details of its PROBLEM.
+func alertDetails(a ZabbixAlert, entry store.Entry) string {
+	if a.Status == StatusResolved && entry.Message != "" {
+		return entry.Message
+	}
+	return a.Message
+}
+
+// layoutMessage lays out the message of formatMessage with the given Details.
+func (h *Handler) layoutMessage(a ZabbixAlert, now time.Time, entry store.Entry, lang *i18n.Catalog, details string) string {
 	var sb strings.Builder
 
 	statusEmoji := statusEmoji(a.Status)
-	sb.WriteString(fmt.Sprintf("%s <b>%s</b>\n", statusEmoji, escapeHTML(string(a.Status))))
+	sb.WriteString(fmt.Sprintf("%s <b>%s</b>\n", statusEmoji, escapeHTML(lang.Status(string(a.Status)))))
 	if a.TriggerName != "" {
-		sb.WriteString(fmt.Sprintf("🔔 <b>Trigger:</b> %s\n", escapeHTML(a.TriggerName)))
+		sb.WriteString(fmt.Sprintf("🔔 <b>%s:</b> %s\n", lang.Label("trigger"), escapeHTML(a.TriggerName)))
 	}
 	if a.Host != "" {
-		sb.WriteString(fmt.Sprintf("🖥 <b>Host:</b> %s\n", escapeHTML(a.Host)))
+		sb.WriteString(fmt.Sprintf("🖥 <b>%s:</b> %s\n", lang.Label("host"), escapeHTML(a.Host)))
 	}
 	if a.Severity != "" {
-		sb.WriteString(fmt.Sprintf("%s <b>Severity:</b> %s\n", severityEmoji(a.Severity), escapeHTML(a.Severity)))
-	}
-	// For RESOLVED, preserve the original Details from the PROBLEM event (if any).
-	msg := a.Message
-	if a.Status == StatusResolved && origMessage != "" {
-		msg = origMessage
+		sb.WriteString(fmt.Sprintf("%s <b>%s:</b> %s\n", severityEmoji(a.Severity), lang.Label("severity"), escapeHTML(lang.Severity(a.Severity))))
 	}
-	if msg != "" {
-		sb.WriteString(fmt.Sprintf("📝 <b>Details:</b> %s\n", escapeHTML(msg)))
+	if details != "" {
+		sb.WriteString(fmt.Sprintf("📝 <b>%s:</b> %s\n", lang.Label("details"), escapeHTML(details)))
 	}
 	if a.EventID != "" {
-		sb.WriteString(fmt.Sprintf("🆔 <b>Event ID:</b> %s\n", escapeHTML(a.EventID)))
+		sb.WriteString(fmt.Sprintf("🆔 <b>%s:</b> %s\n", lang.Label("event_id"), escapeHTML(a.EventID)))
+	}
+	if ack := entry.Ack; ack != nil {
+		label := lang.Label("acknowledged")
+		if ack.Closed {
+			label = lang.Label("close_requested")
+		}
+		sb.WriteString(fmt.Sprintf("👤 <b>%s:</b> %s %s %s\n", label, escapeHTML(ack.By), lang.Label("at"), h.formatTime(ack.At)))
 	}
+	sb.WriteString(h.formatUpdates(entry.Updates, lang))
+	start, end := eventSpan(a, now, entry, h.location)
 	if a.Status == StatusResolved {
-		if startTime != "" {
-			sb.WriteString(fmt.Sprintf("🕐 <b>Start Time:</b> %s\n", startTime))
+		if !start.IsZero() {
+			sb.WriteString(fmt.Sprintf("🕐 <b>%s:</b> %s\n", lang.Label("start_time"), h.formatTime(start)))
+		}
+		sb.WriteString(fmt.Sprintf("🕑 <b>%s:</b> %s", lang.Label("end_time"), h.formatTime(end)))
+		if !start.IsZero() {
+			sb.WriteString(fmt.Sprintf("\n⏱ <b>%s:</b> %s", lang.Label("duration"), formatElapsed(end.Sub(start))))
 		}
-		sb.WriteString(fmt.Sprintf("🕑 <b>End Time:</b> %s", now.Format(timeFormat)))
 	} else {
-		sb.WriteString(fmt.Sprintf("🕐 <b>Start Time:</b> %s", now.Format(timeFormat)))
+		sb.WriteString(fmt.Sprintf("🕐 <b>%s:</b> %s", lang.Label("start_time"), h.formatTime(start)))
 	}
 
 	return sb.String()
 }
 
+// formatTime formats a timestamp shown in a message.
+func (h *Handler) formatTime(t time.Time) string {
+	return t.In(h.location).Format(h.timeLayout)
+}
+
+// formatElapsed formats how long a problem lasted in days, hours and minutes
+// ("2h 14m"), or in seconds under a minute.
+func formatElapsed(d time.Duration) string {
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(max(d, 0).Seconds()))
+	}
+	d = d.Truncate(time.Minute)
+	days, hours, minutes := int(d/(24*time.Hour)), int(d/time.Hour)%24, int(d/time.Minute)%60
+	var parts []string
+	if days > 0 {
+		parts = append(parts, fmt.Sprintf("%dd", days))
+	}
+	if hours > 0 {
+		parts = append(parts, fmt.Sprintf("%dh", hours))
+	}
+	if minutes > 0 {
+		parts = append(parts, fmt.Sprintf("%dm", minutes))
+	}
+	return strings.Join(parts, " ")
+}
+
 func statusEmoji(s AlertStatus) string {
 	switch s {
 	case StatusProblem:
 		return "🔴"
 	case StatusResolved:
 		return "✅"
+	case StatusUpdate:
+		return "✏️"
 	default:
 		return "ℹ️"
 	}
@@ -208,6 +836,33 @@ func severityEmoji(sev string) string {
 	}
 }
 
+// alertPriority returns the priority of the messages sent for an alert.
+func alertPriority(a ZabbixAlert) bot.Priority {
+	if a.Status == StatusResolved {
+		return priorityResolved
+	}
+	return severityPriority(a.Severity)
+}
+
+func severityPriority(sev string) bot.Priority {
+	switch strings.ToUpper(sev) {
+	case "DISASTER":
+		return 6
+	case "HIGH":
+		return 5
+	case "AVERAGE":
+		return 4
+	case "WARNING":
+		return 3
+	case "INFORMATION":
+		return 2
+	case "NOT_CLASSIFIED":
+		return 1
+	default:
+		return 0
+	}
+}
+
 // escapeHTML escapes the characters that have special meaning in Telegram's
 // HTML parse mode: &, <, >.
 func escapeHTML(s string) string {
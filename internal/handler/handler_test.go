@@ -2,13 +2,20 @@ package handler_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/outbox"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
 )
 
@@ -16,24 +23,89 @@ import (
 type mockBot struct {
 	sentText    string
 	sentMsgID   int
+	sentChats   []int64
+	sentThreads []int
+	sentKB      bot.Keyboard
 	editedMsgID int
 	editedText  string
+	editedChats []int64
+	editedKB    bot.Keyboard
+	answered    string
+	replies     []reply
+	documents   []document
 	sendErr     error
 	editErr     error
+	// edits, when set, receives the text of every edit once it is recorded,
+	// for edits made outside of the request, such as by a timer.
+	edits chan string
 }
 
-func (m *mockBot) SendMessage(text string) (int, error) {
+func (m *mockBot) SendMessage(chatID int64, threadID int, text string, kb bot.Keyboard) (int, error) {
 	m.sentText = text
 	m.sentMsgID++
+	m.sentChats = append(m.sentChats, chatID)
+	m.sentThreads = append(m.sentThreads, threadID)
+	m.sentKB = kb
 	return m.sentMsgID, m.sendErr
 }
 
-func (m *mockBot) EditMessage(messageID int, text string) error {
+func (m *mockBot) EditMessage(chatID int64, messageID int, text string, kb bot.Keyboard) error {
 	m.editedMsgID = messageID
 	m.editedText = text
+	m.editedChats = append(m.editedChats, chatID)
+	m.editedKB = kb
+	if m.edits != nil {
+		m.edits <- text
+	}
 	return m.editErr
 }
 
+// reply is a message sent through ReplyMessage.
+type reply struct {
+	chatID   int64
+	threadID int
+	replyTo  int
+	text     string
+}
+
+func (m *mockBot) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	m.sentMsgID++
+	m.replies = append(m.replies, reply{chatID: chatID, threadID: threadID, replyTo: replyTo, text: text})
+	return m.sentMsgID, m.sendErr
+}
+
+// document is a file sent through ReplyDocument.
+type document struct {
+	chatID  int64
+	replyTo int
+	name    string
+	data    string
+}
+
+func (m *mockBot) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	m.sentMsgID++
+	m.documents = append(m.documents, document{chatID: chatID, replyTo: replyTo, name: name, data: string(data)})
+	return m.sentMsgID, m.sendErr
+}
+
+func (m *mockBot) AnswerCallback(callbackID, text string) error {
+	m.answered = text
+	return nil
+}
+
+const defaultChatID = -100
+
+// newRouter builds a router with the given routes and defaultChatID as the
+// fallback chat.
+func newRouter(t *testing.T, routes ...config.Route) *router.Router {
+	t.Helper()
+	r, err := router.New(routes, router.Destination{ChatID: defaultChatID})
+	if err != nil {
+		t.Fatalf("building router: %v", err)
+	}
+	return r
+}
+
 func postAlert(t *testing.T, h http.Handler, alert handler.ZabbixAlert) *httptest.ResponseRecorder {
 	t.Helper()
 	body, _ := json.Marshal(alert)
@@ -47,7 +119,7 @@ func postAlert(t *testing.T, h http.Handler, alert handler.ZabbixAlert) *httptes
 func TestProblemSendsNewMessage(t *testing.T) {
 	mb := &mockBot{}
 	s := store.New()
-	h := handler.New(mb, s, "")
+	h := handler.New(mb, s, newRouter(t), "")
 
 	alert := handler.ZabbixAlert{
 		EventID:     "evt-100",
@@ -64,19 +136,22 @@ func TestProblemSendsNewMessage(t *testing.T) {
 	}
 
 	// The message ID must have been stored under event_id.
-	entry, ok := s.Get("evt-100")
-	if !ok {
+	entry, err := s.Get(t.Context(), "evt-100")
+	if err != nil {
 		t.Fatal("expected event ID to be stored after PROBLEM alert")
 	}
-	if entry.MessageID != 1 {
-		t.Fatalf("expected stored message ID 1, got %d", entry.MessageID)
+	if len(entry.Messages) != 1 || entry.Messages[0].MessageID != 1 {
+		t.Fatalf("expected stored message ID 1, got %+v", entry.Messages)
+	}
+	if entry.Messages[0].ChatID != defaultChatID {
+		t.Fatalf("expected message in default chat %d, got %d", defaultChatID, entry.Messages[0].ChatID)
 	}
 }
 
 func TestResolvedEditsExistingMessage(t *testing.T) {
 	mb := &mockBot{}
 	s := store.New()
-	h := handler.New(mb, s, "")
+	h := handler.New(mb, s, newRouter(t), "")
 
 	// First: a PROBLEM alert.
 	postAlert(t, h, handler.ZabbixAlert{
@@ -88,8 +163,8 @@ func TestResolvedEditsExistingMessage(t *testing.T) {
 	})
 
 	storedID := func() int {
-		entry, _ := s.Get("evt-200")
-		return entry.MessageID
+		entry, _ := s.Get(t.Context(), "evt-200")
+		return entry.Messages[0].MessageID
 	}()
 
 	// Then: a RESOLVED alert for the same event.
@@ -111,7 +186,7 @@ func TestResolvedEditsExistingMessage(t *testing.T) {
 	}
 
 	// The entry must be removed from the store after resolution.
-	if _, ok := s.Get("evt-200"); ok {
+	if _, err := s.Get(t.Context(), "evt-200"); err == nil {
 		t.Fatal("expected event to be removed from store after RESOLVED")
 	}
 }
@@ -119,7 +194,7 @@ func TestResolvedEditsExistingMessage(t *testing.T) {
 func TestResolvedWithNoTrackedMessageSendsNew(t *testing.T) {
 	mb := &mockBot{}
 	s := store.New()
-	h := handler.New(mb, s, "")
+	h := handler.New(mb, s, newRouter(t), "")
 
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-300",
@@ -140,8 +215,89 @@ func TestResolvedWithNoTrackedMessageSendsNew(t *testing.T) {
 	}
 }
 
+var errStoreDown = errors.New("connection refused")
+
+// flakyStore is a MessageStore whose backend can be made unreachable.
+type flakyStore struct {
+	*store.MessageStore
+	down bool
+}
+
+func (f *flakyStore) Get(ctx context.Context, eventID string) (store.Entry, error) {
+	if f.down {
+		return store.Entry{}, errStoreDown
+	}
+	return f.MessageStore.Get(ctx, eventID)
+}
+
+func (f *flakyStore) GetAndDelete(ctx context.Context, eventID string) (store.Entry, error) {
+	if f.down {
+		return store.Entry{}, errStoreDown
+	}
+	return f.MessageStore.GetAndDelete(ctx, eventID)
+}
+
+func (f *flakyStore) SetIfAbsent(ctx context.Context, eventID string, e store.Entry) (bool, error) {
+	if f.down {
+		return false, errStoreDown
+	}
+	return f.MessageStore.SetIfAbsent(ctx, eventID, e)
+}
+
+func TestStoreUnavailableRetried(t *testing.T) {
+	mb := &mockBot{}
+	s := &flakyStore{MessageStore: store.New()}
+	h := handler.New(mb, s, newRouter(t), "")
+
+	problem := handler.ZabbixAlert{EventID: "evt-310", TriggerName: "Disk Full", Status: handler.StatusProblem, Host: "server2"}
+	postAlert(t, h, problem)
+
+	// An outage must not be taken for an untracked event, which would post
+	// the RESOLVED as a second message.
+	s.down = true
+	resolved := problem
+	resolved.Status = handler.StatusResolved
+	if resp := postAlert(t, h, resolved); resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while the store is down, got %d", resp.Code)
+	}
+	if resp := postAlert(t, h, handler.ZabbixAlert{EventID: "evt-311", Status: handler.StatusProblem}); resp.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 for a PROBLEM while the store is down, got %d", resp.Code)
+	}
+	payload, _ := json.Marshal(resolved)
+	if err := h.Deliver(payload); !errors.Is(err, errStoreDown) {
+		t.Fatalf("expected the store error to be returned for retrying, got %v", err)
+	}
+	if mb.sentMsgID != 1 || mb.editedMsgID != 0 {
+		t.Fatalf("expected no message to be sent or edited while the store is down, got %d sent and message %d edited", mb.sentMsgID, mb.editedMsgID)
+	}
+
+	s.down = false
+	if resp := postAlert(t, h, resolved); resp.Code != http.StatusOK {
+		t.Fatalf("expected the retried RESOLVED to succeed, got %d", resp.Code)
+	}
+	if mb.sentMsgID != 1 || mb.editedMsgID != 1 {
+		t.Fatalf("expected the PROBLEM message to be edited, got %d sent and message %d edited", mb.sentMsgID, mb.editedMsgID)
+	}
+}
+
+func TestCancelledRequestNotProcessed(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	body, _ := json.Marshal(handler.ZabbixAlert{EventID: "evt-320", Status: handler.StatusProblem})
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/zabbix/alert", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code == http.StatusOK || mb.sentMsgID != 0 {
+		t.Fatalf("expected a request cancelled by Zabbix to be dropped, got %d and %d message(s)", w.Code, mb.sentMsgID)
+	}
+}
+
 func TestMethodNotAllowed(t *testing.T) {
-	h := handler.New(&mockBot{}, store.New(), "")
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "")
 	req := httptest.NewRequest(http.MethodGet, "/zabbix/alert", nil)
 	w := httptest.NewRecorder()
 	h.ServeHTTP(w, req)
@@ -152,7 +308,7 @@ func TestMethodNotAllowed(t *testing.T) {
 }
 
 func TestInvalidJSON(t *testing.T) {
-	h := handler.New(&mockBot{}, store.New(), "")
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "")
 	req := httptest.NewRequest(http.MethodPost, "/zabbix/alert", bytes.NewBufferString("{bad json"))
 	w := httptest.NewRecorder()
 	h.ServeHTTP(w, req)
@@ -163,7 +319,7 @@ func TestInvalidJSON(t *testing.T) {
 }
 
 func TestMissingEventID(t *testing.T) {
-	h := handler.New(&mockBot{}, store.New(), "")
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "")
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		TriggerName: "Some trigger",
 		Status:      handler.StatusProblem,
@@ -176,7 +332,7 @@ func TestMissingEventID(t *testing.T) {
 
 func TestSecretValidRequest(t *testing.T) {
 	mb := &mockBot{}
-	h := handler.New(mb, store.New(), "mysecret")
+	h := handler.New(mb, store.New(), newRouter(t), "mysecret")
 
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-400",
@@ -191,7 +347,7 @@ func TestSecretValidRequest(t *testing.T) {
 }
 
 func TestSecretWrongValue(t *testing.T) {
-	h := handler.New(&mockBot{}, store.New(), "mysecret")
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "mysecret")
 
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-401",
@@ -206,7 +362,7 @@ func TestSecretWrongValue(t *testing.T) {
 }
 
 func TestSecretMissing(t *testing.T) {
-	h := handler.New(&mockBot{}, store.New(), "mysecret")
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "mysecret")
 
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-402",
@@ -222,7 +378,7 @@ func TestSecretMissing(t *testing.T) {
 
 func TestNoSecretConfiguredAllowsAnyRequest(t *testing.T) {
 	mb := &mockBot{}
-	h := handler.New(mb, store.New(), "")
+	h := handler.New(mb, store.New(), newRouter(t), "")
 
 	resp := postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-403",
@@ -238,7 +394,7 @@ func TestNoSecretConfiguredAllowsAnyRequest(t *testing.T) {
 
 func TestProblemMessageContainsStartTime(t *testing.T) {
 	mb := &mockBot{}
-	h := handler.New(mb, store.New(), "")
+	h := handler.New(mb, store.New(), newRouter(t), "")
 
 	postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-500",
@@ -256,7 +412,7 @@ func TestProblemMessageContainsStartTime(t *testing.T) {
 
 func TestResolvedMessageContainsEndTime(t *testing.T) {
 	mb := &mockBot{}
-	h := handler.New(mb, store.New(), "")
+	h := handler.New(mb, store.New(), newRouter(t), "")
 
 	postAlert(t, h, handler.ZabbixAlert{
 		EventID:     "evt-600",
@@ -272,7 +428,7 @@ func TestResolvedMessageContainsEndTime(t *testing.T) {
 func TestResolvedEditsPreservesStartTimeAndMessage(t *testing.T) {
 	mb := &mockBot{}
 	s := store.New()
-	h := handler.New(mb, s, "")
+	h := handler.New(mb, s, newRouter(t), "")
 
 	// Send PROBLEM with a Details message.
 	postAlert(t, h, handler.ZabbixAlert{
@@ -284,8 +440,8 @@ func TestResolvedEditsPreservesStartTimeAndMessage(t *testing.T) {
 	})
 
 	// Capture the Start Time that was stored.
-	entry, _ := s.Get("evt-700")
-	storedStartTime := entry.StartTime
+	entry, _ := s.Get(t.Context(), "evt-700")
+	storedStartTime := entry.StartTime.Format("2006-01-02 15:04:05 MST")
 
 	// Send RESOLVED for the same event (with different/empty Message).
 	resp := postAlert(t, h, handler.ZabbixAlert{
@@ -314,10 +470,165 @@ func TestResolvedEditsPreservesStartTimeAndMessage(t *testing.T) {
 	}
 }
 
+func TestResolvedShowsDuration(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-710", Status: handler.StatusProblem})
+	if strings.Contains(mb.sentText, "Duration") {
+		t.Fatalf("expected PROBLEM message NOT to contain 'Duration', got: %s", mb.sentText)
+	}
+	entry, _ := s.Get(t.Context(), "evt-710")
+	entry.StartTime = time.Now().Add(-(2*time.Hour + 14*time.Minute + 30*time.Second))
+	s.Set(t.Context(), "evt-710", entry)
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-710", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "Duration:</b> 2h 14m") {
+		t.Fatalf("expected edited message to contain the duration, got: %s", mb.editedText)
+	}
+}
+
+func TestEventClockUsedForTimes(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	// A delayed webhook: the event started well before it is received.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-720", Status: handler.StatusProblem, EventDate: "2024.03.05", EventTime: "09:15:00"})
+	start := time.Date(2024, 3, 5, 9, 15, 0, 0, time.Local)
+	if want := "Start Time:</b> " + start.Format("2006-01-02 15:04:05 MST"); !strings.Contains(mb.sentText, want) {
+		t.Fatalf("expected PROBLEM message to contain %q, got: %s", want, mb.sentText)
+	}
+	if e, _ := s.Get(t.Context(), "evt-720"); !e.StartTime.Equal(start) {
+		t.Fatalf("expected the Zabbix clock to be stored, got %v", e.StartTime)
+	}
+
+	end := start.Add(90 * time.Minute)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-720", Status: handler.StatusResolved, EventRecoveryTimestamp: handler.Timestamp(end.Unix())})
+	if want := "End Time:</b> " + end.Format("2006-01-02 15:04:05 MST"); !strings.Contains(mb.editedText, want) {
+		t.Errorf("expected RESOLVED message to contain %q, got: %s", want, mb.editedText)
+	}
+	if !strings.Contains(mb.editedText, "Duration:</b> 1h 30m") {
+		t.Errorf("expected the duration between the Zabbix clocks, got: %s", mb.editedText)
+	}
+}
+
+func TestResolvedWithoutTrackedMessageUsesEventClock(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-730", Status: handler.StatusResolved,
+		EventDate: "2024.03.05", EventTime: "09:15:00",
+		EventRecoveryDate: "2024.03.05", EventRecoveryTime: "10:00:30",
+	})
+	if !strings.Contains(mb.sentText, "Start Time:") || !strings.Contains(mb.sentText, "Duration:</b> 45m") {
+		t.Errorf("expected the start and duration from the Zabbix clock, got: %s", mb.sentText)
+	}
+}
+
+func TestEventClockUnexpandedMacros(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	body := `{"event_id":"evt-740","status":"PROBLEM","event_date":"{EVENT.DATE}","event_time":"{EVENT.TIME}","event_timestamp":"{EVENT.TIMESTAMP}"}`
+	req := httptest.NewRequest(http.MethodPost, "/zabbix/alert", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	before := time.Now()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if e, _ := s.Get(t.Context(), "evt-740"); e.StartTime.Before(before) {
+		t.Errorf("expected the receive time as start, got %v", e.StartTime)
+	}
+}
+
+func TestDisplayTimeZoneAndLayout(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatalf("loading time zone: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithDisplayTime(rome, "02/01/2006 15:04 MST"))
+
+	start := time.Date(2024, 7, 1, 8, 30, 0, 0, time.UTC)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-750", Status: handler.StatusProblem, EventTimestamp: handler.Timestamp(start.Unix())})
+	if !strings.Contains(mb.sentText, "Start Time:</b> 01/07/2024 10:30 CEST") {
+		t.Errorf("expected the start in the display zone and layout, got: %s", mb.sentText)
+	}
+}
+
+func TestTimestampDecoding(t *testing.T) {
+	for in, want := range map[string]handler.Timestamp{
+		`1709630100`:   1709630100,
+		`"1709630100"`: 1709630100,
+		`""`:           0,
+		`"*UNKNOWN*"`:  0,
+		`null`:         0,
+	} {
+		var ts handler.Timestamp
+		if err := json.Unmarshal([]byte(in), &ts); err != nil || ts != want {
+			t.Errorf("decoding %s: got %d, %v; want %d", in, ts, err, want)
+		}
+	}
+}
+
+func TestDuplicateProblemEditsExistingMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	alert := handler.ZabbixAlert{EventID: "evt-760", Status: handler.StatusProblem, Severity: "High", TriggerName: "Disk full", Message: "95% used"}
+	postAlert(t, h, alert)
+	msgID := mb.sentMsgID
+	first, _ := s.Get(t.Context(), "evt-760")
+	first.Ack = &store.Acknowledgement{By: "alice", At: time.Now()}
+	s.Set(t.Context(), "evt-760", first)
+
+	// Zabbix retries the webhook, with fresher details.
+	alert.Message = "97% used"
+	if resp := postAlert(t, h, alert); resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if len(mb.sentChats) != 1 {
+		t.Fatalf("expected no new message for a repeated PROBLEM, got %d messages", len(mb.sentChats))
+	}
+	if mb.editedMsgID != msgID || !strings.Contains(mb.editedText, "97% used") || !strings.Contains(mb.editedText, "alice") {
+		t.Errorf("expected message %d to be refreshed keeping the ack, got %d: %s", msgID, mb.editedMsgID, mb.editedText)
+	}
+	e, _ := s.Get(t.Context(), "evt-760")
+	if e.Message != "97% used" || !e.StartTime.Equal(first.StartTime) || len(e.Messages) != 1 || e.Ack == nil {
+		t.Errorf("expected the entry to be refreshed in place, got %+v", e)
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-760", Status: handler.StatusResolved})
+	if mb.editedMsgID != msgID || !strings.Contains(mb.editedText, "RESOLVED") {
+		t.Errorf("expected the RESOLVED to edit the original message, got %d: %s", mb.editedMsgID, mb.editedText)
+	}
+}
+
+func TestDuplicateProblemEditFailureRetried(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	alert := handler.ZabbixAlert{EventID: "evt-770", Status: handler.StatusProblem}
+	postAlert(t, h, alert)
+	mb.editErr = errors.New("telegram down")
+	if resp := postAlert(t, h, alert); resp.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the edit fails, got %d", resp.Code)
+	}
+	if len(mb.sentChats) != 1 {
+		t.Errorf("expected no new message when the edit fails, got %d messages", len(mb.sentChats))
+	}
+}
+
 func TestResolvedEditsPreservesSeverity(t *testing.T) {
 	mb := &mockBot{}
 	s := store.New()
-	h := handler.New(mb, s, "")
+	h := handler.New(mb, s, newRouter(t), "")
 
 	// Send PROBLEM with a severity.
 	postAlert(t, h, handler.ZabbixAlert{
@@ -346,3 +657,270 @@ func TestResolvedEditsPreservesSeverity(t *testing.T) {
 		t.Fatalf("expected edited message to preserve original Severity 'High', got: %s", mb.editedText)
 	}
 }
+
+func TestProblemRoutedToMatchingChats(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t,
+		config.Route{
+			Severities:   []string{"disaster"},
+			Host:         "db-*",
+			Destinations: []config.Destination{{ChatID: -1}, {ChatID: -2}},
+		},
+		config.Route{
+			Trigger:      "CPU",
+			Destinations: []config.Destination{{ChatID: -3}},
+		},
+	), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID:     "evt-900",
+		TriggerName: "Replication lag",
+		Status:      handler.StatusProblem,
+		Severity:    "Disaster",
+		Host:        "db-01",
+	})
+
+	if len(mb.sentChats) != 2 || mb.sentChats[0] != -1 || mb.sentChats[1] != -2 {
+		t.Fatalf("expected messages to chats [-1 -2], got %v", mb.sentChats)
+	}
+	entry, err := s.Get(t.Context(), "evt-900")
+	if err != nil {
+		t.Fatal("expected event ID to be stored after PROBLEM alert")
+	}
+	if len(entry.Messages) != 2 {
+		t.Fatalf("expected 2 tracked messages, got %+v", entry.Messages)
+	}
+}
+
+func TestProblemWithoutMatchingRouteUsesDefaultChat(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, config.Route{
+		Host:         "db-*",
+		Destinations: []config.Destination{{ChatID: -1}},
+	}), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID:  "evt-901",
+		Status:   handler.StatusProblem,
+		Host:     "web-01",
+		Severity: "High",
+	})
+
+	if len(mb.sentChats) != 1 || mb.sentChats[0] != defaultChatID {
+		t.Fatalf("expected message to default chat %d, got %v", defaultChatID, mb.sentChats)
+	}
+}
+
+func TestResolvedEditsMessageInEachRoutedChat(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t, config.Route{
+		Host:         "db-*",
+		Destinations: []config.Destination{{ChatID: -1}, {ChatID: -2}},
+	}), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-902",
+		Status:  handler.StatusProblem,
+		Host:    "db-01",
+	})
+	// The RESOLVED payload does not match the route any more; the edits must
+	// still target the chats the PROBLEM was sent to.
+	resp := postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-902",
+		Status:  handler.StatusResolved,
+	})
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if len(mb.editedChats) != 2 || mb.editedChats[0] != -1 || mb.editedChats[1] != -2 {
+		t.Fatalf("expected edits in chats [-1 -2], got %v", mb.editedChats)
+	}
+}
+
+func TestResolvedEditsLegacyEntryInDefaultChat(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	// Entry written by a release without routing support.
+	s.Set(t.Context(), "evt-903", store.Entry{MessageID: 7})
+
+	resp := postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-903",
+		Status:  handler.StatusResolved,
+	})
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if mb.editedMsgID != 7 || len(mb.editedChats) != 1 || mb.editedChats[0] != defaultChatID {
+		t.Fatalf("expected message 7 to be edited in default chat, got message %d in %v", mb.editedMsgID, mb.editedChats)
+	}
+}
+
+func TestProblemPostedInRouteForumTopic(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t, config.Route{
+		Host:         "prod-*",
+		Destinations: []config.Destination{{ChatID: -1, ThreadID: 17}},
+	}), "")
+
+	postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-950",
+		Status:  handler.StatusProblem,
+		Host:    "prod-web",
+	})
+
+	if len(mb.sentThreads) != 1 || mb.sentThreads[0] != 17 {
+		t.Fatalf("expected message in topic 17, got %v", mb.sentThreads)
+	}
+	entry, _ := s.Get(t.Context(), "evt-950")
+	if len(entry.Messages) != 1 || entry.Messages[0].ThreadID != 17 {
+		t.Fatalf("expected topic 17 to be stored, got %+v", entry.Messages)
+	}
+}
+
+// mockOutbox records the keys and payloads handed over by the handler.
+type mockOutbox struct {
+	keys     []string
+	payloads [][]byte
+	err      error
+}
+
+func (m *mockOutbox) Enqueue(key string, payload []byte) error {
+	m.keys = append(m.keys, key)
+	m.payloads = append(m.payloads, payload)
+	return m.err
+}
+
+func (m *mockOutbox) Stats() (outbox.Stats, error) {
+	return outbox.Stats{Pending: len(m.payloads)}, nil
+}
+
+func TestOutboxQueuesAlert(t *testing.T) {
+	mb := &mockBot{}
+	ob := &mockOutbox{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "s3cret", handler.WithOutbox(ob))
+
+	resp := postAlert(t, h, handler.ZabbixAlert{
+		EventID: "evt-900",
+		Status:  handler.StatusProblem,
+		Host:    "server1",
+		Secret:  "s3cret",
+	})
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.Code)
+	}
+	if len(mb.sentChats) != 0 {
+		t.Error("expected no message to be sent before the worker delivers the alert")
+	}
+	if len(ob.payloads) != 1 || ob.keys[0] != "evt-900" {
+		t.Fatalf("expected one alert queued under its event ID, got %d %v", len(ob.payloads), ob.keys)
+	}
+	if strings.Contains(string(ob.payloads[0]), "s3cret") {
+		t.Errorf("the secret must not be persisted in the outbox: %s", ob.payloads[0])
+	}
+
+	if err := h.Deliver(ob.payloads[0]); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	if _, err := s.Get(t.Context(), "evt-900"); err != nil {
+		t.Error("expected the delivered PROBLEM to be stored")
+	}
+	if len(mb.sentChats) != 1 {
+		t.Errorf("expected one message to be sent, got %d", len(mb.sentChats))
+	}
+}
+
+func TestOutboxRejectsBeforeQueueing(t *testing.T) {
+	ob := &mockOutbox{}
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "s3cret", handler.WithOutbox(ob))
+
+	resp := postAlert(t, h, handler.ZabbixAlert{EventID: "evt-901", Status: handler.StatusProblem, Secret: "wrong"})
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", resp.Code)
+	}
+	if len(ob.payloads) != 0 {
+		t.Error("expected a rejected alert not to be queued")
+	}
+}
+
+func TestOutboxEnqueueFailure(t *testing.T) {
+	ob := &mockOutbox{err: errors.New("disk full")}
+	h := handler.New(&mockBot{}, store.New(), newRouter(t), "", handler.WithOutbox(ob))
+
+	resp := postAlert(t, h, handler.ZabbixAlert{EventID: "evt-902", Status: handler.StatusProblem})
+	if resp.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", resp.Code)
+	}
+}
+
+func TestDeliverReturnsTelegramError(t *testing.T) {
+	sendErr := errors.New("Too Many Requests: retry after 5")
+	mb := &mockBot{sendErr: sendErr}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	payload, _ := json.Marshal(handler.ZabbixAlert{EventID: "evt-903", Status: handler.StatusProblem})
+	err := h.Deliver(payload)
+	if !errors.Is(err, sendErr) {
+		t.Fatalf("expected the Telegram error to be returned for retrying, got %v", err)
+	}
+	if _, err := s.Get(t.Context(), "evt-903"); err == nil {
+		t.Error("expected nothing to be stored when no message was sent")
+	}
+}
+
+// prioritizedBot is a mockBot that records the priority of every request.
+type prioritizedBot struct {
+	*mockBot
+	priorities []bot.Priority
+}
+
+func (p *prioritizedBot) WithContext(ctx context.Context, prio bot.Priority) bot.Messenger {
+	p.priorities = append(p.priorities, prio)
+	return p.mockBot
+}
+
+func TestRequestPriorities(t *testing.T) {
+	pb := &prioritizedBot{mockBot: &mockBot{}}
+	h := handler.New(pb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "Warning"})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem, Severity: "Disaster"})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusResolved})
+
+	if len(pb.priorities) != 3 {
+		t.Fatalf("expected 3 prioritized requests, got %v", pb.priorities)
+	}
+	warning, disaster, resolved := pb.priorities[0], pb.priorities[1], pb.priorities[2]
+	if !(disaster > warning) {
+		t.Errorf("expected Disaster (%d) to outrank Warning (%d)", disaster, warning)
+	}
+	if !(resolved > disaster) {
+		t.Errorf("expected the RESOLVED edit (%d) to outrank new problems (%d)", resolved, disaster)
+	}
+}
+
+func TestEventClockReadInDisplayTimeZone(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("loading time zone: %v", err)
+	}
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithDisplayTime(tokyo, "2006-01-02 15:04 MST"))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "evt-725", Status: handler.StatusProblem, EventDate: "2024.03.05", EventTime: "09:15:00"})
+	if !strings.Contains(mb.sentText, "Start Time:</b> 2024-03-05 09:15 JST") {
+		t.Errorf("expected the Zabbix clock read in the configured zone, got: %s", mb.sentText)
+	}
+	if e, _ := s.Get(t.Context(), "evt-725"); !e.StartTime.Equal(time.Date(2024, 3, 5, 0, 15, 0, 0, time.UTC)) {
+		t.Errorf("expected 00:15 UTC to be stored, got %v", e.StartTime)
+	}
+}
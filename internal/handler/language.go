@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"fmt"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+)
+
+// defaultCatalog labels the messages when no language is configured.
+var defaultCatalog = i18n.Default()
+
+// Languages holds the message catalog of the configured language and those
+// of the routes that set their own.
+type Languages struct {
+	global *i18n.Catalog
+	routes map[int]*i18n.Catalog
+}
+
+// NewLanguages loads the catalog of lang, the default language when empty,
+// and of every route setting a language of its own.
+func NewLanguages(lang string, routes []config.Route) (*Languages, error) {
+	l := &Languages{global: defaultCatalog, routes: make(map[int]*i18n.Catalog)}
+	if lang != "" {
+		c, err := i18n.Load(lang)
+		if err != nil {
+			return nil, err
+		}
+		l.global = c
+	}
+	for i, r := range routes {
+		if r.Language == "" {
+			continue
+		}
+		c, err := i18n.Load(r.Language)
+		if err != nil {
+			if r.Name != "" {
+				return nil, fmt.Errorf("routes[%d] (%s): %w", i, r.Name, err)
+			}
+			return nil, fmt.Errorf("routes[%d]: %w", i, err)
+		}
+		l.routes[i+1] = c
+	}
+	return l, nil
+}
+
+// WithLanguages labels the messages in the languages of l instead of
+// English.
+func WithLanguages(l *Languages) Option {
+	return func(h *Handler) { h.languages = l }
+}
+
+// catalog returns the catalog for the chats of route, see Router.RouteOf.
+func (l *Languages) catalog(route int) *i18n.Catalog {
+	if l == nil {
+		return defaultCatalog
+	}
+	if c, ok := l.routes[route]; ok {
+		return c
+	}
+	return l.global
+}
+
+// perRoute reports whether any route has a language of its own.
+func (l *Languages) perRoute() bool {
+	return l != nil && len(l.routes) > 0
+}
@@ -0,0 +1,66 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestLanguageGlobalAndPerRoute(t *testing.T) {
+	routes := []config.Route{{Host: "muc-*", Language: "de", Destinations: []config.Destination{{ChatID: routeChatID}}}}
+	langs, err := handler.NewLanguages("it", routes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, routes...), "", handler.WithLanguages(langs))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "rom-01", Message: "disk full"})
+	for _, want := range []string{"🔴 <b>PROBLEMA</b>", "<b>Gravità:</b> Alta", "<b>Dettagli:</b> disk full", "<b>Inizio:</b>"} {
+		if !strings.Contains(mb.sentText, want) {
+			t.Errorf("expected the Italian message to contain %q, got: %s", want, mb.sentText)
+		}
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem, Severity: "High", Host: "muc-01"})
+	if mb.sentChats[1] != routeChatID || !strings.Contains(mb.sentText, "<b>Schweregrad:</b> Hoch") {
+		t.Errorf("expected the route's German message, got: %s", mb.sentText)
+	}
+
+	// The RESOLVED does not repeat the host, the edit keeps the route's language.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "✅ <b>BEHOBEN</b>") || !strings.Contains(mb.editedText, "<b>Dauer:</b>") {
+		t.Errorf("expected the German RESOLVED message, got: %s", mb.editedText)
+	}
+}
+
+func TestLanguageInTemplates(t *testing.T) {
+	tmpl, err := handler.NewTemplates(map[string]string{"problem": `{{.Lang.Status .Status}} – {{.Lang.Label "host"}}: {{.Host}}`}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	langs, err := handler.NewLanguages("de", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithTemplates(tmpl), handler.WithLanguages(langs))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Host: "db-01"})
+	if mb.sentText != "PROBLEM – Host: db-01" {
+		t.Errorf("unexpected message: %s", mb.sentText)
+	}
+}
+
+func TestNewLanguagesInvalid(t *testing.T) {
+	if _, err := handler.NewLanguages("fr", nil); err == nil {
+		t.Error("expected an error for an unsupported language")
+	}
+	_, err := handler.NewLanguages("", []config.Route{{}, {Name: "paris", Language: "fr"}})
+	if err == nil || !strings.Contains(err.Error(), "routes[1] (paris)") {
+		t.Errorf("expected an error naming the route, got %v", err)
+	}
+}
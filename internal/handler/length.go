@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// maxMessageLength is Telegram's limit on the text of a message, counted in
+// UTF-16 code units after HTML parsing.
+const maxMessageLength = 4096
+
+// maxEntityLength bounds the length of an HTML entity such as "&amp;".
+const maxEntityLength = 10
+
+// WithDetailsDocument makes alerts whose Details are too long for a message
+// get the full Details as a .txt document, in reply to their message.
+func WithDetailsDocument() Option {
+	return func(h *Handler) { h.detailsDocument = true }
+}
+
+// textLength returns the length of an HTML message as Telegram counts it:
+// tags count as nothing and entities as one character.
+func textLength(s string) int {
+	n := 0
+	walkHTML(s, func(_, _, width int, _ string) bool {
+		n += width
+		return true
+	})
+	return n
+}
+
+// walkHTML calls fn for every tag, entity and character of s with its byte
+// offset, byte size and width in UTF-16 code units. tag is the tag without
+// its angle brackets, or "" for text. Walking stops when fn returns false.
+func walkHTML(s string, fn func(i, size, width int, tag string) bool) {
+	for i := 0; i < len(s); {
+		size, width, tag := 0, 1, ""
+		switch s[i] {
+		case '<':
+			if end := strings.IndexByte(s[i:], '>'); end > 0 {
+				size, width, tag = end+1, 0, s[i+1:i+end]
+			}
+		case '&':
+			if end := strings.IndexByte(s[i:min(len(s), i+maxEntityLength)], ';'); end > 0 {
+				size = end + 1
+			}
+		}
+		if size == 0 {
+			r, n := utf8.DecodeRuneInString(s[i:])
+			size = n
+			if r > 0xFFFF {
+				width = 2 // a surrogate pair
+			}
+		}
+		if !fn(i, size, width, tag) {
+			return
+		}
+		i += size
+	}
+}
+
+// fitMessage shortens an HTML message to maxMessageLength, ending it with
+// "…". The cut never splits a tag or an entity, and the tags left open are
+// closed. It reports whether the message was shortened.
+func fitMessage(s string) (string, bool) {
+	return fitLength(s, maxMessageLength)
+}
+
+// fitLength is fitMessage with a limit of limit instead of maxMessageLength.
+func fitLength(s string, limit int) (string, bool) {
+	if textLength(s) <= limit {
+		return s, false
+	}
+	var open []string
+	n, cut := 0, len(s)
+	walkHTML(s, func(i, size, width int, tag string) bool {
+		if width > 0 && n+width > limit-1 {
+			cut = i
+			return false
+		}
+		n += width
+		switch {
+		case tag == "":
+		case strings.HasPrefix(tag, "/"):
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		default:
+			name, _, _ := strings.Cut(tag, " ")
+			open = append(open, name)
+		}
+		return true
+	})
+	var sb strings.Builder
+	sb.WriteString(s[:cut])
+	sb.WriteString("…")
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + open[i] + ">")
+	}
+	return sb.String(), true
+}
+
+// cutText returns the longest prefix of plain text s that is at most n
+// UTF-16 code units long.
+func cutText(s string, n int) string {
+	for i, r := range s {
+		w := 1
+		if r > 0xFFFF {
+			w = 2
+		}
+		if n -= w; n < 0 {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// detailsTooLong reports whether the Details of an alert do not fit in its
+// message with the built-in layout and have to be shortened.
+func (h *Handler) detailsTooLong(a ZabbixAlert, now time.Time, entry store.Entry) bool {
+	details := alertDetails(a, entry)
+	return details != "" && textLength(h.layoutMessage(a, now, entry, defaultCatalog, details)) > maxMessageLength
+}
+
+// sendDetails replies to msgs with the full Details of the alert as a .txt
+// document when WithDetailsDocument is set and the Details were shortened.
+// Failures are only logged: the alert itself was delivered.
+func (h *Handler) sendDetails(ctx context.Context, a ZabbixAlert, now time.Time, entry store.Entry, msgs []store.Message) {
+	if !h.detailsDocument || !h.detailsTooLong(a, now, entry) {
+		return
+	}
+	name := fmt.Sprintf("event-%s.txt", a.EventID)
+	data := []byte(alertDetails(a, entry))
+	for _, m := range msgs {
+		if _, err := h.sender(ctx, alertPriority(a)).ReplyDocument(m.ChatID, m.ThreadID, m.MessageID, name, data); err != nil {
+			log.Printf("ERROR sending the details of event %s to chat %d: %v", a.EventID, m.ChatID, err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package handler_test
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+var tagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// visibleLength returns the length of an HTML message as Telegram counts it.
+func visibleLength(s string) int {
+	return len(utf16.Encode([]rune(html.UnescapeString(tagPattern.ReplaceAllString(s, "")))))
+}
+
+// checkEntities fails when s contains an "&" that does not start one of the
+// entities the handler writes, as after an entity was cut in half.
+func checkEntities(t *testing.T, s string) {
+	t.Helper()
+	n := strings.Count(s, "&amp;") + strings.Count(s, "&lt;") + strings.Count(s, "&gt;")
+	if got := strings.Count(s, "&"); got != n {
+		t.Errorf("expected only whole entities, found %d '&' for %d entities", got, n)
+	}
+}
+
+func TestLongDetailsShortened(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	details := strings.Repeat("a<b>&c ", 2000)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, TriggerName: "Stack trace", Message: details})
+	if n := visibleLength(mb.sentText); n > 4096 {
+		t.Fatalf("expected at most 4096 characters, got %d", n)
+	}
+	checkEntities(t, mb.sentText)
+	for _, want := range []string{"Stack trace", "…\n🆔 <b>Event ID:</b> 1", "Start Time:"} {
+		if !strings.Contains(mb.sentText, want) {
+			t.Errorf("expected the shortened message to contain %q, got: ...%s", want, mb.sentText[len(mb.sentText)-200:])
+		}
+	}
+	if len(mb.documents) != 0 {
+		t.Errorf("expected no document without WithDetailsDocument, got %d", len(mb.documents))
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusResolved})
+	if n := visibleLength(mb.editedText); n > 4096 || !strings.Contains(mb.editedText, "Duration:") {
+		t.Errorf("expected a shortened RESOLVED message of at most 4096 characters, got %d: ...%s", n, mb.editedText[len(mb.editedText)-200:])
+	}
+}
+
+func TestLongDetailsCountsSurrogatePairs(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Message: strings.Repeat("😀", 3000)})
+	if n := visibleLength(mb.sentText); n > 4096 || n < 4000 {
+		t.Errorf("expected close to 4096 UTF-16 code units, got %d", n)
+	}
+}
+
+func TestLongDetailsDocument(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithDetailsDocument())
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem, Message: "short"})
+	if len(mb.documents) != 0 {
+		t.Fatalf("expected no document for short Details, got %d", len(mb.documents))
+	}
+
+	details := strings.Repeat("x", 5000)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "3", Status: handler.StatusProblem, Message: details})
+	if len(mb.documents) != 1 {
+		t.Fatalf("expected one document, got %d", len(mb.documents))
+	}
+	d := mb.documents[0]
+	if d.chatID != defaultChatID || d.replyTo != 2 || d.name != "event-3.txt" || d.data != details {
+		t.Errorf("unexpected document: chat %d, reply to %d, %s, %d bytes", d.chatID, d.replyTo, d.name, len(d.data))
+	}
+}
+
+func TestLongTemplateOutputShortened(t *testing.T) {
+	tmpl, err := handler.NewTemplates(map[string]string{"problem": `<b>{{.Host}}</b> <i>{{.Message | escape}}</i>`}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithTemplates(tmpl))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Host: "db-01", Message: strings.Repeat("<&>", 3000)})
+	if n := visibleLength(mb.sentText); n > 4096 {
+		t.Fatalf("expected at most 4096 characters, got %d", n)
+	}
+	checkEntities(t, mb.sentText)
+	if !strings.HasPrefix(mb.sentText, "<b>db-01</b> <i>") || !strings.HasSuffix(mb.sentText, "…</i>") {
+		t.Errorf("expected the open tag to be closed after the cut, got: %s…%s", mb.sentText[:20], mb.sentText[len(mb.sentText)-20:])
+	}
+}
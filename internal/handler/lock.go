@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// lockTimeout bounds how long an alert waits for another one of the same
+// event to be handled before it fails and is retried.
+const lockTimeout = 30 * time.Second
+
+// lockEvent serializes the handling of one event, so that e.g. a RESOLVED
+// arriving while its PROBLEM is still being sent waits for the message to be
+// tracked instead of being taken for an orphan. The event is locked in
+// process and, when the store is shared by several replicas (see
+// store.Locker), in the store as well. The returned function unlocks it.
+//
+// It fails with a *deliveryError when the event stays busy for lockTimeout or
+// ctx is done, and with a *storeError when the store could not be reached.
+func (h *Handler) lockEvent(ctx context.Context, eventID string) (func(), error) {
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	unlock, err := h.locks.Lock(ctx, eventID)
+	if err != nil {
+		return nil, busyError(eventID, err)
+	}
+	l, ok := h.store.(store.Locker)
+	if !ok {
+		return unlock, nil
+	}
+	unlockShared, err := l.Lock(ctx, eventID)
+	if err != nil {
+		unlock()
+		if ctx.Err() != nil {
+			return nil, busyError(eventID, err)
+		}
+		return nil, storeFailed(eventID, err)
+	}
+	return func() {
+		unlockShared()
+		unlock()
+	}, nil
+}
+
+func busyError(eventID string, err error) error {
+	log.Printf("ERROR locking event %s: %v", eventID, err)
+	return &deliveryError{msg: "event is busy, retry later", err: err}
+}
@@ -0,0 +1,286 @@
+package handler_test
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// syncBot is a Sender safe for concurrent use. Sending a message takes a
+// while, so that other alerts arrive while it is in flight.
+type syncBot struct {
+	mu      sync.Mutex
+	nextID  int
+	sent    map[int]string   // message ID → text
+	edits   map[int][]string // message ID → texts, oldest first
+	sending map[string]chan struct{}
+}
+
+func newSyncBot() *syncBot {
+	return &syncBot{sent: make(map[int]string), edits: make(map[int][]string), sending: make(map[string]chan struct{})}
+}
+
+var eventIDPattern = regexp.MustCompile(`Event ID:</b> (\S+)`)
+
+// inFlight returns a channel closed once a message of eventID is being sent.
+func (b *syncBot) inFlight(eventID string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch, ok := b.sending[eventID]
+	if !ok {
+		ch = make(chan struct{})
+		b.sending[eventID] = ch
+	}
+	return ch
+}
+
+func (b *syncBot) SendMessage(chatID int64, threadID int, text string, kb bot.Keyboard) (int, error) {
+	if m := eventIDPattern.FindStringSubmatch(text); m != nil {
+		ch := b.inFlight(m[1])
+		b.mu.Lock()
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+	time.Sleep(5 * time.Millisecond)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	b.sent[b.nextID] = text
+	return b.nextID, nil
+}
+
+func (b *syncBot) EditMessage(chatID int64, messageID int, text string, kb bot.Keyboard) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.edits[messageID] = append(b.edits[messageID], text)
+	return nil
+}
+
+func (b *syncBot) ReplyMessage(chatID int64, threadID, replyTo int, text string) (int, error) {
+	return b.SendMessage(chatID, threadID, text, nil)
+}
+
+func (b *syncBot) ReplyDocument(chatID int64, threadID, replyTo int, name string, data []byte) (int, error) {
+	return b.SendMessage(chatID, threadID, name, nil)
+}
+
+func (b *syncBot) AnswerCallback(callbackID, text string) error { return nil }
+
+// stressEvents posts, for n events each, three copies of the same PROBLEM at
+// once, and for n other events a PROBLEM followed by its RESOLVED while the
+// PROBLEM is still being sent. Alerts are spread over the handlers, as over
+// the replicas of a deployment.
+func stressEvents(t *testing.T, b *syncBot, s store.Store, n int, hs ...*handler.Handler) {
+	t.Helper()
+	var wg sync.WaitGroup
+	k := 0
+	post := func(alert handler.ZabbixAlert) {
+		h := hs[k%len(hs)]
+		k++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if resp := postAlert(t, h, alert); resp.Code != http.StatusOK {
+				t.Errorf("%s for event %s: expected 200, got %d", alert.Status, alert.EventID, resp.Code)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		dup := handler.ZabbixAlert{EventID: fmt.Sprintf("dup-%d", i), Status: handler.StatusProblem, Severity: "High", Host: "db-01"}
+		for j := 0; j < 3; j++ {
+			post(dup)
+		}
+		race := handler.ZabbixAlert{EventID: fmt.Sprintf("race-%d", i), Status: handler.StatusProblem, Severity: "High", Host: "db-01"}
+		inFlight := b.inFlight(race.EventID)
+		post(race)
+		<-inFlight
+		race.Status = handler.StatusResolved
+		post(race)
+	}
+	wg.Wait()
+
+	sends := make(map[string][]int)
+	for id, text := range b.sent {
+		m := eventIDPattern.FindStringSubmatch(text)
+		if m == nil {
+			t.Fatalf("unexpected message: %s", text)
+		}
+		if !strings.Contains(text, "PROBLEM") {
+			t.Errorf("expected only PROBLEM messages to be posted, got: %s", text)
+		}
+		sends[m[1]] = append(sends[m[1]], id)
+	}
+	for i := 0; i < n; i++ {
+		dup, race := fmt.Sprintf("dup-%d", i), fmt.Sprintf("race-%d", i)
+		if len(sends[dup]) != 1 || len(sends[race]) != 1 {
+			t.Fatalf("expected one message per event, got %d for %s and %d for %s", len(sends[dup]), dup, len(sends[race]), race)
+		}
+		if e, err := s.Get(t.Context(), dup); err != nil || len(e.Messages) != 1 || e.Messages[0].MessageID != sends[dup][0] {
+			t.Errorf("expected %s to track its message, got %+v", dup, e)
+		}
+		if _, err := s.Get(t.Context(), race); err == nil {
+			t.Errorf("expected %s to be resolved", race)
+		}
+		edits := b.edits[sends[race][0]]
+		if len(edits) == 0 || !strings.Contains(edits[len(edits)-1], "RESOLVED") {
+			t.Errorf("expected the message of %s to be edited to RESOLVED, got %q", race, edits)
+		}
+	}
+}
+
+func TestConcurrentAlertsSerializedPerEvent(t *testing.T) {
+	b := newSyncBot()
+	s := store.New()
+	h := handler.New(b, s, newRouter(t), "")
+	stressEvents(t, b, s, 30, h)
+}
+
+func TestConcurrentAlertsSerializedAcrossReplicas(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	b := newSyncBot()
+	s1 := store.NewRedisStore(mr.Addr(), "", 0)
+	s2 := store.NewRedisStore(mr.Addr(), "", 0)
+	h1 := handler.New(b, s1, newRouter(t), "")
+	h2 := handler.New(b, s2, newRouter(t), "")
+	stressEvents(t, b, s1, 30, h1, h2)
+}
+
+// TestReplicasClaimEventsWithoutSharedLock checks that replicas sharing a
+// store but not a lock still post each PROBLEM once: the first claims the
+// event, the others are told to retry until its message is tracked.
+func TestReplicasClaimEventsWithoutSharedLock(t *testing.T) {
+	b := newSyncBot()
+	s := store.New()
+	h1 := handler.New(b, s, newRouter(t), "")
+	h2 := handler.New(b, s, newRouter(t), "")
+
+	alert := handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "db-01"}
+	inFlight := b.inFlight("1")
+	done := make(chan int)
+	go func() { done <- postAlert(t, h1, alert).Code }()
+	<-inFlight
+
+	if code := postAlert(t, h2, alert).Code; code != http.StatusInternalServerError {
+		t.Fatalf("expected a duplicate PROBLEM to be retried while the first is sent, got %d", code)
+	}
+	resolved := alert
+	resolved.Status = handler.StatusResolved
+	if code := postAlert(t, h2, resolved).Code; code != http.StatusInternalServerError {
+		t.Fatalf("expected the RESOLVED to be retried while the PROBLEM is sent, got %d", code)
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected the first PROBLEM to be sent, got %d", code)
+	}
+
+	if code := postAlert(t, h2, resolved).Code; code != http.StatusOK {
+		t.Fatalf("expected the retried RESOLVED to succeed, got %d", code)
+	}
+	if len(b.sent) != 1 {
+		t.Fatalf("expected one message, got %d", len(b.sent))
+	}
+	if edits := b.edits[1]; len(edits) != 1 || !strings.Contains(edits[0], "RESOLVED") {
+		t.Fatalf("expected the message to be resolved once, got %q", edits)
+	}
+	if _, err := s.Get(t.Context(), "1"); err == nil {
+		t.Fatal("expected the entry to be removed")
+	}
+}
+
+// TestAbandonedClaimIsPostedOver checks that the claim of a PROBLEM whose
+// process stopped before tracking its messages does not hold up the event:
+// with the lock shared through Redis, the next alerts of the event drop it.
+func TestAbandonedClaimIsPostedOver(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	b := newSyncBot()
+	s := store.NewRedisStore(mr.Addr(), "", 0)
+	h := handler.New(b, s, newRouter(t), "")
+	claimed := time.Now()
+	for _, id := range []string{"1", "2", "3"} {
+		if err := s.Set(t.Context(), id, store.Entry{Severity: "High", Claimed: &claimed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	alert := handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "db-01"}
+	if code := postAlert(t, h, alert).Code; code != http.StatusOK {
+		t.Fatalf("expected the PROBLEM to be posted over the claim, got %d", code)
+	}
+	resolved := alert
+	resolved.Status = handler.StatusResolved
+	if code := postAlert(t, h, resolved).Code; code != http.StatusOK {
+		t.Fatalf("expected the RESOLVED to succeed, got %d", code)
+	}
+	if edits := b.edits[1]; len(edits) != 1 || !strings.Contains(edits[0], "RESOLVED") {
+		t.Fatalf("expected the posted PROBLEM to be resolved, got %q", edits)
+	}
+
+	resolved.EventID = "2"
+	update := handler.ZabbixAlert{EventID: "3", Status: handler.StatusUpdate, UpdateUser: "alice", UpdateMessage: "on it"}
+	for _, a := range []handler.ZabbixAlert{resolved, update} {
+		if code := postAlert(t, h, a).Code; code != http.StatusOK {
+			t.Fatalf("expected the %s of event %s to be posted on its own, got %d", a.Status, a.EventID, code)
+		}
+	}
+	if len(b.sent) != 3 {
+		t.Fatalf("expected three messages, got %d", len(b.sent))
+	}
+	for _, id := range []string{"2", "3"} {
+		if _, err := s.Get(t.Context(), id); err == nil {
+			t.Fatalf("expected the claim of event %s to be dropped", id)
+		}
+	}
+}
+
+// TestStaleClaimExpiresWithoutSharedLock checks that, without a shared lock,
+// a claim is waited for until it is older than the lock timeout.
+func TestStaleClaimExpiresWithoutSharedLock(t *testing.T) {
+	b := newSyncBot()
+	s := store.New()
+	h := handler.New(b, s, newRouter(t), "")
+	recent, stale := time.Now(), time.Now().Add(-time.Minute)
+	if err := s.Set(t.Context(), "1", store.Entry{Claimed: &recent}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(t.Context(), "2", store.Entry{Claimed: &stale}); err != nil {
+		t.Fatal(err)
+	}
+
+	alert := handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "db-01"}
+	if code := postAlert(t, h, alert).Code; code != http.StatusInternalServerError {
+		t.Fatalf("expected the PROBLEM to be retried while the claim is recent, got %d", code)
+	}
+	alert.EventID = "2"
+	if code := postAlert(t, h, alert).Code; code != http.StatusOK {
+		t.Fatalf("expected the PROBLEM to be posted over the stale claim, got %d", code)
+	}
+	if len(b.sent) != 1 {
+		t.Fatalf("expected one message, got %d", len(b.sent))
+	}
+	entry, err := s.Get(t.Context(), "2")
+	if err != nil || len(entry.Messages) != 1 || entry.Claimed != nil {
+		t.Fatalf("expected the posted message to be tracked, got %+v, %v", entry, err)
+	}
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// maxCheckInterval is the longest time between two walks of the open
+// problems looking for due reminders or escalations.
+const maxCheckInterval = time.Minute
+
+// reminders holds the reminder policy: the interval between reminders by
+// severity and the maximum number of reminders per event.
+type reminders struct {
+	intervals map[string]time.Duration
+	fallback  time.Duration
+	max       int
+}
+
+// WithReminders makes RunReminders reply to the messages of problems that are
+// still open and unacknowledged, every interval of their severity, at most
+// maxReminders times per event. intervals is keyed by severity name
+// (case-insensitive); the "default" key applies to the other severities.
+// Severities without an interval get no reminders.
+func WithReminders(intervals map[string]time.Duration, maxReminders int) Option {
+	return func(h *Handler) {
+		r := &reminders{intervals: make(map[string]time.Duration), max: maxReminders}
+		for sev, d := range intervals {
+			if strings.EqualFold(sev, "default") {
+				r.fallback = d
+				continue
+			}
+			r.intervals[strings.ToUpper(sev)] = d
+		}
+		h.reminders = r
+	}
+}
+
+// interval returns the reminder interval of a severity, zero for none.
+func (r *reminders) interval(sev string) time.Duration {
+	if d, ok := r.intervals[strings.ToUpper(sev)]; ok {
+		return d
+	}
+	return r.fallback
+}
+
+// check returns how often the open problems are walked: as often as the
+// shortest interval, and at least every maxCheckInterval.
+func (r *reminders) check() time.Duration {
+	d := maxCheckInterval
+	if r.fallback > 0 {
+		d = min(d, r.fallback)
+	}
+	for _, i := range r.intervals {
+		if i > 0 {
+			d = min(d, i)
+		}
+	}
+	return d
+}
+
+// RunReminders sends the due reminders, starting with those that fell due
+// while the bot was down, until ctx is cancelled. It returns at once when
+// reminders are not enabled.
+func (h *Handler) RunReminders(ctx context.Context) {
+	if h.reminders == nil {
+		return
+	}
+	// A walk under way is completed on shutdown.
+	walk := context.WithoutCancel(ctx)
+	h.remind(walk, time.Now())
+	ticker := time.NewTicker(h.reminders.check())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.remind(walk, now)
+		}
+	}
+}
+
+// remind walks the open problems and replies to the messages of those that
+// are due for a reminder.
+func (h *Handler) remind(ctx context.Context, now time.Time) {
+	var due []string
+	err := h.store.Scan(ctx, store.Filter{}, func(r store.Record) bool {
+		if h.reminderDue(r.Entry, now) > r.Entry.Reminders {
+			due = append(due, r.EventID)
+		}
+		return true
+	})
+	if err != nil {
+		// The problems walked so far are still reminded.
+		log.Printf("ERROR walking open problems for reminders: %v", err)
+	}
+
+	for _, id := range due {
+		h.remindEvent(ctx, id, now)
+	}
+}
+
+// remindEvent replies to the messages of one event due for a reminder,
+// holding the lock of the event.
+func (h *Handler) remindEvent(ctx context.Context, id string, now time.Time) {
+	unlock, err := h.lockEvent(ctx, id)
+	if err != nil {
+		return // retried on the next walk
+	}
+	defer unlock()
+
+	// The event may have been resolved, or reminded by another replica,
+	// since the walk.
+	entry, ok, err := h.getEntry(ctx, id)
+	if err != nil || !ok || h.reminderDue(entry, now) <= entry.Reminders {
+		return
+	}
+	alert := entryAlert(id, entry)
+	sent := false
+	for _, m := range h.messages(entry) {
+		d := router.Destination{ChatID: m.ChatID, ThreadID: m.ThreadID}
+		text := formatReminder(alert, entry.OpenFor(now), h.catalogOf(alert, entry, d))
+		if _, err := h.sender(ctx, severityPriority(entry.Severity)).ReplyMessage(m.ChatID, m.ThreadID, m.MessageID, text); err != nil {
+			log.Printf("ERROR sending reminder to chat %d for event %s: %v", m.ChatID, id, err)
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return
+	}
+	entry.Reminders = h.reminderDue(entry, now)
+	if h.save(context.WithoutCancel(ctx), id, entry) != nil {
+		return
+	}
+	log.Printf("reminder %d sent for event %s", entry.Reminders, id)
+}
+
+// reminderDue returns the number of reminders entry should have had by now,
+// capped at the maximum. Missed reminders, e.g. while the bot was down, are
+// not sent twice: only the latest one is.
+func (h *Handler) reminderDue(entry store.Entry, now time.Time) int {
+	r := h.reminders
+	interval := r.interval(entry.Severity)
+	if interval <= 0 || entry.Ack != nil || entry.Digest != "" || entry.StartTime.IsZero() {
+		return 0
+	}
+	return min(int(entry.OpenFor(now)/interval), r.max)
+}
+
+// formatReminder builds the reply reminding that a problem is still open,
+// labelled with lang.
+func formatReminder(a ZabbixAlert, open time.Duration, lang *i18n.Catalog) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("⏰ <b>%s</b> %s\n", lang.Label("still_open"), fmt.Sprintf(lang.Label("open_for"), formatDuration(open.Truncate(time.Minute)))))
+	if a.TriggerName != "" {
+		sb.WriteString(fmt.Sprintf("🔔 <b>%s:</b> %s\n", lang.Label("trigger"), escapeHTML(a.TriggerName)))
+	}
+	if a.Host != "" {
+		sb.WriteString(fmt.Sprintf("🖥 <b>%s:</b> %s\n", lang.Label("host"), escapeHTML(a.Host)))
+	}
+	if a.Severity != "" {
+		sb.WriteString(fmt.Sprintf("%s <b>%s:</b> %s\n", severityEmoji(a.Severity), lang.Label("severity"), escapeHTML(lang.Severity(a.Severity))))
+	}
+	sb.WriteString(fmt.Sprintf("🆔 <b>%s:</b> %s", lang.Label("event_id"), escapeHTML(a.EventID)))
+	return sb.String()
+}
@@ -0,0 +1,116 @@
+package handler_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// openSince returns an entry for a problem that started d ago.
+func openSince(d time.Duration, severity string, msgID int) store.Entry {
+	return store.Entry{
+		Messages:  []store.Message{{ChatID: defaultChatID, ThreadID: 7, MessageID: msgID}},
+		StartTime: time.Now().Add(-d),
+		Severity:  severity,
+		Host:      "db-01",
+	}
+}
+
+// remindOnce runs one walk of the open problems.
+func remindOnce(h *handler.Handler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.RunReminders(ctx)
+}
+
+func TestRemindersReplyToOriginalMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithReminders(map[string]time.Duration{
+		"high":    time.Hour,
+		"default": 4 * time.Hour,
+	}, 5))
+
+	s.Set(t.Context(), "1", openSince(3*time.Hour+12*time.Minute, "High", 41))
+	s.Set(t.Context(), "2", openSince(3*time.Hour, "Warning", 42))
+	remindOnce(h)
+
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reminder, got %d", len(mb.replies))
+	}
+	r := mb.replies[0]
+	if r.chatID != defaultChatID || r.threadID != 7 || r.replyTo != 41 {
+		t.Errorf("expected a reply to message 41 in topic 7, got %+v", r)
+	}
+	if !strings.Contains(r.text, "Still open</b> for 3h12m") {
+		t.Errorf("unexpected reminder text: %s", r.text)
+	}
+	if e, _ := s.Get(t.Context(), "1"); e.Reminders != 3 {
+		t.Errorf("expected the missed reminders to be counted, got %d", e.Reminders)
+	}
+
+	// Nothing is due again until the next interval.
+	remindOnce(h)
+	if len(mb.replies) != 1 {
+		t.Errorf("expected no repeated reminder, got %d", len(mb.replies))
+	}
+}
+
+func TestRemindersCapped(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithReminders(map[string]time.Duration{"default": time.Hour}, 2))
+
+	s.Set(t.Context(), "1", openSince(5*time.Hour, "Disaster", 1))
+	remindOnce(h)
+	if e, _ := s.Get(t.Context(), "1"); len(mb.replies) != 1 || e.Reminders != 2 {
+		t.Fatalf("expected one reminder up to the cap, got %d replies, count %d", len(mb.replies), e.Reminders)
+	}
+
+	e, _ := s.Get(t.Context(), "1")
+	e.StartTime = openSince(9*time.Hour, "Disaster", 1).StartTime
+	s.Set(t.Context(), "1", e)
+	remindOnce(h)
+	if len(mb.replies) != 1 {
+		t.Errorf("expected no reminder past the cap, got %d", len(mb.replies))
+	}
+}
+
+func TestRemindersSkipAcknowledged(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithReminders(map[string]time.Duration{"default": time.Hour}, 3))
+
+	e := openSince(2*time.Hour, "High", 1)
+	e.Ack = &store.Acknowledgement{By: "alice", At: time.Now()}
+	s.Set(t.Context(), "1", e)
+	remindOnce(h)
+	if len(mb.replies) != 0 {
+		t.Errorf("expected no reminder for an acknowledged problem, got %d", len(mb.replies))
+	}
+}
+
+func TestRemindersInRouteLanguage(t *testing.T) {
+	langs, err := handler.NewLanguages("it", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "", handler.WithLanguages(langs), handler.WithReminders(map[string]time.Duration{"default": time.Hour}, 3))
+
+	s.Set(t.Context(), "1", openSince(time.Hour+5*time.Minute, "High", 41))
+	remindOnce(h)
+	if len(mb.replies) != 1 {
+		t.Fatalf("expected one reminder, got %d", len(mb.replies))
+	}
+	for _, want := range []string{"Ancora aperto</b> da 1h5m", "<b>Gravità:</b> Alta", "<b>ID evento:</b> 1"} {
+		if !strings.Contains(mb.replies[0].text, want) {
+			t.Errorf("expected the Italian reminder to contain %q, got: %s", want, mb.replies[0].text)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// templateDefault is the template key applying to the statuses that have no
+// template of their own.
+const templateDefault = "default"
+
+// templateKeys lists the keys a template set accepts.
+var templateKeys = map[string]bool{
+	"problem":       true,
+	"resolved":      true,
+	"update":        true,
+	templateDefault: true,
+}
+
+// TemplateData is the data a message template is executed with. An UPDATE of
+// a tracked problem re-renders its PROBLEM message, with the update listed in
+// Updates; the "update" template only renders updates of untracked events.
+type TemplateData struct {
+	Status      string
+	EventID     string
+	TriggerID   string
+	TriggerName string
+	Host        string
+	HostGroups  []string
+	Severity    string
+	// Message is the alert's Details; RESOLVED keeps those of the PROBLEM.
+	Message string
+	// Start is when the problem started, zero when unknown. End is set for
+	// RESOLVED only.
+	Start time.Time
+	End   time.Time
+	// Duration is how long the problem has been open, or lasted.
+	Duration time.Duration
+	Ack      *store.Acknowledgement
+	Updates  []store.Update
+	Now      time.Time
+	// Lang translates labels, statuses and severities into the language of
+	// the chat: {{.Lang.Label "host"}}, {{.Lang.Severity .Severity}}.
+	Lang *i18n.Catalog
+}
+
+// Templates holds the message templates configured globally and per route,
+// each keyed by alert status.
+type Templates struct {
+	global map[string]*template.Template
+	routes map[int]map[string]*template.Template
+}
+
+// NewTemplates parses the global templates and those of routes, and executes
+// each once against sample data so mistakes such as unknown fields are
+// reported at startup rather than when an alert arrives. Keys are an alert
+// status ("problem", "resolved", "update") or "default".
+func NewTemplates(global map[string]string, routes []config.Route) (*Templates, error) {
+	t := &Templates{routes: make(map[int]map[string]*template.Template)}
+	var err error
+	if t.global, err = parseTemplates("templates", global); err != nil {
+		return nil, err
+	}
+	for i, r := range routes {
+		if len(r.Templates) == 0 {
+			continue
+		}
+		label := fmt.Sprintf("routes[%d]", i)
+		if r.Name != "" {
+			label = fmt.Sprintf("routes[%d] (%s)", i, r.Name)
+		}
+		set, err := parseTemplates(label+".templates", r.Templates)
+		if err != nil {
+			return nil, err
+		}
+		t.routes[i+1] = set
+	}
+	return t, nil
+}
+
+func parseTemplates(label string, defs map[string]string) (map[string]*template.Template, error) {
+	keys := make([]string, 0, len(defs))
+	for k := range defs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	set := make(map[string]*template.Template, len(defs))
+	for _, k := range keys {
+		key := strings.ToLower(k)
+		if !templateKeys[key] {
+			return nil, fmt.Errorf("%s: unknown key %q (want problem, resolved, update or default)", label, k)
+		}
+		name := label + "." + key
+		tmpl, err := template.New(name).Funcs(templateFuncs).Parse(defs[k])
+		if err != nil {
+			return nil, err
+		}
+		if err := tmpl.Execute(io.Discard, sampleTemplateData); err != nil {
+			return nil, err
+		}
+		set[key] = tmpl
+	}
+	return set, nil
+}
+
+// sampleTemplateData has every field set, for validating templates.
+var sampleTemplateData = TemplateData{
+	Status:      string(StatusResolved),
+	EventID:     "12345",
+	TriggerID:   "678",
+	TriggerName: "High CPU usage",
+	Host:        "db-01",
+	HostGroups:  []string{"Databases/MySQL"},
+	Severity:    "High",
+	Message:     "CPU load is 97%",
+	Start:       time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+	End:         time.Date(2024, 1, 1, 12, 14, 0, 0, time.UTC),
+	Duration:    2*time.Hour + 14*time.Minute,
+	Ack:         &store.Acknowledgement{By: "alice", At: time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC)},
+	Updates:     []store.Update{{At: time.Date(2024, 1, 1, 10, 6, 0, 0, time.UTC), By: "Admin", Action: "commented", Message: "on it"}},
+	Now:         time.Date(2024, 1, 1, 12, 14, 0, 0, time.UTC),
+	Lang:        defaultCatalog,
+}
+
+// templateFuncs are the helper functions available to message templates.
+var templateFuncs = template.FuncMap{
+	"escape":   escapeHTML,
+	"duration": formatElapsed,
+	"emoji":    emoji,
+	"truncate": truncate,
+	"time":     func(t time.Time) string { return t.Format(timeFormat) }, // replaced by withTime
+	"join":     func(sep string, s []string) string { return strings.Join(s, sep) },
+}
+
+// emoji returns the emoji of an alert status, or else of a severity.
+func emoji(s string) string {
+	switch st := AlertStatus(strings.ToUpper(s)); st {
+	case StatusProblem, StatusResolved, StatusUpdate:
+		return statusEmoji(st)
+	}
+	return severityEmoji(s)
+}
+
+// truncate shortens s to at most n characters, marking the cut with "…".
+func truncate(n int, s string) string {
+	r := []rune(s)
+	if n < 1 || len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
+
+// withTime returns a copy of t whose time function formats with format, as
+// configured for the handler.
+func (t *Templates) withTime(format func(time.Time) string) *Templates {
+	funcs := template.FuncMap{"time": format}
+	bind := func(set map[string]*template.Template) map[string]*template.Template {
+		out := make(map[string]*template.Template, len(set))
+		for k, tmpl := range set {
+			c := template.Must(tmpl.Clone())
+			out[k] = c.Funcs(funcs)
+		}
+		return out
+	}
+	c := &Templates{global: bind(t.global), routes: make(map[int]map[string]*template.Template, len(t.routes))}
+	for i, set := range t.routes {
+		c.routes[i] = bind(set)
+	}
+	return c
+}
+
+// lookup returns the template for status in route's set, falling back to the
+// global set, or nil when neither has one.
+func (t *Templates) lookup(route int, status AlertStatus) *template.Template {
+	key := strings.ToLower(string(status))
+	for _, set := range []map[string]*template.Template{t.routes[route], t.global} {
+		if tmpl, ok := set[key]; ok {
+			return tmpl
+		}
+		if tmpl, ok := set[templateDefault]; ok {
+			return tmpl
+		}
+	}
+	return nil
+}
+
+// WithTemplates renders alert messages with t instead of the built-in layout.
+// Statuses without a template keep the built-in layout.
+func WithTemplates(t *Templates) Option {
+	return func(h *Handler) { h.templates = t }
+}
+
+// render returns the message of an alert for a destination: see formatMessage
+// for the arguments. The template of the route delivering to d is used, then
+// the global one, then the built-in layout.
+func (h *Handler) render(a ZabbixAlert, now time.Time, entry store.Entry, d router.Destination) string {
+	return h.renderWithHeader("", a, now, entry, d)
+}
+
+// renderWithHeader is render with header put before the message, within
+// Telegram's length limit.
+func (h *Handler) renderWithHeader(header string, a ZabbixAlert, now time.Time, entry store.Entry, d router.Destination) string {
+	route := h.routeOf(a, entry, d)
+	lang := h.languages.catalog(route)
+	if h.templates == nil {
+		return h.formatMessage(a, now, entry, lang, header)
+	}
+	tmpl := h.templates.lookup(route, a.Status)
+	if tmpl == nil {
+		return h.formatMessage(a, now, entry, lang, header)
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, newTemplateData(a, now, entry, lang, h.location)); err != nil {
+		log.Printf("ERROR rendering template %s for event %s, using the built-in layout: %v", tmpl.Name(), a.EventID, err)
+		return h.formatMessage(a, now, entry, lang, header)
+	}
+	text, _ := fitMessage(header + sb.String())
+	return text
+}
+
+// renderAll returns the function rendering an alert for each destination of
+// sendAll.
+func (h *Handler) renderAll(a ZabbixAlert, now time.Time, entry store.Entry) func(router.Destination) string {
+	return func(d router.Destination) string { return h.render(a, now, entry, d) }
+}
+
+// renderMessage renders an alert for the chat and topic of a tracked message.
+func (h *Handler) renderMessage(a ZabbixAlert, now time.Time, entry store.Entry, m store.Message) string {
+	return h.render(a, now, entry, router.Destination{ChatID: m.ChatID, ThreadID: m.ThreadID})
+}
+
+// routeOf returns the route delivering the messages of an alert to d, or 0
+// when neither templates nor languages depend on it.
+func (h *Handler) routeOf(a ZabbixAlert, entry store.Entry, d router.Destination) int {
+	if h.templates == nil && !h.languages.perRoute() {
+		return 0
+	}
+	// Tracked messages were routed by the PROBLEM, which a RESOLVED may not
+	// repeat.
+	sev, host, trigger := a.Severity, a.Host, a.TriggerName
+	if len(entry.Messages) > 0 {
+		sev, host, trigger = entry.Severity, entry.Host, entry.TriggerName
+	}
+	return h.router.RouteOf(sev, host, trigger, d)
+}
+
+// catalogOf returns the catalog labelling the messages of an alert for d.
+func (h *Handler) catalogOf(a ZabbixAlert, entry store.Entry, d router.Destination) *i18n.Catalog {
+	if !h.languages.perRoute() {
+		return h.languages.catalog(0)
+	}
+	return h.languages.catalog(h.routeOf(a, entry, d))
+}
+
+// destinationCatalog returns the catalog of the chats of d whatever the alert,
+// for messages such as digests that gather the alerts of several routes: that
+// of the first route delivering to d.
+func (h *Handler) destinationCatalog(d router.Destination) *i18n.Catalog {
+	if !h.languages.perRoute() {
+		return h.languages.catalog(0)
+	}
+	return h.languages.catalog(h.router.RouteTo(d))
+}
+
+func newTemplateData(a ZabbixAlert, now time.Time, entry store.Entry, lang *i18n.Catalog, loc *time.Location) TemplateData {
+	d := TemplateData{
+		Lang:        lang,
+		Status:      string(a.Status),
+		EventID:     a.EventID,
+		TriggerID:   a.TriggerID,
+		TriggerName: a.TriggerName,
+		Host:        a.Host,
+		HostGroups:  hostGroups(a.HostGroup),
+		Severity:    a.Severity,
+		Message:     a.Message,
+		Ack:         entry.Ack,
+		Updates:     localUpdates(entry.Updates, lang),
+		Now:         now,
+	}
+	d.Message = alertDetails(a, entry)
+	// A RESOLVED may only carry the event ID.
+	if d.TriggerName == "" {
+		d.TriggerName = entry.TriggerName
+	}
+	if d.Host == "" {
+		d.Host = entry.Host
+	}
+	if len(d.HostGroups) == 0 {
+		d.HostGroups = entry.HostGroups
+	}
+	d.Start, d.End = eventSpan(a, now, entry, loc)
+	if !d.Start.IsZero() {
+		end := d.End
+		if end.IsZero() {
+			end = now
+		}
+		d.Duration = end.Sub(d.Start)
+	}
+	return d
+}
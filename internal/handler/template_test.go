@@ -0,0 +1,118 @@
+package handler_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+const routeChatID = -500
+
+func TestTemplatesRenderPerStatusAndRoute(t *testing.T) {
+	routes := []config.Route{{
+		Host:         "db-*",
+		Continue:     true,
+		Destinations: []config.Destination{{ChatID: routeChatID}},
+		Templates:    map[string]string{"problem": `DB {{.Host | escape}}`},
+	}}
+	tmpl, err := handler.NewTemplates(map[string]string{
+		"problem":  `{{emoji .Status}} {{emoji .Severity}} {{.TriggerName | truncate 10 | escape}} on {{.Host | escape}}`,
+		"resolved": `{{emoji .Status}} {{.TriggerName | escape}} after {{duration .Duration}}`,
+	}, routes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, routes...), "", handler.WithTemplates(tmpl))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "High", Host: "db-<1>", TriggerName: "Disk space is low"})
+	if len(mb.sentText) == 0 || len(mb.sentChats) != 1 || mb.sentChats[0] != routeChatID {
+		t.Fatalf("expected one message to the route's chat, got %v", mb.sentChats)
+	}
+	if mb.sentText != "DB db-&lt;1&gt;" {
+		t.Errorf("expected the route's template, got: %s", mb.sentText)
+	}
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusProblem, Severity: "High", Host: "web-01", TriggerName: "Disk space is low"})
+	if mb.sentText != "🔴 🔥 Disk spac… on web-01" {
+		t.Errorf("expected the global template, got: %s", mb.sentText)
+	}
+
+	// The route has no RESOLVED template: the global one applies.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusResolved})
+	if !strings.HasPrefix(mb.editedText, "✅ Disk space is low after ") {
+		t.Errorf("expected the global RESOLVED template, got: %s", mb.editedText)
+	}
+
+	// An UPDATE re-renders the PROBLEM message.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "2", Status: handler.StatusUpdate, UpdateUser: "Admin", UpdateAction: "commented"})
+	if mb.editedText != "🔴 🔥 Disk spac… on web-01" {
+		t.Errorf("expected the PROBLEM template, got: %s", mb.editedText)
+	}
+
+	// No UPDATE template anywhere: the built-in layout applies.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "3", Status: handler.StatusUpdate, UpdateUser: "Admin", UpdateAction: "commented"})
+	if !strings.Contains(mb.sentText, "<b>Admin</b>") {
+		t.Errorf("expected the built-in layout, got: %s", mb.sentText)
+	}
+}
+
+func TestTemplatesDefaultKey(t *testing.T) {
+	tmpl, err := handler.NewTemplates(map[string]string{"Default": `{{.Status}} {{.EventID}}`}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithTemplates(tmpl))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "7", Status: "TEST"})
+	if mb.sentText != "TEST 7" {
+		t.Errorf("expected the default template, got: %s", mb.sentText)
+	}
+}
+
+func TestTemplatesTimeUsesDisplayZone(t *testing.T) {
+	tmpl, err := handler.NewTemplates(map[string]string{"problem": `{{time .Start}}`}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatalf("loading time zone: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "", handler.WithTemplates(tmpl), handler.WithDisplayTime(tokyo, "15:04 MST"))
+
+	start := time.Date(2024, 7, 1, 8, 30, 0, 0, time.UTC)
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, EventTimestamp: handler.Timestamp(start.Unix())})
+	if mb.sentText != "17:30 JST" {
+		t.Errorf("expected the start in the display zone, got: %s", mb.sentText)
+	}
+}
+
+func TestNewTemplatesInvalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		global map[string]string
+		routes []config.Route
+		want   string
+	}{
+		{"unknown key", map[string]string{"problems": "x"}, nil, `templates: unknown key "problems"`},
+		{"syntax", map[string]string{"problem": "{{.Host"}, nil, "templates.problem"},
+		{"unknown field", map[string]string{"resolved": "{{.Hostname}}"}, nil, "Hostname"},
+		{"unknown function", map[string]string{"problem": "{{upper .Host}}"}, nil, `"upper" not defined`},
+		{"route", nil, []config.Route{{}, {Name: "db", Templates: map[string]string{"update": "{{.Nope}}"}}}, "routes[1] (db).templates.update"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := handler.NewTemplates(tc.global, tc.routes)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("expected an error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+}
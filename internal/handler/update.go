@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// maxUpdatesShown caps the number of update operations listed in a message;
+// older ones are only counted.
+const maxUpdatesShown = 5
+
+// update records an update operation made on an event in Zabbix (acknowledge,
+// comment, severity change, close) and re-renders the event's messages in
+// place, so the change shows where the problem was posted.
+func (h *Handler) update(ctx context.Context, alert ZabbixAlert, now time.Time) error {
+	u := store.Update{At: now, By: alert.UpdateUser, Action: alert.UpdateAction, Message: alert.UpdateMessage}
+	entry, ok, err := h.trackedEntry(ctx, alert.EventID, now)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// No tracked message found – post the update on its own.
+		entry := store.Entry{Updates: []store.Update{u}}
+		msgs, err := h.sendAll(ctx, alert, h.renderAll(alert, now, entry), nil)
+		if len(msgs) == 0 {
+			return &deliveryError{msg: "failed to send Telegram message", err: err}
+		}
+		h.sendDetails(ctx, alert, now, entry, msgs)
+		log.Printf("UPDATE alert sent (no prior message tracked) for event %s (%d message(s))", alert.EventID, len(msgs))
+		return nil
+	}
+
+	if alert.Severity != "" && !strings.EqualFold(alert.Severity, entry.Severity) {
+		if u.Action == "" {
+			u.SeverityFrom, u.SeverityTo = entry.Severity, alert.Severity
+		}
+		entry.Severity = alert.Severity
+	}
+	if (u.By != "" || u.Action != "" || u.Message != "" || u.SeverityTo != "") && !repeatsLast(entry.Updates, u) {
+		entry.Updates = append(entry.Updates, u)
+	}
+	if err := h.save(ctx, alert.EventID, entry); err != nil {
+		return err
+	}
+
+	if entry.Digest != "" {
+		// The digest only shows counts, which may have changed severity.
+		h.refreshDigest(context.WithoutCancel(ctx), alert.EventID, entry, true)
+		log.Printf("UPDATE alert for event %s recorded in digest %s", alert.EventID, entry.Digest)
+		return nil
+	}
+	if h.flaps != nil && alert.TriggerID != "" && h.flaps.collapses(alert.TriggerID, h.messages(entry)) {
+		log.Printf("UPDATE alert for event %s recorded for flapping trigger %s", alert.EventID, alert.TriggerID)
+		return nil
+	}
+
+	if err := h.editProblem(ctx, alert.EventID, entry, now); err != nil {
+		return err
+	}
+	log.Printf("UPDATE alert applied to event %s", alert.EventID)
+	return nil
+}
+
+// repeatsLast reports whether u is the same operation as the last recorded
+// update, as when a failed delivery of the UPDATE is retried.
+func repeatsLast(updates []store.Update, u store.Update) bool {
+	if len(updates) == 0 {
+		return false
+	}
+	last := updates[len(updates)-1]
+	last.At = u.At
+	return last == u
+}
+
+// formatUpdates renders the most recent update operations of an event, one
+// per line, or "" when there are none.
+func (h *Handler) formatUpdates(updates []store.Update, lang *i18n.Catalog) string {
+	if len(updates) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	if n := len(updates) - maxUpdatesShown; n > 0 {
+		sb.WriteString("✏️ " + fmt.Sprintf(lang.Label("earlier_updates"), n) + "\n")
+		updates = updates[n:]
+	}
+	for _, u := range updates {
+		by := u.By
+		if by == "" {
+			by = "Zabbix"
+		}
+		sb.WriteString(fmt.Sprintf("✏️ <b>%s</b> %s %s", escapeHTML(by), lang.Label("at"), h.formatTime(u.At)))
+		if action := updateAction(u, lang); action != "" {
+			sb.WriteString(": " + escapeHTML(action))
+		}
+		if u.Message != "" {
+			sb.WriteString(fmt.Sprintf(" – <i>%s</i>", escapeHTML(u.Message)))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// updateAction returns what update u did, in the language of lang when it
+// only changed the severity.
+func updateAction(u store.Update, lang *i18n.Catalog) string {
+	if u.Action != "" || u.SeverityTo == "" {
+		return u.Action
+	}
+	return fmt.Sprintf(lang.Label("changed_severity"), lang.Severity(u.SeverityFrom), lang.Severity(u.SeverityTo))
+}
+
+// localUpdates returns a copy of updates whose Action describes severity
+// changes in the language of lang, for templates.
+func localUpdates(updates []store.Update, lang *i18n.Catalog) []store.Update {
+	if len(updates) == 0 {
+		return updates
+	}
+	local := make([]store.Update, len(updates))
+	for i, u := range updates {
+		u.Action = updateAction(u, lang)
+		local[i] = u
+	}
+	return local
+}
@@ -0,0 +1,132 @@
+package handler_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestUpdateEditsOriginalMessage(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "Warning", Host: "db-01", TriggerName: "Disk space is low"})
+	msgID := mb.sentMsgID
+
+	resp := postAlert(t, h, handler.ZabbixAlert{
+		EventID:       "1",
+		Status:        handler.StatusUpdate,
+		Severity:      "Warning",
+		UpdateUser:    "John Smith",
+		UpdateAction:  "acknowledged, commented",
+		UpdateMessage: "looking <into> it",
+	})
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.Code)
+	}
+	if len(mb.sentChats) != 1 {
+		t.Fatalf("expected no new message for an UPDATE, got %d messages", len(mb.sentChats))
+	}
+	if mb.editedMsgID != msgID {
+		t.Fatalf("expected message %d to be edited, got %d", msgID, mb.editedMsgID)
+	}
+	for _, want := range []string{"PROBLEM", "Disk space is low", "<b>John Smith</b>", "acknowledged, commented", "<i>looking &lt;into&gt; it</i>"} {
+		if !strings.Contains(mb.editedText, want) {
+			t.Errorf("expected edited message to contain %q, got: %s", want, mb.editedText)
+		}
+	}
+	if e, _ := s.Get(t.Context(), "1"); len(e.Updates) != 1 {
+		t.Errorf("expected the update to be stored, got %+v", e.Updates)
+	}
+}
+
+func TestUpdateSeverityChangeRerendered(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "Warning"})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusUpdate, Severity: "High", UpdateUser: "Admin"})
+
+	if !strings.Contains(mb.editedText, "🔥 <b>Severity:</b> High") {
+		t.Errorf("expected the new severity to be shown, got: %s", mb.editedText)
+	}
+	if !strings.Contains(mb.editedText, "changed severity from Warning to High") {
+		t.Errorf("expected the severity change to be listed, got: %s", mb.editedText)
+	}
+	if e, _ := s.Get(t.Context(), "1"); e.Severity != "High" {
+		t.Errorf("expected the stored severity to change, got %q", e.Severity)
+	}
+
+	// The RESOLVED keeps the updates.
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusResolved})
+	if !strings.Contains(mb.editedText, "RESOLVED") || !strings.Contains(mb.editedText, "changed severity") {
+		t.Errorf("expected the RESOLVED message to keep the updates, got: %s", mb.editedText)
+	}
+}
+
+func TestUpdateRetryNotDuplicated(t *testing.T) {
+	mb := &mockBot{}
+	s := store.New()
+	h := handler.New(mb, s, newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem})
+	mb.editErr = fmt.Errorf("telegram down")
+	update := handler.ZabbixAlert{EventID: "1", Status: handler.StatusUpdate, UpdateUser: "Admin", UpdateAction: "commented", UpdateMessage: "on it"}
+	if resp := postAlert(t, h, update); resp.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500 when the edit fails, got %d", resp.Code)
+	}
+	mb.editErr = nil
+	postAlert(t, h, update)
+	if e, _ := s.Get(t.Context(), "1"); len(e.Updates) != 1 {
+		t.Errorf("expected the retried update to be stored once, got %d", len(e.Updates))
+	}
+}
+
+func TestUpdateWithoutTrackedMessageSendsNew(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "9", Status: handler.StatusUpdate, UpdateUser: "Admin", UpdateAction: "closed"})
+	if len(mb.sentChats) != 1 || !strings.Contains(mb.sentText, "UPDATE") || !strings.Contains(mb.sentText, "closed") {
+		t.Errorf("expected the update to be posted on its own, got: %s", mb.sentText)
+	}
+}
+
+func TestUpdateListCapped(t *testing.T) {
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t), "")
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem})
+	for i := 1; i <= 7; i++ {
+		postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusUpdate, UpdateUser: "Admin", UpdateMessage: fmt.Sprintf("comment %d", i)})
+	}
+	if strings.Contains(mb.editedText, "comment 2<") || !strings.Contains(mb.editedText, "comment 7") {
+		t.Errorf("expected only the latest updates to be listed, got: %s", mb.editedText)
+	}
+	if !strings.Contains(mb.editedText, "2 earlier update(s)") {
+		t.Errorf("expected the older updates to be counted, got: %s", mb.editedText)
+	}
+}
+
+func TestUpdateSeverityChangeInRouteLanguage(t *testing.T) {
+	routes := []config.Route{{Host: "muc-*", Language: "de", Destinations: []config.Destination{{ChatID: routeChatID}}}}
+	langs, err := handler.NewLanguages("", routes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mb := &mockBot{}
+	h := handler.New(mb, store.New(), newRouter(t, routes...), "", handler.WithLanguages(langs))
+
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusProblem, Severity: "Warning", Host: "muc-01"})
+	postAlert(t, h, handler.ZabbixAlert{EventID: "1", Status: handler.StatusUpdate, Severity: "High", UpdateUser: "Admin"})
+	if !strings.Contains(mb.editedText, "hat den Schweregrad von Warnung auf Hoch geändert") {
+		t.Errorf("expected the German severity change, got: %s", mb.editedText)
+	}
+}
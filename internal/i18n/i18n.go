@@ -0,0 +1,122 @@
+// Package i18n provides the translated labels of the alert messages. One
+// catalog per language is embedded in the binary; English is the default.
+package i18n
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLanguage is the language used when none is configured.
+const DefaultLanguage = "en"
+
+//go:embed catalogs/*.yaml
+var catalogs embed.FS
+
+// Catalog holds the labels of one language, and its names for the alert
+// statuses and severities.
+type Catalog struct {
+	// Language is the code of the catalog, e.g. "it".
+	Language string
+
+	labels     map[string]string
+	statuses   map[string]string
+	severities map[string]string
+}
+
+// catalogFile is the layout of the embedded catalog files.
+type catalogFile struct {
+	Labels     map[string]string `yaml:"labels"`
+	Statuses   map[string]string `yaml:"statuses"`
+	Severities map[string]string `yaml:"severities"`
+}
+
+// Languages returns the codes of the embedded catalogs, sorted.
+func Languages() []string {
+	entries, _ := catalogs.ReadDir("catalogs")
+	langs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		langs = append(langs, strings.TrimSuffix(e.Name(), ".yaml"))
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Load returns the catalog of lang, a language code such as "it". A region
+// ("it-IT", "de_CH") is ignored. Every catalog must translate all labels of
+// the English one.
+func Load(lang string) (*Catalog, error) {
+	code := strings.ToLower(lang)
+	if i := strings.IndexAny(code, "-_"); i >= 0 {
+		code = code[:i]
+	}
+	c, err := parse(code)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported language %q (available: %s)", lang, strings.Join(Languages(), ", "))
+	}
+	if code == DefaultLanguage {
+		return c, nil
+	}
+	en, err := parse(DefaultLanguage)
+	if err != nil {
+		return nil, err
+	}
+	for key := range en.labels {
+		if _, ok := c.labels[key]; !ok {
+			return nil, fmt.Errorf("language %q: missing label %q", code, key)
+		}
+	}
+	return c, nil
+}
+
+// Default returns the English catalog.
+func Default() *Catalog {
+	c, err := Load(DefaultLanguage)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func parse(code string) (*Catalog, error) {
+	data, err := catalogs.ReadFile(path.Join("catalogs", code+".yaml"))
+	if err != nil {
+		return nil, err
+	}
+	var f catalogFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("language %q: %w", code, err)
+	}
+	return &Catalog{Language: code, labels: f.Labels, statuses: f.Statuses, severities: f.Severities}, nil
+}
+
+// Label returns the label for key, or key itself when it has none.
+func (c *Catalog) Label(key string) string {
+	if s, ok := c.labels[key]; ok {
+		return s
+	}
+	return key
+}
+
+// Status returns the name of an alert status (e.g. "PROBLEM"), or status
+// itself when it has no translation.
+func (c *Catalog) Status(status string) string {
+	if s, ok := c.statuses[strings.ToUpper(status)]; ok {
+		return s
+	}
+	return status
+}
+
+// Severity returns the name of a severity (e.g. "High"), or sev itself when
+// it has no translation.
+func (c *Catalog) Severity(sev string) string {
+	if s, ok := c.severities[strings.ToUpper(sev)]; ok {
+		return s
+	}
+	return sev
+}
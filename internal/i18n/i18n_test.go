@@ -0,0 +1,60 @@
+package i18n_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/i18n"
+)
+
+func TestLanguages(t *testing.T) {
+	if got := i18n.Languages(); !reflect.DeepEqual(got, []string{"de", "en", "it"}) {
+		t.Fatalf("unexpected languages: %v", got)
+	}
+	// Load checks every catalog against the English labels.
+	for _, lang := range i18n.Languages() {
+		if _, err := i18n.Load(lang); err != nil {
+			t.Errorf("loading %s: %v", lang, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c, err := i18n.Load("it-IT")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Language != "it" {
+		t.Errorf("expected the region to be ignored, got %q", c.Language)
+	}
+	if got := c.Label("duration"); got != "Durata" {
+		t.Errorf("expected Durata, got %q", got)
+	}
+	if got := c.Status("resolved"); got != "RISOLTO" {
+		t.Errorf("expected RISOLTO, got %q", got)
+	}
+	if got := c.Severity("High"); got != "Alta" {
+		t.Errorf("expected Alta, got %q", got)
+	}
+	if got := c.Severity("Custom"); got != "Custom" {
+		t.Errorf("expected an unknown severity to be kept, got %q", got)
+	}
+
+	if _, err := i18n.Load("fr"); err == nil || !strings.Contains(err.Error(), "de, en, it") {
+		t.Errorf("expected an error listing the languages, got %v", err)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	c := i18n.Default()
+	if got := c.Label("start_time"); got != "Start Time" {
+		t.Errorf("expected Start Time, got %q", got)
+	}
+	if got := c.Status("PROBLEM"); got != "PROBLEM" {
+		t.Errorf("expected English names to be kept, got %q", got)
+	}
+	if got := c.Label("no_such_label"); got != "no_such_label" {
+		t.Errorf("expected an unknown label to be returned as is, got %q", got)
+	}
+}
@@ -0,0 +1,186 @@
+package outbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltQueueBucket   = []byte("outbox")
+	boltClaimedBucket = []byte("outbox_claimed")
+	boltDeadBucket    = []byte("outbox_dead")
+)
+
+// BoltQueue is a Queue stored in buckets of a bbolt database, usually the
+// one of the store. Jobs are keyed by a sequence number, so claimed jobs
+// return to their original position when recovered.
+type BoltQueue struct {
+	db *bolt.DB
+}
+
+// NewBoltQueue creates the outbox buckets in db if needed.
+func NewBoltQueue(db *bolt.DB) (*BoltQueue, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltQueueBucket, boltClaimedBucket, boltDeadBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltQueue{db: db}, nil
+}
+
+// Push appends a job to the tail of the queue.
+func (b *BoltQueue) Push(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return appendSeq(tx.Bucket(boltQueueBucket), data)
+	})
+}
+
+// Claim moves the oldest job to the claimed bucket.
+func (b *BoltQueue) Claim() (Job, bool, error) {
+	var job Job
+	var found bool
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket(boltQueueBucket).Cursor().First()
+		if k == nil {
+			return nil
+		}
+		// Keys and values are only valid inside the transaction, so copy them.
+		key := append([]byte(nil), k...)
+		data := append([]byte(nil), v...)
+		if err := tx.Bucket(boltQueueBucket).Delete(key); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &job); err != nil {
+			// Set the value aside instead of blocking the queue with it.
+			return appendSeq(tx.Bucket(boltDeadBucket), data)
+		}
+		job.receipt = key
+		found = true
+		return tx.Bucket(boltClaimedBucket).Put(key, data)
+	})
+	if err != nil || !found {
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+// Done removes a claimed job.
+func (b *BoltQueue) Done(job Job) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltClaimedBucket).Delete(job.receipt)
+	})
+}
+
+// Retry moves a claimed job to the tail of the queue, under a new sequence
+// number.
+func (b *BoltQueue) Retry(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltClaimedBucket).Delete(job.receipt); err != nil {
+			return err
+		}
+		return appendSeq(tx.Bucket(boltQueueBucket), data)
+	})
+}
+
+// Bury moves a claimed job to the dead-letter bucket.
+func (b *BoltQueue) Bury(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltClaimedBucket).Delete(job.receipt); err != nil {
+			return err
+		}
+		return appendSeq(tx.Bucket(boltDeadBucket), data)
+	})
+}
+
+// Recover moves every claimed job back to the queue under its original key.
+func (b *BoltQueue) Recover() (int, error) {
+	n := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		claimed, queue := tx.Bucket(boltClaimedBucket), tx.Bucket(boltQueueBucket)
+		c := claimed.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if err := queue.Put(append([]byte(nil), k...), append([]byte(nil), v...)); err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Queued returns the queued jobs, in queue order.
+func (b *BoltQueue) Queued() ([]Job, error) {
+	return b.jobs(boltQueueBucket)
+}
+
+// DeadLetters returns the dead-letter list, oldest first.
+func (b *BoltQueue) DeadLetters() ([]Job, error) {
+	return b.jobs(boltDeadBucket)
+}
+
+// jobs returns the jobs in bucket, skipping those that do not decode.
+func (b *BoltQueue) jobs(bucket []byte) ([]Job, error) {
+	var jobs []Job
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(_, v []byte) error {
+			var job Job
+			if err := json.Unmarshal(v, &job); err == nil {
+				jobs = append(jobs, job)
+			}
+			return nil
+		})
+	})
+	return jobs, err
+}
+
+// Stats returns the number of pending and dead jobs.
+func (b *BoltQueue) Stats() (Stats, error) {
+	var s Stats
+	err := b.db.View(func(tx *bolt.Tx) error {
+		s.Pending = tx.Bucket(boltQueueBucket).Stats().KeyN + tx.Bucket(boltClaimedBucket).Stats().KeyN
+		s.Dead = tx.Bucket(boltDeadBucket).Stats().KeyN
+		return nil
+	})
+	return s, err
+}
+
+// String describes the backend for status output.
+func (b *BoltQueue) String() string {
+	return "bbolt " + b.db.Path()
+}
+
+// appendSeq stores data under the next sequence number of bucket. Keys are
+// big-endian so byte order is insertion order.
+func appendSeq(bucket *bolt.Bucket, data []byte) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return bucket.Put(key, data)
+}
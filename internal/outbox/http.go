@@ -0,0 +1,37 @@
+package outbox
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// DeadLetterHandler serves GET requests with the dead-letter list as a JSON
+// array. If secret is non-empty the request must carry it as a bearer token
+// in the Authorization header; otherwise it is rejected with 401.
+func (o *Outbox) DeadLetterHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if secret != "" && r.Header.Get("Authorization") != "Bearer "+secret {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		jobs, err := o.DeadLetters()
+		if err != nil {
+			log.Printf("ERROR outbox: listing dead letters: %v", err)
+			http.Error(w, "failed to read dead letters", http.StatusInternalServerError)
+			return
+		}
+		if jobs == nil {
+			jobs = []Job{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(jobs); err != nil {
+			log.Printf("ERROR outbox: writing dead letters: %v", err)
+		}
+	})
+}
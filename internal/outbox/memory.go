@@ -0,0 +1,105 @@
+package outbox
+
+import "sync"
+
+// MemoryQueue is a Queue held in process memory. Queued jobs are lost on
+// restart; it is used when no persistent backend is configured.
+type MemoryQueue struct {
+	mu      sync.Mutex
+	pending []Job
+	claimed []Job
+	dead    []Job
+}
+
+// NewMemoryQueue creates an empty MemoryQueue.
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{}
+}
+
+// Push appends a job to the tail of the queue.
+func (m *MemoryQueue) Push(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = append(m.pending, job)
+	return nil
+}
+
+// Claim removes the oldest job from the queue and reserves it for the caller.
+func (m *MemoryQueue) Claim() (Job, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pending) == 0 {
+		return Job{}, false, nil
+	}
+	job := m.pending[0]
+	m.pending = m.pending[1:]
+	m.claimed = append(m.claimed, job)
+	return job, true, nil
+}
+
+// Done discards a claimed job.
+func (m *MemoryQueue) Done(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(job.ID)
+	return nil
+}
+
+// Retry moves a claimed job to the tail of the queue.
+func (m *MemoryQueue) Retry(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(job.ID)
+	m.pending = append(m.pending, job)
+	return nil
+}
+
+// Bury moves a claimed job to the dead-letter list.
+func (m *MemoryQueue) Bury(job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.release(job.ID)
+	m.dead = append(m.dead, job)
+	return nil
+}
+
+// Recover returns the claimed jobs to the head of the queue.
+func (m *MemoryQueue) Recover() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.claimed)
+	m.pending = append(m.claimed, m.pending...)
+	m.claimed = nil
+	return n, nil
+}
+
+// Queued returns a copy of the queued jobs.
+func (m *MemoryQueue) Queued() ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Job(nil), m.pending...), nil
+}
+
+// DeadLetters returns a copy of the dead-letter list.
+func (m *MemoryQueue) DeadLetters() ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Job(nil), m.dead...), nil
+}
+
+// Stats returns the number of pending and dead jobs.
+func (m *MemoryQueue) Stats() (Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Stats{Pending: len(m.pending) + len(m.claimed), Dead: len(m.dead)}, nil
+}
+
+// release drops the claimed job with the given ID. The caller holds m.mu.
+func (m *MemoryQueue) release(id string) {
+	for i, j := range m.claimed {
+		if j.ID == id {
+			m.claimed = append(m.claimed[:i], m.claimed[i+1:]...)
+			return
+		}
+	}
+}
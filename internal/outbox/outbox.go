@@ -0,0 +1,346 @@
+// Package outbox queues alerts for delivery to Telegram so the webhook can
+// answer Zabbix immediately. A single worker delivers the queued alerts in
+// order. An alert that fails is rescheduled behind the others with
+// exponential backoff, holding back only the alerts with the same key, and
+// alerts that keep failing are moved to a dead-letter list.
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Defaults of the delivery worker.
+const (
+	DefaultMaxAttempts = 10
+	DefaultBaseDelay   = time.Second
+	DefaultMaxDelay    = 5 * time.Minute
+
+	// pollInterval bounds the wait for jobs pushed by other processes sharing
+	// the queue, which cannot wake this worker directly.
+	pollInterval = 5 * time.Second
+)
+
+// Job is one alert waiting to be delivered.
+type Job struct {
+	ID string `json:"id"`
+	// Key groups the jobs that must be delivered in order, such as the
+	// alerts of one event.
+	Key      string          `json:"key,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+	Enqueued time.Time       `json:"enqueued"`
+	// Attempts and LastError record the failed deliveries so far, and
+	// NotBefore the time the next attempt is due.
+	Attempts  int       `json:"attempts,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+	NotBefore time.Time `json:"not_before,omitzero"`
+
+	// receipt identifies a claimed job to the queue that handed it out.
+	receipt []byte
+}
+
+// Queue is a persistent FIFO of jobs with a dead-letter list. A job is
+// claimed before it is delivered and stays claimed until it is completed
+// with Done or Bury, so a crash during delivery never loses it.
+type Queue interface {
+	// Push appends a job to the tail of the queue.
+	Push(job Job) error
+	// Claim removes the oldest job from the queue and reserves it for the
+	// caller. ok is false when the queue is empty.
+	Claim() (job Job, ok bool, err error)
+	// Done discards a claimed job after successful delivery.
+	Done(job Job) error
+	// Retry returns a claimed job, with the attempts and due time it was
+	// updated with, to the tail of the queue.
+	Retry(job Job) error
+	// Bury moves a claimed job to the dead-letter list.
+	Bury(job Job) error
+	// Recover returns the jobs claimed but never completed by a previous run
+	// to the head of the queue and reports how many there were.
+	Recover() (int, error)
+	// Queued returns the jobs waiting in the queue, in queue order.
+	Queued() ([]Job, error)
+	// DeadLetters returns the dead-letter list, oldest first.
+	DeadLetters() ([]Job, error)
+	// Stats returns the number of pending and dead jobs.
+	Stats() (Stats, error)
+}
+
+// Stats summarises the contents of a queue.
+type Stats struct {
+	// Pending counts the queued and claimed jobs.
+	Pending int
+	Dead    int
+}
+
+// Outbox accepts alerts for delivery and runs the worker delivering them.
+type Outbox struct {
+	queue   Queue
+	deliver func(payload []byte) error
+	wake    chan struct{}
+
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	retryAfter  func(error) (time.Duration, bool)
+}
+
+// Option configures optional Outbox behaviour.
+type Option func(*Outbox)
+
+// WithMaxAttempts sets the number of delivery attempts after which a job is
+// moved to the dead-letter list (DefaultMaxAttempts by default).
+func WithMaxAttempts(n int) Option {
+	return func(o *Outbox) { o.maxAttempts = n }
+}
+
+// WithBackoff sets the delay before the first retry, doubled after every
+// further failure up to maxDelay.
+func WithBackoff(base, maxDelay time.Duration) Option {
+	return func(o *Outbox) { o.baseDelay, o.maxDelay = base, maxDelay }
+}
+
+// WithRetryAfter lets the worker honour a delay requested by the failing
+// service, such as the retry_after of a Telegram 429 response, instead of its
+// own backoff.
+func WithRetryAfter(fn func(error) (time.Duration, bool)) Option {
+	return func(o *Outbox) { o.retryAfter = fn }
+}
+
+// New creates an Outbox storing jobs in q and delivering their payload with
+// deliver. Run must be called for queued jobs to be delivered.
+func New(q Queue, deliver func(payload []byte) error, opts ...Option) *Outbox {
+	o := &Outbox{
+		queue:       q,
+		deliver:     deliver,
+		wake:        make(chan struct{}, 1),
+		maxAttempts: DefaultMaxAttempts,
+		baseDelay:   DefaultBaseDelay,
+		maxDelay:    DefaultMaxDelay,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Enqueue persists payload for delivery and wakes the worker. Payloads with
+// the same key are delivered in the order they were enqueued.
+func (o *Outbox) Enqueue(key string, payload []byte) error {
+	job := Job{ID: newID(), Key: key, Payload: payload, Enqueued: time.Now().UTC()}
+	if err := o.queue.Push(job); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stats returns the number of pending and dead jobs.
+func (o *Outbox) Stats() (Stats, error) {
+	return o.queue.Stats()
+}
+
+// DeadLetters returns the jobs that could not be delivered, oldest first.
+func (o *Outbox) DeadLetters() ([]Job, error) {
+	return o.queue.DeadLetters()
+}
+
+// Run delivers queued jobs one at a time, in order, until ctx is cancelled.
+// A job that fails is rescheduled behind the others, so it does not hold up
+// the rest of the queue while it waits for its next attempt; only the jobs
+// with the same key wait for it, so a RESOLVED is never delivered before its
+// PROBLEM. Keys are held back by the jobs this worker is retrying, and at
+// start by the jobs a previous run left waiting for a retry.
+func (o *Outbox) Run(ctx context.Context) {
+	if n, err := o.queue.Recover(); err != nil {
+		log.Printf("ERROR outbox: recovering claimed jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("outbox: requeued %d job(s) left over from a previous run", n)
+	}
+
+	held := o.retrying()
+	// skipped counts the jobs claimed in a row that were not due, and next
+	// is the earliest time one of them is.
+	var skipped int
+	var next time.Time
+	for ctx.Err() == nil {
+		job, ok, err := o.queue.Claim()
+		if err != nil {
+			log.Printf("ERROR outbox: claiming job: %v", err)
+			o.sleep(ctx, o.baseDelay)
+			continue
+		}
+		if !ok {
+			o.idle(ctx, pollInterval)
+			continue
+		}
+
+		now := time.Now()
+		if job.NotBefore.After(now) || o.isHeld(job, held, now) {
+			o.requeue(ctx, job)
+			if job.NotBefore.After(now) && (next.IsZero() || job.NotBefore.Before(next)) {
+				next = job.NotBefore
+			}
+			skipped++
+			if st, err := o.queue.Stats(); err != nil || skipped >= st.Pending {
+				// Every queued job is waiting for a retry.
+				wait := pollInterval
+				if !next.IsZero() {
+					wait = min(time.Until(next), pollInterval)
+				}
+				o.idle(ctx, wait)
+				skipped, next = 0, time.Time{}
+			}
+			continue
+		}
+		skipped, next = 0, time.Time{}
+		o.process(ctx, job, held)
+	}
+}
+
+// heldJob is a job being retried, which holds back the later jobs with its
+// key until it is delivered or dead-lettered.
+type heldJob struct {
+	id  string
+	due time.Time
+}
+
+// retrying returns the queued jobs that already failed, by key: the oldest
+// one of each key holds back the others, as it did before a restart.
+func (o *Outbox) retrying() map[string]heldJob {
+	held := make(map[string]heldJob)
+	jobs, err := o.queue.Queued()
+	if err != nil {
+		log.Printf("ERROR outbox: listing queued jobs: %v", err)
+		return held
+	}
+	enqueued := make(map[string]time.Time)
+	for _, job := range jobs {
+		if job.Key == "" || job.Attempts == 0 {
+			continue
+		}
+		if t, ok := enqueued[job.Key]; ok && !job.Enqueued.Before(t) {
+			continue
+		}
+		enqueued[job.Key] = job.Enqueued
+		held[job.Key] = heldJob{id: job.ID, due: job.NotBefore}
+	}
+	return held
+}
+
+// isHeld reports whether job must wait for an earlier job with its key. A
+// job is no longer waited for once it is overdue by more than the maximum
+// backoff, as happens when another process sharing the queue took it over.
+func (o *Outbox) isHeld(job Job, held map[string]heldJob, now time.Time) bool {
+	h, ok := held[job.Key]
+	if !ok || h.id == job.ID {
+		return false
+	}
+	if now.After(h.due.Add(o.maxDelay)) {
+		delete(held, job.Key)
+		return false
+	}
+	return true
+}
+
+// process makes one delivery attempt of a claimed job. A failed job is
+// returned to the tail of the queue to be retried after a backoff, until it
+// runs out of attempts and is moved to the dead-letter list.
+func (o *Outbox) process(ctx context.Context, job Job, held map[string]heldJob) {
+	err := o.deliver(job.Payload)
+	if err == nil {
+		delete(held, job.Key)
+		if err := o.queue.Done(job); err != nil {
+			log.Printf("ERROR outbox: completing job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if job.Attempts >= o.maxAttempts {
+		delete(held, job.Key)
+		log.Printf("ERROR outbox: job %s failed %d time(s), moving it to the dead-letter list: %v", job.ID, job.Attempts, err)
+		job.NotBefore = time.Time{}
+		if err := o.queue.Bury(job); err != nil {
+			log.Printf("ERROR outbox: burying job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	wait := o.backoff(job.Attempts)
+	if o.retryAfter != nil {
+		if d, ok := o.retryAfter(err); ok {
+			wait = d
+		}
+	}
+	log.Printf("outbox: delivery of job %s failed (attempt %d/%d), retrying in %s: %v", job.ID, job.Attempts, o.maxAttempts, wait, err)
+	job.NotBefore = time.Now().Add(wait)
+	if job.Key != "" {
+		held[job.Key] = heldJob{id: job.ID, due: job.NotBefore}
+	}
+	o.requeue(ctx, job)
+}
+
+// backoff returns the delay before the attempt following the given number
+// of failed ones: baseDelay, doubled after every further failure up to
+// maxDelay.
+func (o *Outbox) backoff(failures int) time.Duration {
+	d := o.baseDelay
+	for i := 1; i < failures && d < o.maxDelay; i++ {
+		d *= 2
+	}
+	return min(d, o.maxDelay)
+}
+
+// requeue returns a claimed job to the tail of the queue, trying again while
+// the queue fails. On cancellation the job stays claimed and is recovered by
+// the next Run.
+func (o *Outbox) requeue(ctx context.Context, job Job) {
+	for {
+		err := o.queue.Retry(job)
+		if err == nil {
+			return
+		}
+		log.Printf("ERROR outbox: requeueing job %s: %v", job.ID, err)
+		if !o.sleep(ctx, o.baseDelay) {
+			return
+		}
+	}
+}
+
+// idle waits until a job is enqueued, d elapses or ctx is cancelled.
+func (o *Outbox) idle(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-o.wake:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// sleep waits for d and reports false if ctx was cancelled first.
+func (o *Outbox) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,302 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/outbox"
+)
+
+// recorder is a delivery function that fails the first failures calls.
+type recorder struct {
+	mu        sync.Mutex
+	failures  int
+	err       error
+	calls     int
+	delivered []string
+	done      chan struct{}
+}
+
+func newRecorder(failures int) *recorder {
+	return &recorder{failures: failures, err: errors.New("telegram unreachable"), done: make(chan struct{}, 100)}
+}
+
+func (r *recorder) deliver(payload []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.calls <= r.failures {
+		return r.err
+	}
+	r.delivered = append(r.delivered, string(payload))
+	r.done <- struct{}{}
+	return nil
+}
+
+func (r *recorder) snapshot() (int, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls, append([]string(nil), r.delivered...)
+}
+
+// run starts the worker and returns a function stopping it.
+func run(t *testing.T, o *outbox.Outbox) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		o.Run(ctx)
+		close(stopped)
+	}()
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+func waitDelivered(t *testing.T, r *recorder, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for delivery %d of %d", i+1, n)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	rec := newRecorder(0)
+	o := outbox.New(outbox.NewMemoryQueue(), rec.deliver)
+	stop := run(t, o)
+	defer stop()
+
+	for _, p := range []string{`"a"`, `"b"`, `"c"`} {
+		if err := o.Enqueue("1", []byte(p)); err != nil {
+			t.Fatalf("Enqueue: %v", err)
+		}
+	}
+	waitDelivered(t, rec, 3)
+
+	_, got := rec.snapshot()
+	if len(got) != 3 || got[0] != `"a"` || got[1] != `"b"` || got[2] != `"c"` {
+		t.Errorf("unexpected delivery order %v", got)
+	}
+	st, _ := o.Stats()
+	if st.Pending != 0 || st.Dead != 0 {
+		t.Errorf("expected an empty outbox, got %+v", st)
+	}
+}
+
+func TestOutboxRetriesFailedDelivery(t *testing.T) {
+	rec := newRecorder(2)
+	o := outbox.New(outbox.NewMemoryQueue(), rec.deliver, outbox.WithBackoff(time.Millisecond, 4*time.Millisecond))
+	stop := run(t, o)
+	defer stop()
+
+	o.Enqueue("1", []byte(`"a"`))
+	o.Enqueue("1", []byte(`"b"`))
+	waitDelivered(t, rec, 2)
+
+	calls, got := rec.snapshot()
+	if calls != 4 {
+		t.Errorf("expected 2 failures and 2 deliveries, got %d calls", calls)
+	}
+	if got[0] != `"a"` || got[1] != `"b"` {
+		t.Errorf("a retried job must hold back the following ones, got %v", got)
+	}
+}
+
+func TestOutboxRetryHoldsBackOnlyItsKey(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []string
+	done := make(chan struct{}, 10)
+	deliver := func(payload []byte) error {
+		if string(payload) == `"a"` {
+			return errors.New("telegram unreachable")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, string(payload))
+		done <- struct{}{}
+		return nil
+	}
+	q := outbox.NewMemoryQueue()
+	o := outbox.New(q, deliver, outbox.WithBackoff(time.Hour, time.Hour))
+	stop := run(t, o)
+
+	o.Enqueue("1", []byte(`"a"`))
+	o.Enqueue("1", []byte(`"b"`))
+	o.Enqueue("2", []byte(`"c"`))
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the job of the other key")
+	}
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 || delivered[0] != `"c"` {
+		t.Errorf("expected only the job of the other key to be delivered, got %v", delivered)
+	}
+	if st, _ := q.Stats(); st.Pending != 2 {
+		t.Errorf("expected the failed job and the one behind it to stay pending, got %+v", st)
+	}
+}
+
+func TestOutboxDeadLettersAfterMaxAttempts(t *testing.T) {
+	rec := newRecorder(3)
+	o := outbox.New(outbox.NewMemoryQueue(), rec.deliver,
+		outbox.WithMaxAttempts(3),
+		outbox.WithBackoff(time.Millisecond, time.Millisecond),
+	)
+	stop := run(t, o)
+	defer stop()
+
+	o.Enqueue("1", []byte(`"lost"`))
+	o.Enqueue("1", []byte(`"next"`))
+	waitDelivered(t, rec, 1)
+
+	dead, err := o.DeadLetters()
+	if err != nil {
+		t.Fatalf("DeadLetters: %v", err)
+	}
+	if len(dead) != 1 || string(dead[0].Payload) != `"lost"` {
+		t.Fatalf("expected the failing job in the dead-letter list, got %+v", dead)
+	}
+	if dead[0].Attempts != 3 || dead[0].LastError != "telegram unreachable" {
+		t.Errorf("unexpected dead letter details %+v", dead[0])
+	}
+	if _, got := rec.snapshot(); len(got) != 1 || got[0] != `"next"` {
+		t.Errorf("expected the next job to be delivered, got %v", got)
+	}
+}
+
+func TestOutboxHonoursRetryAfter(t *testing.T) {
+	rec := newRecorder(1)
+	var asked []error
+	retryAfter := func(err error) (time.Duration, bool) {
+		asked = append(asked, err)
+		return time.Millisecond, true
+	}
+	// The backoff alone would outlast the test.
+	o := outbox.New(outbox.NewMemoryQueue(), rec.deliver,
+		outbox.WithBackoff(time.Hour, time.Hour),
+		outbox.WithRetryAfter(retryAfter),
+	)
+	stop := run(t, o)
+	defer stop()
+
+	o.Enqueue("1", []byte(`"a"`))
+	waitDelivered(t, rec, 1)
+	if len(asked) != 1 || asked[0] != rec.err {
+		t.Errorf("expected the delivery error to be passed to retryAfter, got %v", asked)
+	}
+}
+
+func TestOutboxRecoversClaimedJobs(t *testing.T) {
+	q := outbox.NewMemoryQueue()
+	q.Push(outbox.Job{ID: "1", Payload: json.RawMessage(`"a"`)})
+	q.Push(outbox.Job{ID: "2", Payload: json.RawMessage(`"b"`)})
+	// Simulate a crash while "a" was being delivered.
+	if _, ok, _ := q.Claim(); !ok {
+		t.Fatal("expected a job to claim")
+	}
+
+	rec := newRecorder(0)
+	stop := run(t, outbox.New(q, rec.deliver))
+	defer stop()
+	waitDelivered(t, rec, 2)
+
+	if _, got := rec.snapshot(); got[0] != `"a"` || got[1] != `"b"` {
+		t.Errorf("expected the claimed job to be delivered first, got %v", got)
+	}
+}
+
+func TestOutboxRestartKeepsRetryOrder(t *testing.T) {
+	// A previous run was retrying the PROBLEM when it stopped; the RESOLVED
+	// queued behind it is now ahead of it.
+	q := outbox.NewMemoryQueue()
+	enqueued := time.Now().Add(-time.Minute)
+	q.Push(outbox.Job{ID: "2", Key: "1", Payload: json.RawMessage(`"RESOLVED"`), Enqueued: enqueued.Add(time.Second)})
+	q.Push(outbox.Job{ID: "1", Key: "1", Payload: json.RawMessage(`"PROBLEM"`), Enqueued: enqueued, Attempts: 1, NotBefore: time.Now().Add(300 * time.Millisecond)})
+
+	rec := newRecorder(0)
+	stop := run(t, outbox.New(q, rec.deliver))
+	defer stop()
+	waitDelivered(t, rec, 2)
+
+	if _, got := rec.snapshot(); got[0] != `"PROBLEM"` || got[1] != `"RESOLVED"` {
+		t.Errorf("expected the PROBLEM to be delivered first, got %v", got)
+	}
+}
+
+func TestOutboxStopLeavesJobClaimed(t *testing.T) {
+	rec := newRecorder(1000)
+	q := outbox.NewMemoryQueue()
+	o := outbox.New(q, rec.deliver, outbox.WithBackoff(time.Hour, time.Hour))
+	stop := run(t, o)
+
+	o.Enqueue("1", []byte(`"a"`))
+	waitFor(t, func() bool { calls, _ := rec.snapshot(); return calls == 1 })
+	stop()
+
+	if st, _ := q.Stats(); st.Pending != 1 || st.Dead != 0 {
+		t.Errorf("expected the job to stay pending after stop, got %+v", st)
+	}
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	q := outbox.NewMemoryQueue()
+	q.Push(outbox.Job{ID: "1", Payload: json.RawMessage(`{"event_id":"42"}`)})
+	job, _, _ := q.Claim()
+	job.Attempts, job.LastError = 10, "Bad Request: chat not found"
+	q.Bury(job)
+	h := outbox.New(q, newRecorder(0).deliver).DeadLetterHandler("s3cret")
+
+	req := httptest.NewRequest(http.MethodGet, "/outbox/dead", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the secret, got %d", rr.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var got []outbox.Job
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "1" || got[0].LastError != "Bad Request: chat not found" {
+		t.Errorf("unexpected dead letters %+v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/outbox/dead", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", rr.Code)
+	}
+}
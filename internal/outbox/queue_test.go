@@ -0,0 +1,202 @@
+package outbox_test
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/outbox"
+)
+
+// queues returns a fresh instance of every Queue implementation.
+func queues(t *testing.T) map[string]outbox.Queue {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	cluster := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{miniredis.RunT(t).Addr()}})
+	t.Cleanup(func() { cluster.Close() })
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "outbox.db"), 0o600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	bq, err := outbox.NewBoltQueue(db)
+	if err != nil {
+		t.Fatalf("NewBoltQueue: %v", err)
+	}
+
+	return map[string]outbox.Queue{
+		"memory":        outbox.NewMemoryQueue(),
+		"redis":         outbox.NewRedisQueue(client, outbox.DefaultRedisKey, "test"),
+		"redis cluster": outbox.NewRedisQueue(cluster, outbox.DefaultRedisKey, "test"),
+		"bolt":          bq,
+	}
+}
+
+func job(id string) outbox.Job {
+	return outbox.Job{ID: id, Payload: json.RawMessage(`{"event_id":"` + id + `"}`)}
+}
+
+func claim(t *testing.T, q outbox.Queue) outbox.Job {
+	t.Helper()
+	j, ok, err := q.Claim()
+	if err != nil || !ok {
+		t.Fatalf("Claim: ok=%v err=%v", ok, err)
+	}
+	return j
+}
+
+func TestQueueFIFO(t *testing.T) {
+	for name, q := range queues(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"1", "2", "3"} {
+				if err := q.Push(job(id)); err != nil {
+					t.Fatalf("Push: %v", err)
+				}
+			}
+			for _, want := range []string{"1", "2", "3"} {
+				j := claim(t, q)
+				if j.ID != want || string(j.Payload) != `{"event_id":"`+want+`"}` {
+					t.Errorf("expected job %s, got %+v", want, j)
+				}
+				if err := q.Done(j); err != nil {
+					t.Fatalf("Done: %v", err)
+				}
+			}
+			if _, ok, err := q.Claim(); ok || err != nil {
+				t.Errorf("expected an empty queue, got ok=%v err=%v", ok, err)
+			}
+			if st, _ := q.Stats(); st.Pending != 0 {
+				t.Errorf("expected no pending jobs, got %+v", st)
+			}
+		})
+	}
+}
+
+func TestQueueRecover(t *testing.T) {
+	for name, q := range queues(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"1", "2", "3"} {
+				q.Push(job(id))
+			}
+			claim(t, q)
+			claim(t, q)
+			if st, _ := q.Stats(); st.Pending != 3 {
+				t.Errorf("claimed jobs must count as pending, got %+v", st)
+			}
+
+			n, err := q.Recover()
+			if err != nil || n != 2 {
+				t.Fatalf("Recover: n=%d err=%v", n, err)
+			}
+			for _, want := range []string{"1", "2", "3"} {
+				if j := claim(t, q); j.ID != want {
+					t.Errorf("expected job %s after recovery, got %s", want, j.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	for name, q := range queues(t) {
+		t.Run(name, func(t *testing.T) {
+			q.Push(job("1"))
+			q.Push(job("2"))
+			j := claim(t, q)
+			due := time.Now().Add(time.Minute).UTC().Truncate(time.Second)
+			j.Attempts, j.LastError, j.NotBefore = 1, "Too Many Requests", due
+			if err := q.Retry(j); err != nil {
+				t.Fatalf("Retry: %v", err)
+			}
+			if st, _ := q.Stats(); st.Pending != 2 {
+				t.Errorf("expected the retried job to stay pending, got %+v", st)
+			}
+
+			if j := claim(t, q); j.ID != "2" {
+				t.Errorf("expected the retried job to move behind job 2, got %s", j.ID)
+			}
+			j = claim(t, q)
+			if j.ID != "1" || j.Attempts != 1 || j.LastError != "Too Many Requests" || !j.NotBefore.Equal(due) {
+				t.Errorf("unexpected retried job %+v", j)
+			}
+			if n, _ := q.Recover(); n != 2 {
+				t.Errorf("expected both claimed jobs to be recovered, got %d", n)
+			}
+		})
+	}
+}
+
+func TestQueueQueued(t *testing.T) {
+	for name, q := range queues(t) {
+		t.Run(name, func(t *testing.T) {
+			q.Push(job("1"))
+			q.Push(job("2"))
+			q.Push(job("3"))
+			claim(t, q)
+			jobs, err := q.Queued()
+			if err != nil {
+				t.Fatalf("Queued: %v", err)
+			}
+			if len(jobs) != 2 || jobs[0].ID != "2" || jobs[1].ID != "3" {
+				t.Errorf("expected the unclaimed jobs 2 and 3, got %+v", jobs)
+			}
+		})
+	}
+}
+
+func TestQueueBury(t *testing.T) {
+	for name, q := range queues(t) {
+		t.Run(name, func(t *testing.T) {
+			q.Push(job("1"))
+			q.Push(job("2"))
+			j := claim(t, q)
+			j.Attempts, j.LastError = 5, "Too Many Requests"
+			if err := q.Bury(j); err != nil {
+				t.Fatalf("Bury: %v", err)
+			}
+
+			dead, err := q.DeadLetters()
+			if err != nil {
+				t.Fatalf("DeadLetters: %v", err)
+			}
+			if len(dead) != 1 || dead[0].ID != "1" || dead[0].Attempts != 5 || dead[0].LastError != "Too Many Requests" {
+				t.Errorf("unexpected dead letters %+v", dead)
+			}
+			if st, _ := q.Stats(); st.Pending != 1 || st.Dead != 1 {
+				t.Errorf("unexpected stats %+v", st)
+			}
+			if n, _ := q.Recover(); n != 0 {
+				t.Errorf("a buried job must not be recovered, got %d", n)
+			}
+		})
+	}
+}
+
+func TestRedisQueueConsumersDoNotShareClaims(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	a := outbox.NewRedisQueue(client, outbox.DefaultRedisKey, "a")
+	b := outbox.NewRedisQueue(client, outbox.DefaultRedisKey, "b")
+
+	a.Push(job("1"))
+	a.Push(job("2"))
+	if j := claim(t, a); j.ID != "1" {
+		t.Fatalf("expected job 1, got %s", j.ID)
+	}
+	if j := claim(t, b); j.ID != "2" {
+		t.Fatalf("expected job 2, got %s", j.ID)
+	}
+	if n, _ := b.Recover(); n != 1 {
+		t.Errorf("expected b to recover only its own claim, got %d", n)
+	}
+}
@@ -0,0 +1,191 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisOpTimeout = 5 * time.Second
+
+	// DefaultRedisKey is the name of the Redis list holding queued jobs.
+	DefaultRedisKey = "zbxtg:outbox"
+)
+
+// RedisQueue is a Queue backed by Redis lists: "<key>" holds the queued jobs,
+// "<key>:claimed:<consumer>" the jobs claimed by one worker and "<key>:dead"
+// the dead letters. Claims are atomic, so several processes can share the
+// queue; each must use a distinct consumer name that is stable across
+// restarts so it recovers its own claimed jobs.
+type RedisQueue struct {
+	client  redis.UniversalClient
+	key     string
+	claimed string
+	dead    string
+}
+
+// NewRedisQueue creates a RedisQueue on the list key using client. On a Redis
+// Cluster a key without a hash tag is wrapped in one ("{key}"), so that the
+// lists share a slot and jobs can move between them atomically.
+func NewRedisQueue(client redis.UniversalClient, key, consumer string) *RedisQueue {
+	if _, ok := client.(*redis.ClusterClient); ok && !strings.Contains(key, "{") {
+		key = "{" + key + "}"
+	}
+	return &RedisQueue{
+		client:  client,
+		key:     key,
+		claimed: key + ":claimed:" + consumer,
+		dead:    key + ":dead",
+	}
+}
+
+// Push appends a job to the tail of the queue.
+func (r *RedisQueue) Push(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return r.client.RPush(ctx, r.key, data).Err()
+}
+
+// Claim atomically moves the oldest job to this consumer's claimed list.
+func (r *RedisQueue) Claim() (Job, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	data, err := r.client.LMove(ctx, r.key, r.claimed, "LEFT", "RIGHT").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		// Set the value aside so it does not come back on every Recover.
+		r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+			p.LRem(ctx, r.claimed, 1, data)
+			p.RPush(ctx, r.dead, data)
+			return nil
+		})
+		return Job{}, false, fmt.Errorf("decoding job %q: %w", data, err)
+	}
+	job.receipt = data
+	return job, true, nil
+}
+
+// Done removes a claimed job from the claimed list.
+func (r *RedisQueue) Done(job Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return r.client.LRem(ctx, r.claimed, 1, job.receipt).Err()
+}
+
+// Retry moves a claimed job from the claimed list to the tail of the queue.
+func (r *RedisQueue) Retry(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.LRem(ctx, r.claimed, 1, job.receipt)
+		p.RPush(ctx, r.key, data)
+		return nil
+	})
+	return err
+}
+
+// Bury moves a claimed job to the dead-letter list.
+func (r *RedisQueue) Bury(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	_, err = r.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.LRem(ctx, r.claimed, 1, job.receipt)
+		p.RPush(ctx, r.dead, data)
+		return nil
+	})
+	return err
+}
+
+// Recover moves this consumer's claimed jobs back to the head of the queue,
+// newest first so their order is preserved.
+func (r *RedisQueue) Recover() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	n := 0
+	for {
+		err := r.client.LMove(ctx, r.claimed, r.key, "RIGHT", "LEFT").Err()
+		if errors.Is(err, redis.Nil) {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Queued returns the queued jobs, in queue order.
+func (r *RedisQueue) Queued() ([]Job, error) {
+	return r.jobs(r.key)
+}
+
+// DeadLetters returns the dead-letter list, oldest first.
+func (r *RedisQueue) DeadLetters() ([]Job, error) {
+	return r.jobs(r.dead)
+}
+
+// jobs returns the jobs in the list key, skipping those that do not decode.
+func (r *RedisQueue) jobs(key string) ([]Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	values, err := r.client.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, 0, len(values))
+	for _, v := range values {
+		var job Job
+		if err := json.Unmarshal([]byte(v), &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// Stats returns the number of pending jobs, including those claimed by this
+// consumer, and dead jobs.
+func (r *RedisQueue) Stats() (Stats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	var queued, claimed, dead *redis.IntCmd
+	_, err := r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		queued = p.LLen(ctx, r.key)
+		claimed = p.LLen(ctx, r.claimed)
+		dead = p.LLen(ctx, r.dead)
+		return nil
+	})
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{Pending: int(queued.Val() + claimed.Val()), Dead: int(dead.Val())}, nil
+}
+
+// String describes the backend for status output.
+func (r *RedisQueue) String() string {
+	return "redis list " + r.key
+}
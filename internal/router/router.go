@@ -0,0 +1,179 @@
+// Package router selects the Telegram chats an alert is delivered to, based on
+// the routing table from the configuration.
+package router
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+)
+
+// Destination identifies a Telegram chat, and optionally a forum topic within
+// it, a message is delivered to. A zero ThreadID means the chat's General
+// topic.
+type Destination struct {
+	ChatID   int64
+	ThreadID int
+}
+
+// Router matches alerts against an ordered list of routes.
+type Router struct {
+	routes   []route
+	fallback Destination
+}
+
+type route struct {
+	severities map[string]bool
+	host       string
+	hostRe     *regexp.Regexp
+	triggerRe  *regexp.Regexp
+	dests      []Destination
+	cont       bool
+}
+
+// New compiles the given routes. fallback is used for alerts that match no
+// route. An error is returned if a host glob or regular expression is invalid.
+func New(routes []config.Route, fallback Destination) (*Router, error) {
+	r := &Router{fallback: fallback}
+	for i, cr := range routes {
+		label := cr.Name
+		if label == "" {
+			label = fmt.Sprintf("routes[%d]", i)
+		}
+
+		rt := route{host: cr.Host, cont: cr.Continue}
+		if len(cr.Severities) > 0 {
+			rt.severities = make(map[string]bool, len(cr.Severities))
+			for _, sev := range cr.Severities {
+				rt.severities[strings.ToUpper(sev)] = true
+			}
+		}
+		if cr.Host != "" {
+			if _, err := path.Match(cr.Host, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid host glob %q: %w", label, cr.Host, err)
+			}
+		}
+		if cr.HostRegex != "" {
+			re, err := regexp.Compile(cr.HostRegex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid host_regex: %w", label, err)
+			}
+			rt.hostRe = re
+		}
+		if cr.Trigger != "" {
+			re, err := regexp.Compile(cr.Trigger)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid trigger regex: %w", label, err)
+			}
+			rt.triggerRe = re
+		}
+		for _, d := range cr.Destinations {
+			rt.dests = append(rt.dests, Destination{ChatID: d.ChatID, ThreadID: d.ThreadID})
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return r, nil
+}
+
+// Default returns the destination used for alerts that match no route.
+func (r *Router) Default() Destination {
+	return r.fallback
+}
+
+// Match returns the destinations for an alert with the given severity, host
+// and trigger name. Routes are evaluated in order; the first matching route
+// wins unless it has Continue set. Duplicate destinations are removed. When
+// no route matches, the default destination is returned.
+func (r *Router) Match(severity, host, trigger string) []Destination {
+	var dests []Destination
+	seen := make(map[Destination]bool)
+	for _, rt := range r.routes {
+		if !rt.matches(severity, host, trigger) {
+			continue
+		}
+		for _, d := range rt.dests {
+			if !seen[d] {
+				seen[d] = true
+				dests = append(dests, d)
+			}
+		}
+		if !rt.cont {
+			break
+		}
+	}
+	if len(dests) == 0 {
+		return []Destination{r.fallback}
+	}
+	return dests
+}
+
+// RouteOf returns the position, counting from 1, of the route that delivers
+// an alert with the given severity, host and trigger name to d, following
+// the same evaluation as Match. Zero means d is not reached through a route,
+// e.g. it is the default destination.
+func (r *Router) RouteOf(severity, host, trigger string, d Destination) int {
+	for i, rt := range r.routes {
+		if !rt.matches(severity, host, trigger) {
+			continue
+		}
+		for _, rd := range rt.dests {
+			if rd == d {
+				return i + 1
+			}
+		}
+		if !rt.cont {
+			break
+		}
+	}
+	return 0
+}
+
+// RouteTo returns the position, counting from 1, of the first route that
+// delivers to d, whatever the alert. Zero means no route does.
+func (r *Router) RouteTo(d Destination) int {
+	for i, rt := range r.routes {
+		for _, rd := range rt.dests {
+			if rd == d {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func (rt *route) matches(severity, host, trigger string) bool {
+	if rt.severities != nil && !rt.severities[strings.ToUpper(severity)] {
+		return false
+	}
+	if rt.host != "" {
+		if ok, _ := path.Match(rt.host, host); !ok {
+			return false
+		}
+	}
+	if rt.hostRe != nil && !rt.hostRe.MatchString(host) {
+		return false
+	}
+	if rt.triggerRe != nil && !rt.triggerRe.MatchString(trigger) {
+		return false
+	}
+	return true
+}
+
+// Chats returns the IDs of every chat the router can deliver to: the default
+// chat and the chats of all route destinations.
+func (r *Router) Chats() []int64 {
+	chats := []int64{r.fallback.ChatID}
+	seen := map[int64]bool{r.fallback.ChatID: true}
+	for _, rt := range r.routes {
+		for _, d := range rt.dests {
+			if !seen[d.ChatID] {
+				seen[d.ChatID] = true
+				chats = append(chats, d.ChatID)
+			}
+		}
+	}
+	return chats
+}
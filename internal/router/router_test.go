@@ -0,0 +1,159 @@
+package router_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
+)
+
+func dests(ids ...int64) []router.Destination {
+	var d []router.Destination
+	for _, id := range ids {
+		d = append(d, router.Destination{ChatID: id})
+	}
+	return d
+}
+
+func TestMatchFallsBackToDefault(t *testing.T) {
+	r, err := router.New(nil, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := r.Match("High", "web-01", "CPU"); !reflect.DeepEqual(got, dests(42)) {
+		t.Fatalf("expected default destination, got %v", got)
+	}
+}
+
+func TestMatchCriteria(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Severities: []string{"Disaster", "HIGH"}, Destinations: []config.Destination{{ChatID: 1}}, Continue: true},
+		{Host: "db-*", Destinations: []config.Destination{{ChatID: 2}}, Continue: true},
+		{HostRegex: `^web-\d+$`, Destinations: []config.Destination{{ChatID: 3}}, Continue: true},
+		{Trigger: `(?i)disk`, Destinations: []config.Destination{{ChatID: 4}}},
+	}, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		severity, host, trigger string
+		want                    []router.Destination
+	}{
+		{"high", "app-01", "CPU", dests(1)},
+		{"Warning", "db-01", "CPU", dests(2)},
+		{"Warning", "web-12", "CPU", dests(3)},
+		{"Warning", "web-x", "Disk full", dests(4)},
+		{"Disaster", "db-01", "Disk full", dests(1, 2, 4)},
+		{"Warning", "app-01", "CPU", dests(42)},
+	}
+	for _, tt := range tests {
+		got := r.Match(tt.severity, tt.host, tt.trigger)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Match(%q, %q, %q) = %v, want %v", tt.severity, tt.host, tt.trigger, got, tt.want)
+		}
+	}
+}
+
+func TestMatchFirstRouteWins(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Host: "db-*", Destinations: []config.Destination{{ChatID: 1}}},
+		{Host: "db-*", Destinations: []config.Destination{{ChatID: 2}}},
+	}, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := r.Match("", "db-01", ""); !reflect.DeepEqual(got, dests(1)) {
+		t.Fatalf("expected only the first route to match, got %v", got)
+	}
+}
+
+func TestMatchDeduplicatesDestinations(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Host: "db-*", Destinations: []config.Destination{{ChatID: 1}, {ChatID: 2}}, Continue: true},
+		{Severities: []string{"High"}, Destinations: []config.Destination{{ChatID: 2}}},
+	}, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := r.Match("High", "db-01", ""); !reflect.DeepEqual(got, dests(1, 2)) {
+		t.Fatalf("expected de-duplicated destinations, got %v", got)
+	}
+}
+
+func TestNewInvalidPatterns(t *testing.T) {
+	for _, rt := range []config.Route{
+		{Host: "db-[", Destinations: []config.Destination{{ChatID: 1}}},
+		{HostRegex: "(", Destinations: []config.Destination{{ChatID: 1}}},
+		{Trigger: "[", Destinations: []config.Destination{{ChatID: 1}}},
+	} {
+		if _, err := router.New([]config.Route{rt}, router.Destination{ChatID: 42}); err == nil {
+			t.Errorf("expected error for route %+v", rt)
+		}
+	}
+}
+
+func TestMatchKeepsForumTopic(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Host: "prod-*", Destinations: []config.Destination{{ChatID: 1, ThreadID: 5}, {ChatID: 1, ThreadID: 6}}},
+	}, router.Destination{ChatID: 42, ThreadID: 9})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []router.Destination{{ChatID: 1, ThreadID: 5}, {ChatID: 1, ThreadID: 6}}
+	if got := r.Match("", "prod-db", ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	want = []router.Destination{{ChatID: 42, ThreadID: 9}}
+	if got := r.Match("", "test-db", ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected default topic %v, got %v", want, got)
+	}
+}
+
+func TestChats(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Host: "a", Destinations: []config.Destination{{ChatID: 1}, {ChatID: 42, ThreadID: 3}}},
+		{Host: "b", Destinations: []config.Destination{{ChatID: 1, ThreadID: 5}, {ChatID: 2}}},
+	}, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := r.Chats(); !reflect.DeepEqual(got, []int64{42, 1, 2}) {
+		t.Fatalf("expected chats [42 1 2], got %v", got)
+	}
+}
+
+func TestRouteOf(t *testing.T) {
+	r, err := router.New([]config.Route{
+		{Host: "db-*", Continue: true, Destinations: []config.Destination{{ChatID: 1}}},
+		{Severities: []string{"High"}, Destinations: []config.Destination{{ChatID: 1}, {ChatID: 2}}},
+		{Destinations: []config.Destination{{ChatID: 3}}},
+	}, router.Destination{ChatID: 42})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		severity, host string
+		dest           int64
+		want           int
+	}{
+		{"High", "db-01", 1, 1},
+		{"High", "db-01", 2, 2},
+		{"High", "web-01", 1, 2},
+		{"High", "web-01", 3, 0}, // the second route stops evaluation
+		{"Warning", "web-01", 3, 3},
+		{"Warning", "web-01", 42, 0},
+	}
+	for _, c := range cases {
+		if got := r.RouteOf(c.severity, c.host, "", router.Destination{ChatID: c.dest}); got != c.want {
+			t.Errorf("RouteOf(%s, %s, chat %d) = %d, want %d", c.severity, c.host, c.dest, got, c.want)
+		}
+	}
+
+	for dest, want := range map[int64]int{1: 1, 2: 2, 3: 3, 42: 0} {
+		if got := r.RouteTo(router.Destination{ChatID: dest}); got != want {
+			t.Errorf("RouteTo(chat %d) = %d, want %d", dest, got, want)
+		}
+	}
+}
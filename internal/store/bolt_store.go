@@ -0,0 +1,206 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout bounds the wait for the file lock held by another process
+// that has the same database open.
+const boltOpenTimeout = 5 * time.Second
+
+var boltEventsBucket = []byte("events")
+
+// BoltStore is a Store implementation backed by an embedded bbolt database
+// file. Every write is a transaction that is fsynced before it returns, so
+// entries survive restarts and crashes without an external server.
+type BoltStore struct {
+	db   *bolt.DB
+	path string
+}
+
+// NewBoltStore opens (or creates) the database file at path.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltEventsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initialising %s: %w", path, err)
+	}
+	return &BoltStore{db: db, path: path}, nil
+}
+
+// DB returns the underlying database so other components, such as the
+// outbox, can keep their buckets in the same file.
+func (b *BoltStore) DB() *bolt.DB {
+	return b.db
+}
+
+// Close releases the database file.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// Set serialises entry as JSON and stores it under the given event ID.
+func (b *BoltStore) Set(_ context.Context, eventID string, entry Entry) error {
+	_, err := b.put(eventID, entry, func([]byte) bool { return true })
+	return err
+}
+
+// SetIfAbsent stores entry for the given event ID only if it has no entry.
+// The check and the write share one transaction.
+func (b *BoltStore) SetIfAbsent(_ context.Context, eventID string, entry Entry) (bool, error) {
+	return b.put(eventID, entry, func(stored []byte) bool { return stored == nil })
+}
+
+// CompareAndSet stores entry only if the stored entry has entry.Version.
+// The check and the write share one transaction.
+func (b *BoltStore) CompareAndSet(_ context.Context, eventID string, entry Entry) (bool, error) {
+	return b.put(eventID, entry, func(stored []byte) bool {
+		var current struct{ Version int64 }
+		return stored != nil && json.Unmarshal(stored, &current) == nil && current.Version == entry.Version
+	})
+}
+
+// put stores entry, with its Version incremented, when ok accepts the value
+// stored for the event (nil when missing), and reports whether it did.
+func (b *BoltStore) put(eventID string, entry Entry, ok func(stored []byte) bool) (bool, error) {
+	entry.Version++
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, fmt.Errorf("bolt store: marshal entry for event %s: %w", eventID, err)
+	}
+	stored := false
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEventsBucket)
+		if !ok(bucket.Get([]byte(eventID))) {
+			return nil
+		}
+		stored = true
+		return bucket.Put([]byte(eventID), data)
+	})
+	if err != nil {
+		return false, fmt.Errorf("bolt store: put event %s: %w", eventID, err)
+	}
+	return stored, nil
+}
+
+// Get retrieves and deserialises the Entry for the given event ID, or
+// returns ErrNotFound.
+func (b *BoltStore) Get(_ context.Context, eventID string) (Entry, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid inside the transaction, so copy it.
+		if v := tx.Bucket(boltEventsBucket).Get([]byte(eventID)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return Entry{}, fmt.Errorf("bolt store: get event %s: %w", eventID, err)
+	}
+	return decodeEntry(eventID, data)
+}
+
+// GetAndDelete removes the entry for the given event ID and returns it, in
+// one transaction.
+func (b *BoltStore) GetAndDelete(_ context.Context, eventID string) (Entry, error) {
+	var data []byte
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEventsBucket)
+		v := bucket.Get([]byte(eventID))
+		if v == nil {
+			return nil
+		}
+		data = append([]byte(nil), v...)
+		return bucket.Delete([]byte(eventID))
+	})
+	if err != nil {
+		return Entry{}, fmt.Errorf("bolt store: delete event %s: %w", eventID, err)
+	}
+	return decodeEntry(eventID, data)
+}
+
+// decodeEntry deserialises the entry stored for an event, nil when missing.
+func decodeEntry(eventID string, data []byte) (Entry, error) {
+	if data == nil {
+		return Entry{}, ErrNotFound
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return Entry{}, fmt.Errorf("bolt store: unmarshal entry for event %s: %w", eventID, err)
+	}
+	return entry, nil
+}
+
+// Delete removes the entry for the given event ID.
+func (b *BoltStore) Delete(_ context.Context, eventID string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltEventsBucket).Delete([]byte(eventID))
+	})
+	if err != nil {
+		return fmt.Errorf("bolt store: delete event %s: %w", eventID, err)
+	}
+	return nil
+}
+
+// List returns one page of matching entries in key (byte) order. The cursor
+// is the last event ID of the page, so entries added or removed between calls
+// do not shift the following pages.
+func (b *BoltStore) List(_ context.Context, opts ListOptions) ([]Record, string, error) {
+	limit := opts.limit()
+	var records []Record
+	next := ""
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltEventsBucket).Cursor()
+		k, v := c.First()
+		if opts.Cursor != "" {
+			k, v = c.Seek([]byte(opts.Cursor))
+			if k != nil && bytes.Equal(k, []byte(opts.Cursor)) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil; k, v = c.Next() {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				log.Printf("ERROR bolt store: unmarshal entry for event %s: %v", k, err)
+				continue
+			}
+			if !opts.Match(entry) {
+				continue
+			}
+			if len(records) == limit {
+				next = records[limit-1].EventID
+				return nil
+			}
+			records = append(records, Record{EventID: string(k), Entry: entry})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("bolt store: list: %w", err)
+	}
+	return records, next, nil
+}
+
+// Scan calls fn for every matching entry in key order until fn returns false.
+func (b *BoltStore) Scan(ctx context.Context, f Filter, fn func(Record) bool) error {
+	return scanPages(ctx, b, f, fn)
+}
+
+// String describes the backend for status output.
+func (b *BoltStore) String() string {
+	return "bbolt " + b.path
+}
@@ -0,0 +1,190 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+// openBolt opens a BoltStore in a temporary directory. The store is closed
+// automatically when the test ends.
+func openBolt(t *testing.T) (*store.BoltStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := store.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("opening bolt store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, path
+}
+
+func TestBoltSetAndGet(t *testing.T) {
+	s, _ := openBolt(t)
+
+	s.Set(t.Context(), "trigger-1", store.Entry{
+		Messages:  []store.Message{{ChatID: -100, ThreadID: 3, MessageID: 42}},
+		StartTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		Message:   "details",
+		Severity:  "HIGH",
+	})
+	e, err := s.Get(t.Context(), "trigger-1")
+	if err != nil {
+		t.Fatal("expected entry to exist after Set")
+	}
+	if len(e.Messages) != 1 || e.Messages[0] != (store.Message{ChatID: -100, ThreadID: 3, MessageID: 42}) {
+		t.Fatalf("expected message to be preserved, got %+v", e.Messages)
+	}
+	if !e.StartTime.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected StartTime to be preserved, got %s", e.StartTime)
+	}
+	if e.Message != "details" {
+		t.Fatalf("expected Message to be preserved, got %q", e.Message)
+	}
+	if e.Severity != "HIGH" {
+		t.Fatalf("expected Severity 'HIGH', got %q", e.Severity)
+	}
+}
+
+func TestBoltGetMissing(t *testing.T) {
+	s, _ := openBolt(t)
+
+	_, err := s.Get(t.Context(), "nonexistent")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatal("expected ErrNotFound for a missing key")
+	}
+}
+
+func TestBoltDelete(t *testing.T) {
+	s, _ := openBolt(t)
+
+	s.Set(t.Context(), "trigger-1", store.Entry{Severity: "High"})
+	s.Delete(t.Context(), "trigger-1")
+
+	_, err := s.Get(t.Context(), "trigger-1")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatal("expected entry to be absent after Delete")
+	}
+}
+
+func TestBoltDeleteMissing(t *testing.T) {
+	s, _ := openBolt(t)
+	if err := s.Delete(t.Context(), "does-not-exist"); err != nil {
+		t.Fatalf("expected deleting a missing entry to succeed, got %v", err)
+	}
+}
+
+func TestBoltPersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.db")
+	s, err := store.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("opening bolt store: %v", err)
+	}
+	s.Set(t.Context(), "evt-1", store.Entry{Severity: "Disaster"})
+	if err := s.Close(); err != nil {
+		t.Fatalf("closing bolt store: %v", err)
+	}
+
+	s, err = store.NewBoltStore(path)
+	if err != nil {
+		t.Fatalf("reopening bolt store: %v", err)
+	}
+	defer s.Close()
+	e, err := s.Get(t.Context(), "evt-1")
+	if err != nil || e.Severity != "Disaster" {
+		t.Fatalf("expected entry to survive a reopen, got %+v (%v)", e, err)
+	}
+}
+
+func TestBoltListAndScan(t *testing.T) {
+	s, _ := openBolt(t)
+	for i := 0; i < 25; i++ {
+		s.Set(t.Context(), fmt.Sprintf("%03d", i), store.Entry{Severity: "High", Host: fmt.Sprintf("db-%02d", i)})
+	}
+	s.Set(t.Context(), "web", store.Entry{Severity: "High", Host: "web-01"})
+
+	var got []string
+	opts := store.ListOptions{Filter: store.Filter{Host: "db-*"}, Limit: 10}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		records, next, err := s.List(t.Context(), opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(records) > 10 {
+			t.Fatalf("expected at most 10 records per page, got %d", len(records))
+		}
+		for _, r := range records {
+			got = append(got, r.EventID)
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+	if len(got) != 25 || got[0] != "000" || got[24] != "024" {
+		t.Fatalf("expected the 25 db entries in order, got %v", got)
+	}
+
+	n := 0
+	s.Scan(t.Context(), store.Filter{Severity: "high"}, func(r store.Record) bool {
+		n++
+		return true
+	})
+	if n != 26 {
+		t.Fatalf("expected Scan to visit 26 entries, got %d", n)
+	}
+}
+
+func TestBoltLegacyStartTime(t *testing.T) {
+	s, _ := openBolt(t)
+
+	// An entry as written by releases that stored StartTime as a string.
+	err := s.DB().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("events")).Put([]byte("100"), []byte(`{"MessageID":42,"StartTime":"2024-01-01 10:30:00 UTC"}`))
+	})
+	if err != nil {
+		t.Fatalf("writing legacy entry: %v", err)
+	}
+	e, err := s.Get(t.Context(), "100")
+	if err != nil || !e.StartTime.Equal(time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)) {
+		t.Fatalf("expected the legacy StartTime to be converted, got %+v (%v)", e, err)
+	}
+}
+
+func TestBoltConcurrentAccess(t *testing.T) {
+	s, _ := openBolt(t)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			key := "trigger"
+			s.Set(t.Context(), key, store.Entry{Messages: []store.Message{{MessageID: n}}})
+			s.Get(t.Context(), key)
+			s.Delete(t.Context(), key)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBoltAtomicOps(t *testing.T) {
+	s, _ := openBolt(t)
+	testAtomicOps(t, s)
+}
+
+// TestBoltStoreImplementsStore verifies at compile time that *BoltStore
+// satisfies the Store interface.
+func TestBoltStoreImplementsStore(t *testing.T) {
+	var _ store.Store = (*store.BoltStore)(nil)
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultPageSize is the page size List uses when ListOptions.Limit is zero.
+const DefaultPageSize = 100
+
+// Record is an Entry together with the event ID it is stored under.
+type Record struct {
+	EventID string
+	Entry   Entry
+}
+
+// Filter restricts the entries returned by List and Scan. Empty fields match
+// every entry.
+type Filter struct {
+	// Severity matches the entry severity, case-insensitively.
+	Severity string
+	// Host is a shell-style glob (e.g. "db-*") matched against the host name.
+	Host string
+	// Digest matches the entries aggregated into the given storm digest.
+	Digest string
+}
+
+// Match reports whether e satisfies the filter. An invalid Host glob matches
+// nothing.
+func (f Filter) Match(e Entry) bool {
+	if f.Severity != "" && !strings.EqualFold(f.Severity, e.Severity) {
+		return false
+	}
+	if f.Host != "" {
+		if ok, _ := path.Match(f.Host, e.Host); !ok {
+			return false
+		}
+	}
+	if f.Digest != "" && f.Digest != e.Digest {
+		return false
+	}
+	return true
+}
+
+// ListOptions selects one page of List results.
+type ListOptions struct {
+	Filter
+	// Cursor is the value returned by the previous List call, or empty to
+	// start from the beginning.
+	Cursor string
+	// Limit is the maximum number of records per page (DefaultPageSize when
+	// zero). Backends that page by key ranges, such as Redis, treat it as a
+	// hint and may return slightly more.
+	Limit int
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultPageSize
+	}
+	return o.Limit
+}
+
+// scanPages implements Store.Scan on top of List.
+func scanPages(ctx context.Context, s Store, f Filter, fn func(Record) bool) error {
+	opts := ListOptions{Filter: f}
+	for {
+		records, next, err := s.List(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if !fn(r) {
+				return nil
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// SortEventIDs sorts Zabbix event IDs, which are increasing integers, in
+// numeric order without parsing them.
+func SortEventIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		return lessEventID(ids[i], ids[j])
+	})
+}
+
+func lessEventID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"sync"
+)
+
+// Locker is implemented by stores that can serialize the handling of one
+// event across processes sharing the backend, such as RedisStore.
+type Locker interface {
+	// Lock blocks until it holds the lock of eventID or ctx is done. The
+	// returned function releases the lock.
+	Lock(ctx context.Context, eventID string) (unlock func(), err error)
+}
+
+// KeyedMutex is an in-process Locker: one mutex per event ID, created on
+// first use and dropped once nobody holds or waits for it.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	held chan struct{}
+	refs int
+}
+
+// NewKeyedMutex creates and returns an empty KeyedMutex.
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock blocks until it holds the lock of eventID or ctx is done.
+func (k *KeyedMutex) Lock(ctx context.Context, eventID string) (func(), error) {
+	k.mu.Lock()
+	l, ok := k.locks[eventID]
+	if !ok {
+		l = &keyedLock{held: make(chan struct{}, 1)}
+		k.locks[eventID] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	select {
+	case l.held <- struct{}{}:
+	case <-ctx.Done():
+		k.release(eventID, l)
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			<-l.held
+			k.release(eventID, l)
+		})
+	}, nil
+}
+
+func (k *KeyedMutex) release(eventID string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(k.locks, eventID)
+	}
+}
+
+// Len returns the number of event IDs currently locked or waited for.
+func (k *KeyedMutex) Len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.locks)
+}
@@ -0,0 +1,77 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestKeyedMutexSerializesOneKey(t *testing.T) {
+	k := store.NewKeyedMutex()
+
+	var mu sync.Mutex
+	inside, most := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := k.Lock(context.Background(), "1")
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			mu.Lock()
+			inside++
+			most = max(most, inside)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inside--
+			mu.Unlock()
+			unlock()
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Fatalf("expected one holder at a time, got %d", most)
+	}
+	if n := k.Len(); n != 0 {
+		t.Fatalf("expected the lock to be dropped once released, %d left", n)
+	}
+}
+
+func TestKeyedMutexOtherKeysAndTimeout(t *testing.T) {
+	k := store.NewKeyedMutex()
+	unlock, err := k.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	other, err := k.Lock(context.Background(), "2")
+	if err != nil {
+		t.Fatalf("expected another key not to wait, got %v", err)
+	}
+	other()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := k.Lock(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	unlock()
+	unlock() // a second call is a no-op
+	again, err := k.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("expected the released lock to be free, got %v", err)
+	}
+	again()
+	if n := k.Len(); n != 0 {
+		t.Fatalf("expected no lock left, got %d", n)
+	}
+}
@@ -0,0 +1,150 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisConfig describes the Redis deployment a RedisStore connects to: a
+// single server, a master monitored by Sentinels, or a Redis Cluster.
+type RedisConfig struct {
+	// Addrs are the host:port of the server, of the Sentinels with
+	// MasterName, or of seed nodes of the cluster with Cluster. A single
+	// server may be given as a redis:// or rediss:// URL instead; the user,
+	// password and database it sets take precedence over those below.
+	Addrs []string
+
+	// MasterName is the name of the master monitored by the Sentinels.
+	MasterName string
+
+	// Cluster connects to a Redis Cluster, which only has database 0.
+	Cluster bool
+
+	// Username and Password authenticate as an ACL user, or as the default
+	// user when Username is empty.
+	Username string
+	Password string
+
+	// SentinelUsername and SentinelPassword authenticate with the Sentinels,
+	// which keep users of their own. Left empty, no credentials are sent to
+	// them.
+	SentinelUsername string
+	SentinelPassword string
+
+	// DB is the logical database index.
+	DB int
+
+	// TLS connects over TLS, verifying the servers against the system roots
+	// or, when set, the PEM certificates in CAFile. CertFile and KeyFile
+	// hold an optional client certificate and its key. Setting any of the
+	// files, or a rediss:// URL, implies TLS.
+	TLS      bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// NewRedisStoreFrom creates a RedisStore connected to the deployment
+// described by c. Like NewRedisStore it does not contact the servers; use
+// Ping for that.
+func NewRedisStoreFrom(c RedisConfig, opts ...RedisOption) (*RedisStore, error) {
+	client, desc, err := c.client()
+	if err != nil {
+		return nil, fmt.Errorf("redis store: %w", err)
+	}
+	return newRedisStore(client, desc, opts), nil
+}
+
+// client returns the client for c and the description of the deployment
+// used by String.
+func (c RedisConfig) client() (redis.UniversalClient, string, error) {
+	if len(c.Addrs) == 0 {
+		return nil, "", errors.New("no address configured")
+	}
+	o := &redis.UniversalOptions{
+		Addrs:            c.Addrs,
+		MasterName:       c.MasterName,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
+	}
+	if strings.Contains(c.Addrs[0], "://") {
+		if len(c.Addrs) > 1 || c.Cluster || c.MasterName != "" {
+			return nil, "", errors.New("a URL can only address a single server")
+		}
+		u, err := redis.ParseURL(c.Addrs[0])
+		if err != nil {
+			return nil, "", err
+		}
+		o.Addrs = []string{u.Addr}
+		if u.Username != "" {
+			o.Username = u.Username
+		}
+		if u.Password != "" {
+			o.Password = u.Password
+		}
+		if u.DB != 0 {
+			o.DB = u.DB
+		}
+		o.TLSConfig = u.TLSConfig
+	}
+	if c.TLS || c.CAFile != "" || c.CertFile != "" || c.KeyFile != "" || o.TLSConfig != nil {
+		tc, err := c.tlsConfig(o.TLSConfig)
+		if err != nil {
+			return nil, "", err
+		}
+		o.TLSConfig = tc
+	}
+
+	switch {
+	case c.Cluster && c.MasterName != "":
+		return nil, "", errors.New("cluster and sentinel modes are exclusive")
+	case c.Cluster:
+		if o.DB != 0 {
+			return nil, "", fmt.Errorf("a cluster has no database %d", o.DB)
+		}
+		return redis.NewClusterClient(o.Cluster()), "redis cluster " + strings.Join(o.Addrs, ","), nil
+	case c.MasterName != "":
+		return redis.NewFailoverClient(o.Failover()), fmt.Sprintf("redis sentinel master %s (db %d)", c.MasterName, o.DB), nil
+	case len(o.Addrs) > 1:
+		return nil, "", errors.New("several addresses need cluster or sentinel mode")
+	}
+	return redis.NewClient(o.Simple()), fmt.Sprintf("redis %s (db %d)", o.Addrs[0], o.DB), nil
+}
+
+// tlsConfig returns the TLS configuration of c, based on that of a rediss://
+// URL when not nil. The server name is left to be taken from the address
+// dialled, which differs between the nodes of a cluster.
+func (c RedisConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		tc = base.Clone()
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in TLS CA file %s", c.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
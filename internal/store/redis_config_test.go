@@ -0,0 +1,185 @@
+package store_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+)
+
+func TestRedisCluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s, err := store.NewRedisStoreFrom(store.RedisConfig{Addrs: []string{mr.Addr()}, Cluster: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := s.String(); got != "redis cluster "+mr.Addr() {
+		t.Errorf("unexpected description %q", got)
+	}
+
+	for i := 0; i < 25; i++ {
+		if err := s.Set(t.Context(), fmt.Sprint(i), store.Entry{Host: "db-01"}); err != nil {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	seen := make(map[string]bool)
+	err = s.Scan(t.Context(), store.Filter{}, func(r store.Record) bool {
+		seen[r.EventID] = true
+		return true
+	})
+	if err != nil || len(seen) != 25 {
+		t.Fatalf("expected Scan to visit the 25 entries, got %d (%v)", len(seen), err)
+	}
+
+	if ok, err := s.CompareAndSet(t.Context(), "1", store.Entry{Version: 1, Host: "db-02"}); !ok || err != nil {
+		t.Fatalf("expected the compare-and-set to succeed, got %v %v", ok, err)
+	}
+	if e, err := s.GetAndDelete(t.Context(), "1"); err != nil || e.Host != "db-02" {
+		t.Fatalf("expected the updated entry, got %+v %v", e, err)
+	}
+	unlock, err := s.Lock(t.Context(), "2")
+	if err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	unlock()
+}
+
+func TestRedisTLSWithACLUser(t *testing.T) {
+	dir := t.TempDir()
+	serverTLS, caFile := testCertificate(t, dir)
+	mr, err := miniredis.RunTLS(serverTLS)
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	mr.RequireUserAuth("bot", "secret")
+
+	url := "rediss://bot:secret@" + mr.Addr() + "/0"
+	s, err := store.NewRedisStoreFrom(store.RedisConfig{Addrs: []string{url}, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Contains(s.String(), "secret") {
+		t.Errorf("expected the password to be left out of %q", s.String())
+	}
+	if err := s.Ping(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if err := s.Set(t.Context(), "1", store.Entry{MessageID: 7}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// The same without a URL.
+	s, err = store.NewRedisStoreFrom(store.RedisConfig{Addrs: []string{mr.Addr()}, Username: "bot", Password: "secret", TLS: true, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if e, err := s.Get(t.Context(), "1"); err != nil || e.MessageID != 7 {
+		t.Fatalf("expected the entry, got %+v %v", e, err)
+	}
+
+	// Servers are verified against the system roots by default.
+	s, _ = store.NewRedisStoreFrom(store.RedisConfig{Addrs: []string{url}})
+	if err := s.Ping(); err == nil {
+		t.Fatal("expected an untrusted server certificate to be rejected")
+	}
+}
+
+func TestRedisSentinelCredentials(t *testing.T) {
+	// miniredis has no SENTINEL command, but rejects wrong credentials
+	// before answering that, which shows what reaches the Sentinel.
+	sentinel := miniredis.RunT(t)
+	sentinel.RequireUserAuth("watcher", "sentinel-pw")
+	wrongPass := func(c store.RedisConfig) bool {
+		t.Helper()
+		s, err := store.NewRedisStoreFrom(c)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = s.Ping()
+		return err != nil && strings.Contains(err.Error(), "WRONGPASS")
+	}
+
+	c := store.RedisConfig{Addrs: []string{sentinel.Addr()}, MasterName: "main", Username: "bot", Password: "secret"}
+	if wrongPass(c) {
+		t.Error("expected the data node's credentials to be kept from the Sentinel")
+	}
+	c.SentinelUsername, c.SentinelPassword = "watcher", "wrong"
+	if !wrongPass(c) {
+		t.Error("expected the Sentinel credentials to be sent")
+	}
+	c.SentinelPassword = "sentinel-pw"
+	if wrongPass(c) {
+		t.Error("expected the Sentinel to accept its own credentials")
+	}
+}
+
+func TestRedisConfigInvalid(t *testing.T) {
+	for name, c := range map[string]store.RedisConfig{
+		"no address":          {},
+		"several servers":     {Addrs: []string{"a:6379", "b:6379"}},
+		"URL and cluster":     {Addrs: []string{"redis://a:6379"}, Cluster: true},
+		"invalid URL":         {Addrs: []string{"http://a:6379"}},
+		"cluster database":    {Addrs: []string{"a:6379"}, Cluster: true, DB: 1},
+		"cluster sentinel":    {Addrs: []string{"a:26379"}, Cluster: true, MasterName: "main"},
+		"missing CA file":     {Addrs: []string{"a:6379"}, CAFile: "/nonexistent/ca.pem"},
+		"missing certificate": {Addrs: []string{"a:6379"}, CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"},
+	} {
+		if _, err := store.NewRedisStoreFrom(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	s, err := store.NewRedisStoreFrom(store.RedisConfig{Addrs: []string{"a:26379", "b:26379"}, MasterName: "main", DB: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := s.String(); got != "redis sentinel master main (db 2)" {
+		t.Errorf("unexpected description %q", got)
+	}
+}
+
+// testCertificate returns the TLS configuration of a server for 127.0.0.1,
+// with a self-signed certificate, and the path of that certificate in dir.
+func testCertificate(t *testing.T, dir string) (*tls.Config, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "miniredis"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("writing certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, caFile
+}
@@ -2,35 +2,176 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	mathrand "math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-const redisOpTimeout = 5 * time.Second
+const (
+	redisOpTimeout = 5 * time.Second
 
-// RedisStore is a Store implementation backed by a Redis-compatible server.
-// Entries are serialised as JSON and stored with no expiry by default.
+	// DefaultRedisKeyPrefix namespaces the keys written by RedisStore.
+	DefaultRedisKeyPrefix = "zbxtg:event:"
+
+	// redisLockTTL bounds how long the lock of an event outlives a replica
+	// that died holding it. A live holder keeps extending it.
+	redisLockTTL = time.Minute
+
+	// redisLockPoll and redisLockMaxPoll bound how often a waiting Lock
+	// retries: the first retry comes after redisLockPoll, later ones back
+	// off up to redisLockMaxPoll.
+	redisLockPoll    = 20 * time.Millisecond
+	redisLockMaxPoll = 500 * time.Millisecond
+)
+
+// setWithTTL stores ARGV[1] under KEYS[1], keeping the key's remaining time
+// to live, and applies the ARGV[2] seconds expiry only when the key has none.
+// Rewriting an entry (e.g. after an acknowledgement) therefore never extends
+// its maximum age.
+var setWithTTL = redis.NewScript(`
+redis.call("SET", KEYS[1], ARGV[1], "KEEPTTL")
+if redis.call("TTL", KEYS[1]) < 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// compareAndSet stores ARGV[1] under KEYS[1], like setWithTTL, only if the
+// entry stored there has the Version ARGV[3] (a missing Version is 0).
+var compareAndSet = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if not current then
+	return 0
+end
+local ok, entry = pcall(cjson.decode, current)
+if not ok or (entry.Version or 0) ~= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "KEEPTTL")
+if tonumber(ARGV[2]) > 0 and redis.call("TTL", KEYS[1]) < 0 then
+	redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// getAndDelete returns and deletes KEYS[1], as GETDEL does on Redis 6.2 and
+// later.
+var getAndDelete = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value then
+	redis.call("DEL", KEYS[1])
+end
+return value
+`)
+
+// releaseLock deletes the lock KEYS[1] only if it still holds the token
+// ARGV[1], so a lock that expired and was taken over is left alone.
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// extendLock sets the expiry of the lock KEYS[1] to ARGV[2] milliseconds only
+// if it still holds the token ARGV[1].
+var extendLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// RedisStore is a Store implementation backed by a Redis-compatible server,
+// a Sentinel-monitored master or a Redis Cluster (see RedisConfig). Entries
+// are serialised as JSON under "<prefix><event ID>" keys and stored with no
+// expiry unless a TTL is configured.
 type RedisStore struct {
-	client *redis.Client
+	client  redis.UniversalClient
+	desc    string
+	prefix  string
+	ttl     time.Duration
+	lockTTL time.Duration
+}
+
+// RedisOption configures optional RedisStore behaviour.
+type RedisOption func(*RedisStore)
+
+// WithKeyPrefix sets the prefix of every key written by the store
+// (DefaultRedisKeyPrefix by default).
+func WithKeyPrefix(prefix string) RedisOption {
+	return func(r *RedisStore) { r.prefix = prefix }
+}
+
+// WithTTL sets the maximum age of an entry, counted from the moment it is
+// first stored. Entries of problems whose RESOLVED never arrives expire
+// instead of leaking. Zero disables expiry.
+func WithTTL(ttl time.Duration) RedisOption {
+	return func(r *RedisStore) { r.ttl = ttl }
+}
+
+// WithLockTTL sets how long the lock of an event outlives a replica that died
+// holding it (a minute by default). The holder extends the lock every third
+// of it.
+func WithLockTTL(ttl time.Duration) RedisOption {
+	return func(r *RedisStore) { r.lockTTL = ttl }
 }
 
 // NewRedisStore creates a RedisStore connected to the given Redis server.
 // addr is the host:port of the server (e.g. "localhost:6379").
 // password may be empty when authentication is not required.
 // db selects the logical Redis database index (usually 0).
-func NewRedisStore(addr, password string, db int) *RedisStore {
+func NewRedisStore(addr, password string, db int, opts ...RedisOption) *RedisStore {
 	client := redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
 	})
-	return &RedisStore{client: client}
+	return newRedisStore(client, fmt.Sprintf("redis %s (db %d)", addr, db), opts)
+}
+
+func newRedisStore(client redis.UniversalClient, desc string, opts []RedisOption) *RedisStore {
+	r := &RedisStore{client: client, desc: desc, prefix: DefaultRedisKeyPrefix, lockTTL: redisLockTTL}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
 }
 
+// Client returns the underlying Redis client so other components, such as
+// the outbox, can share its connection pool.
+func (r *RedisStore) Client() redis.UniversalClient {
+	return r.client
+}
+
+func (r *RedisStore) key(eventID string) string {
+	return r.prefix + eventID
+}
+
+// lockKey returns the key of the lock of an event. It is outside the
+// prefix so listings never see it.
+func (r *RedisStore) lockKey(eventID string) string {
+	return "lock:" + r.prefix + eventID
+}
+
+// keyPattern returns the SCAN pattern matching every entry key.
+func (r *RedisStore) keyPattern() string {
+	return globEscaper.Replace(r.prefix) + "*"
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 // Ping checks connectivity to the Redis server and returns an error if the
 // server is unreachable. Callers may use this at startup to fail fast.
 func (r *RedisStore) Ping() error {
@@ -40,44 +181,379 @@ func (r *RedisStore) Ping() error {
 }
 
 // Set serialises entry as JSON and stores it under the given event ID.
-func (r *RedisStore) Set(eventID string, entry Entry) {
+func (r *RedisStore) Set(ctx context.Context, eventID string, entry Entry) error {
+	entry.Version++
 	data, err := json.Marshal(entry)
 	if err != nil {
-		log.Printf("ERROR redis store: marshal entry for event %s: %v", eventID, err)
-		return
+		return fmt.Errorf("redis store: marshal entry for event %s: %w", eventID, err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
 	defer cancel()
-	if err := r.client.Set(ctx, eventID, data, 0).Err(); err != nil {
-		log.Printf("ERROR redis store: SET event %s: %v", eventID, err)
+	if r.ttl > 0 {
+		err = setWithTTL.Run(ctx, r.client, []string{r.key(eventID)}, data, int64(r.ttl/time.Second)).Err()
+	} else {
+		err = r.client.Set(ctx, r.key(eventID), data, 0).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("redis store: SET event %s: %w", eventID, err)
 	}
+	return nil
 }
 
-// Get retrieves and deserialises the Entry for the given event ID.
-// Returns (Entry{}, false) when the key does not exist or on any error.
-func (r *RedisStore) Get(eventID string) (Entry, bool) {
-	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+// Get retrieves and deserialises the Entry for the given event ID, or
+// returns ErrNotFound.
+func (r *RedisStore) Get(ctx context.Context, eventID string) (Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
 	defer cancel()
-	data, err := r.client.Get(ctx, eventID).Bytes()
+	data, err := r.client.Get(ctx, r.key(eventID)).Bytes()
 	if err != nil {
-		if !errors.Is(err, redis.Nil) {
-			log.Printf("ERROR redis store: GET event %s: %v", eventID, err)
+		if errors.Is(err, redis.Nil) {
+			return Entry{}, ErrNotFound
 		}
-		return Entry{}, false
+		return Entry{}, fmt.Errorf("redis store: GET event %s: %w", eventID, err)
 	}
+	return decodeRedisEntry(eventID, data)
+}
+
+func decodeRedisEntry(eventID string, data []byte) (Entry, error) {
 	var entry Entry
 	if err := json.Unmarshal(data, &entry); err != nil {
-		log.Printf("ERROR redis store: unmarshal entry for event %s: %v", eventID, err)
-		return Entry{}, false
+		return Entry{}, fmt.Errorf("redis store: unmarshal entry for event %s: %w", eventID, err)
 	}
-	return entry, true
+	return entry, nil
+}
+
+// SetIfAbsent stores entry for the given event ID only if it has no entry,
+// with SET NX.
+func (r *RedisStore) SetIfAbsent(ctx context.Context, eventID string, entry Entry) (bool, error) {
+	entry.Version++
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, fmt.Errorf("redis store: marshal entry for event %s: %w", eventID, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	ok, err := r.client.SetNX(ctx, r.key(eventID), data, r.ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("redis store: SETNX event %s: %w", eventID, err)
+	}
+	return ok, nil
+}
+
+// GetAndDelete removes the entry for the given event ID and returns it, in
+// one script.
+func (r *RedisStore) GetAndDelete(ctx context.Context, eventID string) (Entry, error) {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	data, err := getAndDelete.Run(ctx, r.client, []string{r.key(eventID)}).Text()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return Entry{}, ErrNotFound
+		}
+		return Entry{}, fmt.Errorf("redis store: GETDEL event %s: %w", eventID, err)
+	}
+	return decodeRedisEntry(eventID, []byte(data))
+}
+
+// CompareAndSet stores entry only if the stored entry has entry.Version. The
+// check and the write run in one script.
+func (r *RedisStore) CompareAndSet(ctx context.Context, eventID string, entry Entry) (bool, error) {
+	version := entry.Version
+	entry.Version++
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return false, fmt.Errorf("redis store: marshal entry for event %s: %w", eventID, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	n, err := compareAndSet.Run(ctx, r.client, []string{r.key(eventID)}, data, int64(r.ttl/time.Second), version).Int()
+	if err != nil {
+		return false, fmt.Errorf("redis store: compare-and-set event %s: %w", eventID, err)
+	}
+	return n == 1, nil
 }
 
 // Delete removes the entry for the given event ID.
-func (r *RedisStore) Delete(eventID string) {
-	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+func (r *RedisStore) Delete(ctx context.Context, eventID string) error {
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+	defer cancel()
+	if err := r.client.Del(ctx, r.key(eventID)).Err(); err != nil {
+		return fmt.Errorf("redis store: DEL event %s: %w", eventID, err)
+	}
+	return nil
+}
+
+// Lock takes the lock of eventID, shared by every replica using the same
+// Redis server, waiting until it is free or ctx is done. The lock is extended
+// while it is held; one whose holder died expires after the lock TTL (see
+// WithLockTTL).
+func (r *RedisStore) Lock(ctx context.Context, eventID string) (func(), error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+	key := r.lockKey(eventID)
+	poll := redisLockPoll
+	for {
+		ok, err := r.client.SetNX(ctx, key, token, r.lockTTL).Result()
+		if err != nil {
+			return nil, fmt.Errorf("redis store: lock event %s: %w", eventID, err)
+		}
+		if ok {
+			break
+		}
+		// Jittered, so replicas waiting for the same lock spread out.
+		select {
+		case <-time.After(poll/2 + mathrand.N(poll/2)):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("redis store: lock event %s: %w", eventID, ctx.Err())
+		}
+		poll = min(2*poll, redisLockMaxPoll)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		r.keepLock(eventID, key, token, stop)
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+		defer cancel()
+		if err := releaseLock.Run(ctx, r.client, []string{key}, token).Err(); err != nil {
+			log.Printf("ERROR redis store: unlock event %s: %v", eventID, err)
+		}
+	}, nil
+}
+
+// keepLock extends the lock key holding token every third of the lock TTL
+// until stop is closed, or until the lock is found expired and taken over.
+func (r *RedisStore) keepLock(eventID, key, token string, stop <-chan struct{}) {
+	ticker := time.NewTicker(r.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+		held, err := extendLock.Run(ctx, r.client, []string{key}, token, r.lockTTL.Milliseconds()).Int()
+		cancel()
+		switch {
+		case err != nil:
+			log.Printf("ERROR redis store: extend lock of event %s: %v", eventID, err)
+		case held == 0:
+			log.Printf("WARNING redis store: lock of event %s expired while held", eventID)
+			return
+		}
+	}
+}
+
+// List returns one page of matching entries. Keys are walked with SCAN so
+// the server is never blocked the way KEYS would; the cursor is the SCAN
+// cursor, prefixed on a cluster by the index of the master being walked. The
+// order is unspecified and an entry may occasionally be returned twice. Keys
+// whose value is not an Entry are skipped.
+func (r *RedisStore) List(ctx context.Context, opts ListOptions) ([]Record, string, error) {
+	node, cursor, err := parseRedisCursor(opts.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, redisOpTimeout)
 	defer cancel()
-	if err := r.client.Del(ctx, eventID).Err(); err != nil {
-		log.Printf("ERROR redis store: DEL event %s: %v", eventID, err)
+
+	nodes, err := r.scanNodes(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := opts.limit()
+	var records []Record
+	for node < len(nodes) {
+		keys, next, err := nodes[node].Scan(ctx, cursor, r.keyPattern(), int64(limit)).Result()
+		if err != nil {
+			return nil, "", fmt.Errorf("redis store: SCAN: %w", err)
+		}
+		page, err := r.fetch(ctx, keys, opts.Filter)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, page...)
+		cursor = next
+		if cursor == 0 {
+			node++
+		}
+		if node < len(nodes) && len(records) >= limit {
+			return records, formatRedisCursor(node, cursor), nil
+		}
+	}
+	return records, "", nil
+}
+
+// scanNodes returns the servers whose keys List walks: the masters of a
+// cluster, sorted by address so the order is the same on every page, or
+// else the one server.
+func (r *RedisStore) scanNodes(ctx context.Context) ([]redis.Cmdable, error) {
+	c, ok := r.client.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{r.client}, nil
+	}
+	var mu sync.Mutex
+	var masters []*redis.Client
+	err := c.ForEachMaster(ctx, func(ctx context.Context, m *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("redis store: cluster masters: %w", err)
+	}
+	sort.Slice(masters, func(i, j int) bool { return masters[i].Options().Addr < masters[j].Options().Addr })
+	nodes := make([]redis.Cmdable, len(masters))
+	for i, m := range masters {
+		nodes[i] = m
+	}
+	return nodes, nil
+}
+
+// parseRedisCursor splits a List cursor into the index of the node and its
+// SCAN cursor. The index is omitted for the first node.
+func parseRedisCursor(s string) (int, uint64, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	nodeStr, cursorStr, ok := strings.Cut(s, ":")
+	if !ok {
+		nodeStr, cursorStr = "0", s
+	}
+	node, err := strconv.Atoi(nodeStr)
+	if err != nil || node < 0 {
+		return 0, 0, fmt.Errorf("redis store: invalid list cursor %q", s)
+	}
+	cursor, err := strconv.ParseUint(cursorStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("redis store: invalid list cursor %q", s)
+	}
+	return node, cursor, nil
+}
+
+func formatRedisCursor(node int, cursor uint64) string {
+	if node == 0 {
+		return strconv.FormatUint(cursor, 10)
+	}
+	return fmt.Sprintf("%d:%d", node, cursor)
+}
+
+// Scan calls fn for every matching entry until fn returns false.
+func (r *RedisStore) Scan(ctx context.Context, f Filter, fn func(Record) bool) error {
+	return scanPages(ctx, r, f, fn)
+}
+
+// fetch loads the entries stored under keys with one pipeline of GETs, which
+// unlike MGET works across the slots of a cluster, and returns those
+// matching f.
+func (r *RedisStore) fetch(ctx context.Context, keys []string, f Filter) ([]Record, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	cmds := make([]*redis.StringCmd, len(keys))
+	r.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = p.Get(ctx, key)
+		}
+		return nil
+	})
+	var records []Record
+	for i, cmd := range cmds {
+		data, err := cmd.Bytes()
+		if err != nil {
+			// A missing key was deleted since SCAN returned it, and a
+			// server error (WRONGTYPE) means it holds no Entry.
+			var re redis.Error
+			if errors.Is(err, redis.Nil) || errors.As(err, &re) {
+				continue
+			}
+			return nil, fmt.Errorf("redis store: GET: %w", err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			continue
+		}
+		if f.Match(entry) {
+			records = append(records, Record{EventID: strings.TrimPrefix(keys[i], r.prefix), Entry: entry})
+		}
+	}
+	return records, nil
+}
+
+// String describes the backend for status output.
+func (r *RedisStore) String() string {
+	return r.desc
+}
+
+// MigrateLegacyKeys moves entries written by releases without key prefixes
+// (stored directly under the event ID) to prefixed keys, applying the
+// configured TTL. Only string values that decode to an Entry tracking at
+// least one message are moved; existing prefixed keys are never overwritten.
+// It returns the number of keys migrated and is safe to run repeatedly. It
+// is not supported on a cluster, where keys cannot be renamed across slots.
+func (r *RedisStore) MigrateLegacyKeys() (int, error) {
+	if r.prefix == "" {
+		return 0, nil
+	}
+	if _, ok := r.client.(*redis.ClusterClient); ok {
+		return 0, errors.New("legacy key migration is not supported on a Redis Cluster")
+	}
+	ctx := context.Background()
+	moved := 0
+	iter := r.client.Scan(ctx, 0, "*", 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if strings.HasPrefix(key, r.prefix) {
+			continue
+		}
+		opCtx, cancel := context.WithTimeout(ctx, redisOpTimeout)
+		ok, err := r.migrateKey(opCtx, key)
+		cancel()
+		if err != nil {
+			return moved, fmt.Errorf("migrating key %q: %w", key, err)
+		}
+		if ok {
+			moved++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return moved, fmt.Errorf("scanning keys: %w", err)
+	}
+	return moved, nil
+}
+
+func (r *RedisStore) migrateKey(ctx context.Context, key string) (bool, error) {
+	data, err := r.client.Get(ctx, key).Bytes()
+	if err != nil {
+		// Missing keys and non-string values are not legacy entries.
+		if errors.Is(err, redis.Nil) || strings.HasPrefix(err.Error(), "WRONGTYPE") {
+			return false, nil
+		}
+		return false, err
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil || (entry.MessageID == 0 && len(entry.Messages) == 0) {
+		return false, nil
+	}
+	renamed, err := r.client.RenameNX(ctx, key, r.key(key)).Result()
+	if err != nil || !renamed {
+		return false, err
+	}
+	if r.ttl > 0 {
+		if err := r.client.Expire(ctx, r.key(key), r.ttl).Err(); err != nil {
+			return true, err
+		}
 	}
+	return true, nil
 }
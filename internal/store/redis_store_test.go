@@ -1,8 +1,12 @@
 package store_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
@@ -24,16 +28,16 @@ func TestRedisSetAndGet(t *testing.T) {
 	addr := startMiniRedis(t)
 	s := store.NewRedisStore(addr, "", 0)
 
-	s.Set("trigger-1", store.Entry{MessageID: 42, StartTime: "2024-01-01 00:00:00 UTC", Message: "details", Severity: "HIGH"})
-	e, ok := s.Get("trigger-1")
-	if !ok {
+	s.Set(t.Context(), "trigger-1", store.Entry{MessageID: 42, StartTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Message: "details", Severity: "HIGH"})
+	e, err := s.Get(t.Context(), "trigger-1")
+	if err != nil {
 		t.Fatal("expected entry to exist after Set")
 	}
 	if e.MessageID != 42 {
 		t.Fatalf("expected message ID 42, got %d", e.MessageID)
 	}
-	if e.StartTime != "2024-01-01 00:00:00 UTC" {
-		t.Fatalf("expected StartTime to be preserved, got %q", e.StartTime)
+	if !e.StartTime.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected StartTime to be preserved, got %s", e.StartTime)
 	}
 	if e.Message != "details" {
 		t.Fatalf("expected Message to be preserved, got %q", e.Message)
@@ -47,9 +51,9 @@ func TestRedisGetMissing(t *testing.T) {
 	addr := startMiniRedis(t)
 	s := store.NewRedisStore(addr, "", 0)
 
-	_, ok := s.Get("nonexistent")
-	if ok {
-		t.Fatal("expected Get to return false for a missing key")
+	_, err := s.Get(t.Context(), "nonexistent")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatal("expected ErrNotFound for a missing key")
 	}
 }
 
@@ -57,11 +61,11 @@ func TestRedisDelete(t *testing.T) {
 	addr := startMiniRedis(t)
 	s := store.NewRedisStore(addr, "", 0)
 
-	s.Set("trigger-1", store.Entry{MessageID: 99})
-	s.Delete("trigger-1")
+	s.Set(t.Context(), "trigger-1", store.Entry{MessageID: 99})
+	s.Delete(t.Context(), "trigger-1")
 
-	_, ok := s.Get("trigger-1")
-	if ok {
+	_, err := s.Get(t.Context(), "trigger-1")
+	if !errors.Is(err, store.ErrNotFound) {
 		t.Fatal("expected entry to be absent after Delete")
 	}
 }
@@ -69,8 +73,9 @@ func TestRedisDelete(t *testing.T) {
 func TestRedisDeleteMissing(t *testing.T) {
 	addr := startMiniRedis(t)
 	s := store.NewRedisStore(addr, "", 0)
-	// Should not panic.
-	s.Delete("does-not-exist")
+	if err := s.Delete(t.Context(), "does-not-exist"); err != nil {
+		t.Fatalf("expected deleting a missing entry to succeed, got %v", err)
+	}
 }
 
 func TestRedisConcurrentAccess(t *testing.T) {
@@ -83,18 +88,344 @@ func TestRedisConcurrentAccess(t *testing.T) {
 		go func(n int) {
 			defer wg.Done()
 			key := "trigger"
-			s.Set(key, store.Entry{MessageID: n})
-			s.Get(key)
-			s.Delete(key)
+			s.Set(t.Context(), key, store.Entry{MessageID: n})
+			s.Get(t.Context(), key)
+			s.Delete(t.Context(), key)
 		}(i)
 	}
 	wg.Wait()
 }
 
+func TestRedisListAndScan(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	s := store.NewRedisStore(mr.Addr(), "", 0)
+
+	for i := 0; i < 25; i++ {
+		s.Set(t.Context(), fmt.Sprint(i), store.Entry{Severity: "High", Host: fmt.Sprintf("db-%02d", i)})
+	}
+	s.Set(t.Context(), "web", store.Entry{Severity: "High", Host: "web-01"})
+	// Unrelated keys sharing the database are skipped.
+	mr.Set("unrelated", "not json")
+
+	seen := make(map[string]bool)
+	opts := store.ListOptions{Filter: store.Filter{Host: "db-*"}, Limit: 10}
+	for pages := 0; ; pages++ {
+		if pages > 30 {
+			t.Fatal("pagination did not terminate")
+		}
+		records, next, err := s.List(t.Context(), opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for _, r := range records {
+			seen[r.EventID] = true
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+	if len(seen) != 25 || seen["web"] {
+		t.Fatalf("expected the 25 db entries, got %d (web included: %v)", len(seen), seen["web"])
+	}
+
+	n := 0
+	s.Scan(t.Context(), store.Filter{Severity: "HIGH"}, func(r store.Record) bool {
+		n++
+		return true
+	})
+	if n < 26 {
+		t.Fatalf("expected Scan to visit all 26 entries, got %d", n)
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	s := store.NewRedisStore(mr.Addr(), "", 0)
+	mr.Close()
+	ctx, cancel := context.WithTimeout(t.Context(), 200*time.Millisecond)
+	defer cancel()
+
+	// An unreachable server must not look like a missing entry.
+	if _, err := s.Get(ctx, "1"); err == nil || errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected a backend error from Get, got %v", err)
+	}
+	if _, err := s.GetAndDelete(ctx, "1"); err == nil || errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected a backend error from GetAndDelete, got %v", err)
+	}
+	if err := s.Set(ctx, "1", store.Entry{}); err == nil {
+		t.Fatal("expected a backend error from Set")
+	}
+	if err := s.Scan(ctx, store.Filter{}, func(store.Record) bool { return true }); err == nil {
+		t.Fatal("expected a backend error from Scan")
+	}
+}
+
+func TestRedisListInvalidCursor(t *testing.T) {
+	addr := startMiniRedis(t)
+	s := store.NewRedisStore(addr, "", 0)
+	s.Set(t.Context(), "1", store.Entry{})
+
+	records, next, err := s.List(t.Context(), store.ListOptions{Cursor: "not-a-cursor"})
+	if err == nil || len(records) != 0 || next != "" {
+		t.Fatalf("expected an error for an invalid cursor, got %+v %q %v", records, next, err)
+	}
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	s := store.NewRedisStore(mr.Addr(), "", 0)
+	s.Set(t.Context(), "123", store.Entry{Messages: []store.Message{{ChatID: 1, MessageID: 2}}})
+	if !mr.Exists(store.DefaultRedisKeyPrefix + "123") {
+		t.Fatalf("expected key %q, got keys %v", store.DefaultRedisKeyPrefix+"123", mr.Keys())
+	}
+
+	custom := store.NewRedisStore(mr.Addr(), "", 0, store.WithKeyPrefix("team[a]:"))
+	custom.Set(t.Context(), "123", store.Entry{Severity: "High"})
+	if !mr.Exists("team[a]:123") {
+		t.Fatalf("expected key with custom prefix, got keys %v", mr.Keys())
+	}
+	records, _, err := custom.List(t.Context(), store.ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].EventID != "123" || records[0].Entry.Severity != "High" {
+		t.Fatalf("expected List to see only the custom prefix, got %+v", records)
+	}
+}
+
+func TestRedisTTL(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	s := store.NewRedisStore(mr.Addr(), "", 0, store.WithTTL(time.Hour))
+
+	s.Set(t.Context(), "1", store.Entry{Severity: "High"})
+	key := store.DefaultRedisKeyPrefix + "1"
+	if ttl := mr.TTL(key); ttl != time.Hour {
+		t.Fatalf("expected TTL of 1h, got %v", ttl)
+	}
+
+	// Rewriting the entry must not extend its maximum age.
+	mr.FastForward(20 * time.Minute)
+	s.Set(t.Context(), "1", store.Entry{Severity: "Disaster"})
+	if ttl := mr.TTL(key); ttl != 40*time.Minute {
+		t.Fatalf("expected remaining TTL of 40m after rewrite, got %v", ttl)
+	}
+	if e, _ := s.Get(t.Context(), "1"); e.Severity != "Disaster" {
+		t.Fatalf("expected rewritten entry, got %+v", e)
+	}
+
+	mr.FastForward(41 * time.Minute)
+	if _, err := s.Get(t.Context(), "1"); err == nil {
+		t.Fatal("expected entry to expire")
+	}
+}
+
+func TestRedisMigrateLegacyKeys(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+
+	// Entries as written by releases without key prefixes.
+	mr.Set("100", `{"MessageID":42,"StartTime":"2024-01-01 00:00:00 UTC"}`)
+	mr.Set("101", `{"Messages":[{"ChatID":-1,"MessageID":7}]}`)
+	// Keys that are not entries must be left alone.
+	mr.Set("session", `{"user":"bob"}`)
+	mr.Set("counter", "12")
+	mr.Lpush("queue", "x")
+
+	s := store.NewRedisStore(mr.Addr(), "", 0, store.WithTTL(time.Hour))
+	n, err := s.MigrateLegacyKeys()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 migrated keys, got %d", n)
+	}
+	e, err := s.Get(t.Context(), "100")
+	if err != nil || e.MessageID != 42 {
+		t.Fatalf("expected legacy entry under the prefix, got %+v (%v)", e, err)
+	}
+	if !e.StartTime.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the legacy StartTime to be converted, got %s", e.StartTime)
+	}
+	if mr.TTL(store.DefaultRedisKeyPrefix+"100") != time.Hour {
+		t.Error("expected the TTL to be applied to migrated keys")
+	}
+	for _, key := range []string{"session", "counter", "queue"} {
+		if !mr.Exists(key) {
+			t.Errorf("expected unrelated key %q to be kept", key)
+		}
+	}
+
+	// Running again is a no-op.
+	if n, err := s.MigrateLegacyKeys(); err != nil || n != 0 {
+		t.Fatalf("expected second migration to move nothing, got %d, %v", n, err)
+	}
+}
+
+func TestRedisAtomicOps(t *testing.T) {
+	testAtomicOps(t, store.NewRedisStore(startMiniRedis(t), "", 0))
+}
+
+func TestRedisAtomicOpsTTL(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	s := store.NewRedisStore(mr.Addr(), "", 0, store.WithTTL(time.Hour))
+	key := store.DefaultRedisKeyPrefix + "1"
+
+	s.SetIfAbsent(t.Context(), "1", store.Entry{Severity: "High"})
+	if ttl := mr.TTL(key); ttl != time.Hour {
+		t.Fatalf("expected TTL of 1h, got %v", ttl)
+	}
+	mr.FastForward(20 * time.Minute)
+	e, _ := s.Get(t.Context(), "1")
+	if ok, err := s.CompareAndSet(t.Context(), "1", e); !ok || err != nil {
+		t.Fatal("expected CompareAndSet to store an unchanged entry")
+	}
+	if ttl := mr.TTL(key); ttl != 40*time.Minute {
+		t.Fatalf("expected remaining TTL of 40m after CompareAndSet, got %v", ttl)
+	}
+}
+
+func TestRedisLock(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	// Two replicas sharing the server.
+	a := store.NewRedisStore(mr.Addr(), "", 0)
+	b := store.NewRedisStore(mr.Addr(), "", 0)
+
+	unlock, err := a.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.Lock(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the other replica to wait, got %v", err)
+	}
+	other, err := b.Lock(context.Background(), "2")
+	if err != nil {
+		t.Fatalf("expected another event not to wait, got %v", err)
+	}
+	other()
+	if records, _, _ := a.List(t.Context(), store.ListOptions{}); len(records) != 0 {
+		t.Fatalf("expected locks not to be listed, got %+v", records)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		unlock, err := b.Lock(context.Background(), "1")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		unlock()
+	}()
+	unlock()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting replica to get the lock once released")
+	}
+}
+
+func TestRedisLockExpires(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	a := store.NewRedisStore(mr.Addr(), "", 0)
+	b := store.NewRedisStore(mr.Addr(), "", 0)
+
+	// a dies holding the lock; it expires and b takes it over.
+	stale, err := a.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mr.FastForward(2 * time.Minute)
+	unlock, err := b.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("expected the expired lock to be taken over, got %v", err)
+	}
+
+	// Releasing the stale lock must not release b's.
+	stale()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.Lock(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lock to still be held, got %v", err)
+	}
+	unlock()
+}
+
+func TestRedisLockExtendedWhileHeld(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("starting miniredis: %v", err)
+	}
+	defer mr.Close()
+	a := store.NewRedisStore(mr.Addr(), "", 0, store.WithLockTTL(300*time.Millisecond))
+	b := store.NewRedisStore(mr.Addr(), "", 0)
+
+	unlock, err := a.Lock(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// miniredis only counts down on FastForward: let most of the TTL pass
+	// and wait for the holder to extend it again.
+	key := "lock:" + store.DefaultRedisKeyPrefix + "1"
+	mr.FastForward(250 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.TTL(key) != 300*time.Millisecond {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the held lock to be extended, TTL is %v", mr.TTL(key))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mr.FastForward(250 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Lock(ctx, "1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the extended lock to still be held, got %v", err)
+	}
+
+	unlock()
+	if mr.Exists(key) {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
 // TestRedisStoreImplementsStore verifies at compile time that *RedisStore
-// satisfies the Store interface.
+// satisfies the Store and Locker interfaces.
 func TestRedisStoreImplementsStore(t *testing.T) {
 	var _ store.Store = (*store.RedisStore)(nil)
+	var _ store.Locker = (*store.RedisStore)(nil)
 }
 
 // TestMessageStoreImplementsStore verifies at compile time that *MessageStore
@@ -3,32 +3,170 @@
 // to edit an existing message when a trigger's status changes (e.g.
 // PROBLEM → RESOLVED) instead of posting a new one.
 //
-// Two implementations are available:
+// Three implementations are available:
 //   - MessageStore: in-memory store (default)
 //   - RedisStore:   Redis-backed store (enabled when a Redis address is configured)
+//   - BoltStore:    embedded file-backed store (enabled when a store path is configured)
 package store
 
-import "sync"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
 
-// Store is the interface implemented by both the in-memory MessageStore and
-// the Redis-backed RedisStore.
+// legacyTimeLayout is the layout StartTime was stored in, as a string, by
+// earlier releases.
+const legacyTimeLayout = "2006-01-02 15:04:05 MST"
+
+// ErrNotFound is returned when an event has no entry.
+var ErrNotFound = errors.New("store: entry not found")
+
+// Store is the interface implemented by the in-memory MessageStore, the
+// Redis-backed RedisStore and the file-backed BoltStore. Every method returns
+// the error of the backend, so a missing entry (ErrNotFound) can be told from
+// a backend that cannot be reached.
 type Store interface {
-	// Set stores an Entry for the given event ID.
-	Set(eventID string, entry Entry)
-	// Get returns the Entry for the given event ID and a boolean indicating
-	// whether the entry exists. Returns false when the key is missing or on
-	// any backend error (which is logged internally).
-	Get(eventID string) (Entry, bool)
-	// Delete removes the entry for the given event ID.
-	Delete(eventID string)
+	// Set stores an Entry for the given event ID, whatever is stored. Use
+	// CompareAndSet to write back an entry read from the store.
+	Set(ctx context.Context, eventID string, entry Entry) error
+	// Get returns the Entry for the given event ID, or ErrNotFound.
+	Get(ctx context.Context, eventID string) (Entry, error)
+	// Delete removes the entry for the given event ID. Deleting a missing
+	// entry is not an error.
+	Delete(ctx context.Context, eventID string) error
+	// SetIfAbsent stores entry for the given event ID only if the event
+	// has no entry yet, and reports whether it did. Of several callers
+	// racing to create the same entry exactly one succeeds.
+	SetIfAbsent(ctx context.Context, eventID string, entry Entry) (bool, error)
+	// GetAndDelete removes the entry for the given event ID and returns
+	// it, or ErrNotFound. Of several callers racing to delete the same
+	// entry exactly one gets it.
+	GetAndDelete(ctx context.Context, eventID string) (Entry, error)
+	// CompareAndSet stores entry for the given event ID only if the stored
+	// entry still has entry.Version, i.e. was not written since entry was
+	// read, and reports whether it did. It fails when the entry is gone.
+	CompareAndSet(ctx context.Context, eventID string, entry Entry) (bool, error)
+	// List returns one page of entries matching opts, together with the
+	// cursor for the next page, which is empty after the last page.
+	List(ctx context.Context, opts ListOptions) ([]Record, string, error)
+	// Scan calls fn for every entry matching f, across all pages, until fn
+	// returns false.
+	Scan(ctx context.Context, f Filter, fn func(Record) bool) error
+}
+
+// Message identifies a Telegram message posted for an event. ThreadID is the
+// forum topic the message was posted in, or zero for the General topic.
+type Message struct {
+	ChatID    int64
+	ThreadID  int `json:",omitempty"`
+	MessageID int
 }
 
 // Entry holds the data persisted for a single PROBLEM event.
 type Entry struct {
-	MessageID int
-	StartTime string
-	Message   string
-	Severity  string
+	// Messages lists the Telegram messages posted for the event, one per
+	// destination chat.
+	Messages []Message
+
+	// MessageID is the message posted to the default chat by releases that
+	// predate routing. It is only kept so such entries can still be resolved
+	// and is never written by the current code.
+	MessageID int `json:",omitempty"`
+
+	StartTime   time.Time
+	Message     string
+	Severity    string
+	TriggerName string   `json:",omitempty"`
+	Host        string   `json:",omitempty"`
+	HostGroups  []string `json:",omitempty"`
+
+	// Ack is set once the event has been acknowledged or closed from
+	// Telegram.
+	Ack *Acknowledgement `json:",omitempty"`
+
+	// Claimed is when a PROBLEM claimed the event, before posting its
+	// messages. It is cleared once the messages are tracked.
+	Claimed *time.Time `json:",omitempty"`
+
+	// Updates lists the update operations Zabbix reported for the event,
+	// oldest first.
+	Updates []Update `json:",omitempty"`
+
+	// Digest is the ID of the storm digest the event was aggregated into.
+	// Messages then lists the digest messages rather than messages of the
+	// event's own.
+	Digest string `json:",omitempty"`
+
+	// Reminders counts the "still open" reminders sent for the event.
+	Reminders int `json:",omitempty"`
+
+	// Escalation counts the escalation steps already taken for the event.
+	// The messages posted by those steps are listed in Messages.
+	Escalation int `json:",omitempty"`
+
+	// Version counts the writes of the entry: every write stores it one
+	// higher than in the entry written. See Store.CompareAndSet.
+	Version int64 `json:",omitempty"`
+}
+
+// Acknowledgement records who acknowledged an event from Telegram, and when.
+// Closed is true when a manual close was requested rather than a plain
+// acknowledgement.
+type Acknowledgement struct {
+	By     string
+	At     time.Time
+	Closed bool
+}
+
+// UnmarshalJSON decodes an Entry, converting the StartTime of entries
+// written by earlier releases, which stored it as a formatted string. Such
+// entries are saved in the current format on their next update. A start
+// that cannot be converted is left zero rather than losing the entry.
+func (e *Entry) UnmarshalJSON(data []byte) error {
+	type entry Entry
+	aux := struct {
+		*entry
+		StartTime json.RawMessage
+	}{entry: (*entry)(e)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.StartTime) == 0 || json.Unmarshal(aux.StartTime, &e.StartTime) == nil {
+		return nil
+	}
+	var s string
+	if json.Unmarshal(aux.StartTime, &s) == nil {
+		if t, err := time.ParseInLocation(legacyTimeLayout, s, time.Local); err == nil {
+			e.StartTime = t
+		}
+	}
+	return nil
+}
+
+// OpenFor returns how long the event has been open at now, or zero when its
+// start is unknown.
+func (e Entry) OpenFor(now time.Time) time.Duration {
+	if e.StartTime.IsZero() {
+		return 0
+	}
+	return now.Sub(e.StartTime)
+}
+
+// Update records an update operation on an event in Zabbix: who made it,
+// what was done (e.g. "acknowledged, commented") and the comment, if any.
+type Update struct {
+	At      time.Time
+	By      string `json:",omitempty"`
+	Action  string `json:",omitempty"`
+	Message string `json:",omitempty"`
+	// SeverityFrom and SeverityTo record a change of severity made without
+	// an action of its own, which is described in the language of each
+	// message.
+	SeverityFrom string `json:",omitempty"`
+	SeverityTo   string `json:",omitempty"`
 }
 
 // MessageStore maps event IDs to Entry values.
@@ -43,24 +181,103 @@ func New() *MessageStore {
 }
 
 // Set stores an Entry for the given event ID.
-func (s *MessageStore) Set(eventID string, entry Entry) {
+func (s *MessageStore) Set(_ context.Context, eventID string, entry Entry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	entry.Version++
 	s.data[eventID] = entry
+	return nil
 }
 
-// Get returns the Entry for the given event ID, and a boolean indicating
-// whether the entry exists.
-func (s *MessageStore) Get(eventID string) (Entry, bool) {
+// Get returns the Entry for the given event ID, or ErrNotFound.
+func (s *MessageStore) Get(_ context.Context, eventID string) (Entry, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	e, ok := s.data[eventID]
-	return e, ok
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	return e, nil
 }
 
 // Delete removes the entry for the given event ID.
-func (s *MessageStore) Delete(eventID string) {
+func (s *MessageStore) Delete(_ context.Context, eventID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.data, eventID)
+	return nil
+}
+
+// SetIfAbsent stores entry for the given event ID only if it has no entry.
+func (s *MessageStore) SetIfAbsent(_ context.Context, eventID string, entry Entry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[eventID]; ok {
+		return false, nil
+	}
+	entry.Version++
+	s.data[eventID] = entry
+	return true, nil
+}
+
+// GetAndDelete removes the entry for the given event ID and returns it.
+func (s *MessageStore) GetAndDelete(_ context.Context, eventID string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.data[eventID]
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	delete(s.data, eventID)
+	return e, nil
+}
+
+// CompareAndSet stores entry only if the stored entry has entry.Version.
+func (s *MessageStore) CompareAndSet(_ context.Context, eventID string, entry Entry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.data[eventID]; !ok || e.Version != entry.Version {
+		return false, nil
+	}
+	entry.Version++
+	s.data[eventID] = entry
+	return true, nil
+}
+
+// List returns one page of matching entries in event ID order. The cursor is
+// the last event ID of the page, so entries added or removed between calls
+// do not shift the following pages.
+func (s *MessageStore) List(_ context.Context, opts ListOptions) ([]Record, string, error) {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.data))
+	for id, e := range s.data {
+		if (opts.Cursor == "" || lessEventID(opts.Cursor, id)) && opts.Match(e) {
+			ids = append(ids, id)
+		}
+	}
+	SortEventIDs(ids)
+
+	limit := opts.limit()
+	next := ""
+	if len(ids) > limit {
+		ids = ids[:limit]
+		next = ids[limit-1]
+	}
+	records := make([]Record, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, Record{EventID: id, Entry: s.data[id]})
+	}
+	s.mu.RUnlock()
+	return records, next, nil
+}
+
+// Scan calls fn for every matching entry in event ID order until fn returns
+// false.
+func (s *MessageStore) Scan(ctx context.Context, f Filter, fn func(Record) bool) error {
+	return scanPages(ctx, s, f, fn)
+}
+
+// String describes the backend for status output.
+func (s *MessageStore) String() string {
+	return "in-memory"
 }
@@ -1,8 +1,12 @@
 package store_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
 )
@@ -10,16 +14,16 @@ import (
 func TestSetAndGet(t *testing.T) {
 	s := store.New()
 
-	s.Set("trigger-1", store.Entry{MessageID: 42, StartTime: "2024-01-01 00:00:00 UTC", Message: "details"})
-	e, ok := s.Get("trigger-1")
-	if !ok {
+	s.Set(t.Context(), "trigger-1", store.Entry{MessageID: 42, StartTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Message: "details"})
+	e, err := s.Get(t.Context(), "trigger-1")
+	if err != nil {
 		t.Fatal("expected entry to exist after Set")
 	}
 	if e.MessageID != 42 {
 		t.Fatalf("expected message ID 42, got %d", e.MessageID)
 	}
-	if e.StartTime != "2024-01-01 00:00:00 UTC" {
-		t.Fatalf("expected StartTime to be preserved, got %q", e.StartTime)
+	if !e.StartTime.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected StartTime to be preserved, got %s", e.StartTime)
 	}
 	if e.Message != "details" {
 		t.Fatalf("expected Message to be preserved, got %q", e.Message)
@@ -29,28 +33,29 @@ func TestSetAndGet(t *testing.T) {
 func TestGetMissing(t *testing.T) {
 	s := store.New()
 
-	_, ok := s.Get("nonexistent")
-	if ok {
-		t.Fatal("expected Get to return false for a missing key")
+	_, err := s.Get(t.Context(), "nonexistent")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Fatal("expected ErrNotFound for a missing key")
 	}
 }
 
 func TestDelete(t *testing.T) {
 	s := store.New()
 
-	s.Set("trigger-1", store.Entry{MessageID: 99})
-	s.Delete("trigger-1")
+	s.Set(t.Context(), "trigger-1", store.Entry{MessageID: 99})
+	s.Delete(t.Context(), "trigger-1")
 
-	_, ok := s.Get("trigger-1")
-	if ok {
+	_, err := s.Get(t.Context(), "trigger-1")
+	if !errors.Is(err, store.ErrNotFound) {
 		t.Fatal("expected entry to be absent after Delete")
 	}
 }
 
 func TestDeleteMissing(t *testing.T) {
 	s := store.New()
-	// Should not panic.
-	s.Delete("does-not-exist")
+	if err := s.Delete(t.Context(), "does-not-exist"); err != nil {
+		t.Fatalf("expected deleting a missing entry to succeed, got %v", err)
+	}
 }
 
 func TestConcurrentAccess(t *testing.T) {
@@ -62,10 +67,244 @@ func TestConcurrentAccess(t *testing.T) {
 		go func(n int) {
 			defer wg.Done()
 			key := "trigger"
-			s.Set(key, store.Entry{MessageID: n})
-			s.Get(key)
-			s.Delete(key)
+			s.Set(t.Context(), key, store.Entry{MessageID: n})
+			s.Get(t.Context(), key)
+			s.Delete(t.Context(), key)
 		}(i)
 	}
 	wg.Wait()
 }
+
+// testAtomicOps checks SetIfAbsent, GetAndDelete and CompareAndSet on s,
+// alone and with several callers racing.
+func testAtomicOps(t *testing.T, s store.Store) {
+	t.Helper()
+	ctx := t.Context()
+	setIfAbsent := func(id string, e store.Entry) bool {
+		ok, err := s.SetIfAbsent(ctx, id, e)
+		if err != nil {
+			t.Errorf("SetIfAbsent: unexpected error: %v", err)
+		}
+		return ok
+	}
+	compareAndSet := func(id string, e store.Entry) bool {
+		ok, err := s.CompareAndSet(ctx, id, e)
+		if err != nil {
+			t.Errorf("CompareAndSet: unexpected error: %v", err)
+		}
+		return ok
+	}
+
+	if !setIfAbsent("1", store.Entry{Severity: "High"}) {
+		t.Fatal("expected SetIfAbsent to store a new entry")
+	}
+	if setIfAbsent("1", store.Entry{Severity: "Disaster"}) {
+		t.Fatal("expected SetIfAbsent not to overwrite an entry")
+	}
+	e, err := s.Get(ctx, "1")
+	if err != nil || e.Severity != "High" || e.Version != 1 {
+		t.Fatalf("expected the first entry with version 1, got %+v (%v)", e, err)
+	}
+
+	stale := e
+	e.Severity = "Disaster"
+	if !compareAndSet("1", e) {
+		t.Fatal("expected CompareAndSet to store an unchanged entry")
+	}
+	stale.Severity = "Warning"
+	if compareAndSet("1", stale) {
+		t.Fatal("expected CompareAndSet to refuse an entry written since it was read")
+	}
+	if e, _ = s.Get(ctx, "1"); e.Severity != "Disaster" || e.Version != 2 {
+		t.Fatalf("expected the compared entry with version 2, got %+v", e)
+	}
+	if err := s.Set(ctx, "1", e); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if compareAndSet("1", e) {
+		t.Fatal("expected CompareAndSet to refuse an entry overwritten by Set")
+	}
+
+	if e, err := s.GetAndDelete(ctx, "1"); err != nil || e.Severity != "Disaster" || e.Version != 3 {
+		t.Fatalf("expected GetAndDelete to return the entry, got %+v (%v)", e, err)
+	}
+	if _, err := s.Get(ctx, "1"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected GetAndDelete to remove the entry, got %v", err)
+	}
+	if _, err := s.GetAndDelete(ctx, "1"); !errors.Is(err, store.ErrNotFound) {
+		t.Fatalf("expected GetAndDelete of a missing entry to return ErrNotFound, got %v", err)
+	}
+	if compareAndSet("1", e) {
+		t.Fatal("expected CompareAndSet not to bring a deleted entry back")
+	}
+
+	// Of callers racing on one event, exactly one wins each operation.
+	race := func(op func(n int) bool) int {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		won := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				if op(n) {
+					mu.Lock()
+					won++
+					mu.Unlock()
+				}
+			}(i)
+		}
+		wg.Wait()
+		return won
+	}
+	if n := race(func(n int) bool { return setIfAbsent("2", store.Entry{MessageID: n}) }); n != 1 {
+		t.Fatalf("expected one SetIfAbsent to win, %d did", n)
+	}
+	read, _ := s.Get(ctx, "2")
+	if n := race(func(n int) bool {
+		e := read
+		e.Reminders = n
+		return compareAndSet("2", e)
+	}); n != 1 {
+		t.Fatalf("expected one CompareAndSet to win, %d did", n)
+	}
+	if n := race(func(int) bool { _, err := s.GetAndDelete(ctx, "2"); return err == nil }); n != 1 {
+		t.Fatalf("expected one GetAndDelete to win, %d did", n)
+	}
+}
+
+func TestAtomicOps(t *testing.T) {
+	testAtomicOps(t, store.New())
+}
+
+func TestListPagination(t *testing.T) {
+	s := store.New()
+	for _, id := range []string{"10", "9", "100", "11", "2"} {
+		s.Set(t.Context(), id, store.Entry{})
+	}
+
+	var got []string
+	opts := store.ListOptions{Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not terminate")
+		}
+		records, next, err := s.List(t.Context(), opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(records) > 2 {
+			t.Fatalf("expected at most 2 records per page, got %d", len(records))
+		}
+		for _, r := range records {
+			got = append(got, r.EventID)
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+
+	want := []string{"2", "9", "10", "11", "100"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestListFilter(t *testing.T) {
+	s := store.New()
+	s.Set(t.Context(), "1", store.Entry{Severity: "High", Host: "db-01"})
+	s.Set(t.Context(), "2", store.Entry{Severity: "Disaster", Host: "db-02"})
+	s.Set(t.Context(), "3", store.Entry{Severity: "High", Host: "web-01"})
+
+	records, next, err := s.List(t.Context(), store.ListOptions{Filter: store.Filter{Severity: "high", Host: "db-*"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next != "" {
+		t.Fatalf("expected a single page, got cursor %q", next)
+	}
+	if len(records) != 1 || records[0].EventID != "1" {
+		t.Fatalf("expected only event 1, got %+v", records)
+	}
+}
+
+func TestListFilterDigest(t *testing.T) {
+	s := store.New()
+	s.Set(t.Context(), "1", store.Entry{Digest: "storm-a"})
+	s.Set(t.Context(), "2", store.Entry{Digest: "storm-b"})
+	s.Set(t.Context(), "3", store.Entry{})
+
+	records, _, err := s.List(t.Context(), store.ListOptions{Filter: store.Filter{Digest: "storm-a"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 || records[0].EventID != "1" {
+		t.Fatalf("expected only event 1, got %+v", records)
+	}
+}
+
+func TestScan(t *testing.T) {
+	s := store.New()
+	for i := 0; i < store.DefaultPageSize+5; i++ {
+		s.Set(t.Context(), fmt.Sprint(i), store.Entry{Severity: "High"})
+	}
+	s.Set(t.Context(), "other", store.Entry{Severity: "Warning"})
+
+	n := 0
+	s.Scan(t.Context(), store.Filter{Severity: "High"}, func(r store.Record) bool {
+		n++
+		return true
+	})
+	if n != store.DefaultPageSize+5 {
+		t.Fatalf("expected %d entries across pages, got %d", store.DefaultPageSize+5, n)
+	}
+
+	n = 0
+	s.Scan(t.Context(), store.Filter{}, func(r store.Record) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Fatalf("expected Scan to stop after 3 entries, got %d", n)
+	}
+}
+
+func TestEntryLegacyStartTime(t *testing.T) {
+	tests := []struct {
+		data string
+		want time.Time
+	}{
+		{`{"StartTime":"2024-05-01T10:00:03Z"}`, time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC)},
+		{`{"StartTime":"2024-05-01 10:00:03 UTC"}`, time.Date(2024, 5, 1, 10, 0, 3, 0, time.UTC)},
+		{`{"StartTime":""}`, time.Time{}},
+		{`{"StartTime":"yesterday"}`, time.Time{}},
+		{`{"Severity":"High"}`, time.Time{}},
+	}
+	for _, tt := range tests {
+		var e store.Entry
+		if err := json.Unmarshal([]byte(`{"Messages":[{"ChatID":-1,"MessageID":7}],`+tt.data[1:]), &e); err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.data, err)
+			continue
+		}
+		if !e.StartTime.Equal(tt.want) || len(e.Messages) != 1 {
+			t.Errorf("%s: got %+v, want StartTime %s", tt.data, e, tt.want)
+		}
+	}
+}
+
+func TestEntryOpenFor(t *testing.T) {
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	e := store.Entry{StartTime: start}
+	if d := e.OpenFor(start.Add(134 * time.Minute)); d != 134*time.Minute {
+		t.Errorf("expected 2h14m, got %s", d)
+	}
+	if d := (store.Entry{}).OpenFor(start); d != 0 {
+		t.Errorf("expected zero for an unknown start, got %s", d)
+	}
+}
@@ -0,0 +1,122 @@
+// Package zabbix implements a minimal client for the Zabbix JSON-RPC API,
+// covering the calls the bot makes back into Zabbix.
+package zabbix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Action is the bitmask accepted by event.acknowledge.
+type Action int
+
+const (
+	ActionClose       Action = 1
+	ActionAcknowledge Action = 2
+	ActionMessage     Action = 4
+)
+
+// Client calls the Zabbix API at a single api_jsonrpc.php endpoint.
+type Client struct {
+	url   string
+	token string
+	http  *http.Client
+	id    atomic.Int64
+}
+
+// New creates a Client for the API endpoint url (e.g.
+// "https://zabbix.example.com/api_jsonrpc.php"). token is a Zabbix API token,
+// sent as a bearer token (Zabbix 6.4 or later).
+func New(url, token string) *Client {
+	return &Client{url: url, token: token, http: &http.Client{Timeout: requestTimeout}}
+}
+
+// Error is an error object returned by the Zabbix API.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("zabbix api error %d: %s %s", e.Code, e.Message, e.Data)
+}
+
+type request struct {
+	JSONRPC string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+	ID      int64  `json:"id"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Acknowledge runs event.acknowledge for eventID with the given action
+// bitmask. message is attached to the event when action includes
+// ActionMessage.
+func (c *Client) Acknowledge(ctx context.Context, eventID string, action Action, message string) error {
+	params := map[string]any{
+		"eventids": eventID,
+		"action":   action,
+	}
+	if action&ActionMessage != 0 {
+		params["message"] = message
+	}
+	return c.call(ctx, "event.acknowledge", params, nil)
+}
+
+// call performs a single JSON-RPC request and decodes the result into out,
+// unless out is nil.
+func (c *Client) call(ctx context.Context, method string, params, out any) error {
+	body, err := json.Marshal(request{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      c.id.Add(1),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected HTTP status %s", method, resp.Status)
+	}
+
+	var rpcResp response
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return fmt.Errorf("%s: decoding response: %w", method, err)
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s: %w", method, rpcResp.Error)
+	}
+	if out != nil {
+		if err := json.Unmarshal(rpcResp.Result, out); err != nil {
+			return fmt.Errorf("%s: decoding result: %w", method, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package zabbix_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/zabbix"
+)
+
+// stubAPI starts a fake api_jsonrpc.php endpoint that records the last request
+// and replies with reply.
+func stubAPI(t *testing.T, reply string) (*httptest.Server, *map[string]any, *string) {
+	t.Helper()
+	var last map[string]any
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&last); err != nil {
+			t.Errorf("decoding request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(reply))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &last, &auth
+}
+
+func TestAcknowledge(t *testing.T) {
+	srv, last, auth := stubAPI(t, `{"jsonrpc":"2.0","result":{"eventids":["123"]},"id":1}`)
+	c := zabbix.New(srv.URL, "secret-token")
+
+	err := c.Acknowledge(context.Background(), "123", zabbix.ActionAcknowledge|zabbix.ActionMessage, "ack from telegram")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *auth != "Bearer secret-token" {
+		t.Errorf("expected bearer token, got %q", *auth)
+	}
+	req := *last
+	if req["method"] != "event.acknowledge" || req["jsonrpc"] != "2.0" {
+		t.Errorf("unexpected request: %v", req)
+	}
+	params := req["params"].(map[string]any)
+	if params["eventids"] != "123" {
+		t.Errorf("expected eventids 123, got %v", params["eventids"])
+	}
+	if params["action"] != float64(6) {
+		t.Errorf("expected action 6, got %v", params["action"])
+	}
+	if params["message"] != "ack from telegram" {
+		t.Errorf("expected message to be sent, got %v", params["message"])
+	}
+}
+
+func TestAcknowledgeWithoutMessageOmitsIt(t *testing.T) {
+	srv, last, _ := stubAPI(t, `{"jsonrpc":"2.0","result":{"eventids":["1"]},"id":1}`)
+	c := zabbix.New(srv.URL, "")
+
+	if err := c.Acknowledge(context.Background(), "1", zabbix.ActionClose, "ignored"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	params := (*last)["params"].(map[string]any)
+	if _, ok := params["message"]; ok {
+		t.Errorf("expected no message without ActionMessage, got %v", params["message"])
+	}
+}
+
+func TestAcknowledgeAPIError(t *testing.T) {
+	srv, _, _ := stubAPI(t, `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params.","data":"Cannot close problem: trigger does not allow manual closing."},"id":1}`)
+	c := zabbix.New(srv.URL, "tok")
+
+	err := c.Acknowledge(context.Background(), "1", zabbix.ActionClose, "")
+	var apiErr *zabbix.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *zabbix.Error, got %v", err)
+	}
+	if apiErr.Code != -32602 {
+		t.Errorf("expected code -32602, got %d", apiErr.Code)
+	}
+}
+
+func TestAcknowledgeHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	c := zabbix.New(srv.URL, "tok")
+
+	if err := c.Acknowledge(context.Background(), "1", zabbix.ActionAcknowledge, ""); err == nil {
+		t.Fatal("expected error on non-200 response")
+	}
+}
@@ -1,7 +1,8 @@
 // zabx_telegram_bot receives Zabbix trigger alerts over HTTP and forwards
-// them to a Telegram group chat via the Bot API. When a trigger transitions
-// from PROBLEM to RESOLVED the original Telegram message is edited in-place
-// rather than posting a duplicate.
+// them to one or more Telegram group chats via the Bot API. When a trigger
+// transitions from PROBLEM to RESOLVED the original Telegram messages are
+// edited in-place rather than posting duplicates. Messages are paced to stay
+// within Telegram's rate limits, most severe first.
 //
 // Configuration is read from an optional YAML file (default: config.yaml,
 // overridable via CONFIG_FILE) and/or environment variables. Environment
@@ -10,29 +11,83 @@
 // Required (env var or config file):
 //
 //	TELEGRAM_BOT_TOKEN – bot token from BotFather
-//	TELEGRAM_CHAT_ID   – numeric ID of the target group chat
+//	TELEGRAM_CHAT_ID   – numeric ID of the default target group chat
 //
 // Optional:
 //
+//	TELEGRAM_THREAD_ID – forum topic (message_thread_id) within the default chat
+//	TELEGRAM_UPDATES – poll Telegram for commands and button presses (default true)
 //	SERVER_ADDR     – listen address for the HTTP server (default ":8080")
 //	CONFIG_FILE     – path to the YAML configuration file (default "config.yaml")
-//	REDIS_ADDR      – host:port of a Redis-compatible server for persistent storage
+//	REDIS_ADDR      – host:port or redis:// / rediss:// URL of a Redis-compatible
+//	                  server for persistent storage
+//	REDIS_SENTINEL_MASTER, REDIS_SENTINEL_ADDRS – Sentinel master name and the
+//	                  comma-separated Sentinel addresses, instead of REDIS_ADDR
+//	REDIS_SENTINEL_USERNAME, REDIS_SENTINEL_PASSWORD – credentials of the
+//	                  Sentinels; REDIS_USERNAME and REDIS_PASSWORD are only
+//	                  sent to the Redis servers (optional)
+//	REDIS_CLUSTER   – REDIS_ADDR lists seed nodes of a Redis Cluster
+//	REDIS_USERNAME  – ACL user for the Redis servers (optional)
 //	REDIS_PASSWORD  – password for the Redis server (optional)
 //	REDIS_DB        – Redis database index (default 0)
+//	REDIS_KEY_PREFIX – namespace of the Redis keys (default "zbxtg:event:")
+//	REDIS_ENTRY_TTL – maximum age of a stored PROBLEM entry (e.g. "168h")
+//	REDIS_MIGRATE_KEYS – move un-prefixed keys of older releases at startup
+//	REDIS_TLS       – connect to Redis over TLS, optionally with
+//	                  REDIS_TLS_CA_FILE, REDIS_TLS_CERT_FILE and REDIS_TLS_KEY_FILE
+//	STORE_PATH      – database file for persistent storage without Redis
+//	OUTBOX_ENABLED  – queue alerts and deliver them in the background (default
+//	                  true with REDIS_ADDR, REDIS_SENTINEL_MASTER or STORE_PATH)
+//	OUTBOX_MAX_ATTEMPTS – delivery attempts before an alert is dead-lettered (default 10)
+//	OUTBOX_CONSUMER – stable name of this process on a shared Redis outbox
+//	STORM_THRESHOLD – PROBLEMs per STORM_WINDOW (default "1m") above which they
+//	                  are aggregated into one digest message per chat
+//	STORM_DIGEST_INTERVAL – minimum time between digest edits (default "10s")
+//	FLAP_THRESHOLD  – state changes of a trigger per FLAP_WINDOW (default "30m")
+//	                  above which it is collapsed into one counter message
+//	REMINDER_INTERVALS – "still open" reminder interval by severity
+//	                  (e.g. "Disaster=30m,High=1h,default=4h")
+//	REMINDER_MAX    – reminders per problem (default 3)
+//	TIME_ZONE       – IANA time zone of displayed timestamps (default: local)
+//	TIME_LAYOUT     – Go layout of displayed timestamps (default "2006-01-02 15:04:05 MST")
+//	MESSAGE_LANGUAGE – language of the message labels: en, it or de (default "en")
+//	DETAILS_DOCUMENT – send Details too long for a message as a .txt reply
+//	ZABBIX_API_URL  – Zabbix API endpoint; enables the Ack / Close buttons
+//	ZABBIX_API_TOKEN – Zabbix API token used for event.acknowledge
+//
+// Alerts can be routed to further chats by severity, host and trigger name
+// through the "routes" table of the YAML file, and problems left open can be
+// escalated to further chats through its "escalations" list. The message
+// layout can be replaced, globally and per route, by Go templates given in
+// its "templates" maps.
 //
 // Endpoint:
 //
 //	POST /zabbix/alert  – receive a Zabbix alert JSON payload
+//	GET  /outbox/dead   – list the alerts that could not be delivered
+//
+// Bot commands (in any configured chat):
+//
+//	/active             – list the open problems
+//	/problem <event_id> – re-post an open problem and link to its message
+//	/status             – uptime, store backend, queues and counts
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"os"
+	"strings"
 
 	"github.com/mgarbin/zabbix-telegram-event-correlator/config"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/bot"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/escalation"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/handler"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/outbox"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/router"
 	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/store"
+	"github.com/mgarbin/zabbix-telegram-event-correlator/internal/zabbix"
 )
 
 func main() {
@@ -41,30 +96,182 @@ func main() {
 		log.Fatalf("configuration error: %v", err)
 	}
 
-	tgBot, err := bot.New(cfg.TelegramToken, cfg.ChatID)
+	tgBot, err := bot.New(cfg.TelegramToken)
 	if err != nil {
 		log.Fatalf("failed to create Telegram bot: %v", err)
 	}
 
+	// All messages go through the scheduler so alert storms stay within
+	// Telegram's rate limits instead of failing with 429.
+	sender := bot.NewScheduler(tgBot)
+	go sender.Run(context.Background())
+
+	alertRouter, err := router.New(cfg.Routes, router.Destination{ChatID: cfg.ChatID, ThreadID: cfg.ThreadID})
+	if err != nil {
+		log.Fatalf("routing configuration error: %v", err)
+	}
+
 	var msgStore store.Store
-	if cfg.RedisAddr != "" {
-		log.Printf("using Redis store at %s (db %d)", cfg.RedisAddr, cfg.RedisDB)
-		rs := store.NewRedisStore(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+	var queue outbox.Queue = outbox.NewMemoryQueue()
+	if cfg.RedisAddr != "" || cfg.RedisSentinelMaster != "" {
+		addrs := cfg.RedisSentinelAddrs
+		if cfg.RedisSentinelMaster == "" {
+			addrs = strings.Split(strings.ReplaceAll(cfg.RedisAddr, " ", ""), ",")
+		}
+		rs, err := store.NewRedisStoreFrom(store.RedisConfig{
+			Addrs:            addrs,
+			MasterName:       cfg.RedisSentinelMaster,
+			Cluster:          cfg.RedisCluster,
+			Username:         cfg.RedisUsername,
+			Password:         cfg.RedisPassword,
+			SentinelUsername: cfg.RedisSentinelUsername,
+			SentinelPassword: cfg.RedisSentinelPassword,
+			DB:               cfg.RedisDB,
+			TLS:              cfg.RedisTLS,
+			CAFile:           cfg.RedisTLSCA,
+			CertFile:         cfg.RedisTLSCert,
+			KeyFile:          cfg.RedisTLSKey,
+		}, store.WithKeyPrefix(cfg.RedisKeyPrefix), store.WithTTL(cfg.RedisEntryTTL))
+		if err != nil {
+			log.Fatalf("Redis configuration error: %v", err)
+		}
+		log.Printf("using Redis store at %s", rs)
 		if err := rs.Ping(); err != nil {
 			log.Fatalf("Redis connectivity check failed: %v", err)
 		}
+		if cfg.RedisMigrateKeys {
+			n, err := rs.MigrateLegacyKeys()
+			if err != nil {
+				log.Fatalf("Redis key migration failed after %d key(s): %v", n, err)
+			}
+			log.Printf("migrated %d legacy Redis key(s) to prefix %q", n, cfg.RedisKeyPrefix)
+		}
 		msgStore = rs
+		queue = outbox.NewRedisQueue(rs.Client(), outbox.DefaultRedisKey, outboxConsumer(cfg.OutboxConsumer))
+	} else if cfg.StorePath != "" {
+		log.Printf("using embedded store at %s", cfg.StorePath)
+		bs, err := store.NewBoltStore(cfg.StorePath)
+		if err != nil {
+			log.Fatalf("failed to open store: %v", err)
+		}
+		msgStore = bs
+		bq, err := outbox.NewBoltQueue(bs.DB())
+		if err != nil {
+			log.Fatalf("failed to open outbox: %v", err)
+		}
+		queue = bq
 	} else {
 		msgStore = store.New()
+		if cfg.OutboxEnabled {
+			log.Printf("WARNING the outbox is held in memory: alerts queued when the process stops are lost")
+		}
+	}
+
+	opts := []handler.Option{handler.WithDisplayTime(cfg.TimeZone, cfg.TimeLayout)}
+	if cfg.ZabbixAPIURL != "" {
+		log.Printf("Ack / Close buttons enabled (Zabbix API at %s)", cfg.ZabbixAPIURL)
+		opts = append(opts, handler.WithAcknowledger(zabbix.New(cfg.ZabbixAPIURL, cfg.ZabbixAPIToken)))
+	}
+
+	if cfg.StormThreshold > 0 {
+		log.Printf("storm digest enabled above %d PROBLEMs per %s", cfg.StormThreshold, cfg.StormWindow)
+		opts = append(opts, handler.WithStormDigest(cfg.StormThreshold, cfg.StormWindow, cfg.StormDigestInterval))
+	}
+
+	if cfg.FlapThreshold > 0 {
+		log.Printf("flap detection enabled above %d transitions per %s", cfg.FlapThreshold, cfg.FlapWindow)
+		opts = append(opts, handler.WithFlapDetection(cfg.FlapThreshold, cfg.FlapWindow))
+	}
+
+	if len(cfg.ReminderIntervals) > 0 {
+		log.Printf("reminders enabled (at most %d per problem)", cfg.ReminderMax)
+		opts = append(opts, handler.WithReminders(cfg.ReminderIntervals, cfg.ReminderMax))
+	}
+
+	if len(cfg.Escalations) > 0 {
+		policies, err := escalation.New(cfg.Escalations)
+		if err != nil {
+			log.Fatalf("escalation configuration error: %v", err)
+		}
+		log.Printf("%d escalation polic(ies) enabled", len(cfg.Escalations))
+		opts = append(opts, handler.WithEscalations(policies))
 	}
 
-	alertHandler := handler.New(tgBot, msgStore, cfg.ServerSecret)
+	if cfg.DetailsDocument {
+		opts = append(opts, handler.WithDetailsDocument())
+	}
+
+	languages, err := handler.NewLanguages(cfg.Language, cfg.Routes)
+	if err != nil {
+		log.Fatalf("language configuration error: %v", err)
+	}
+	opts = append(opts, handler.WithLanguages(languages))
+
+	if templatesConfigured(cfg) {
+		templates, err := handler.NewTemplates(cfg.Templates, cfg.Routes)
+		if err != nil {
+			log.Fatalf("template configuration error: %v", err)
+		}
+		log.Printf("message templates enabled")
+		opts = append(opts, handler.WithTemplates(templates))
+	}
+
+	var alertHandler *handler.Handler
+	var alertOutbox *outbox.Outbox
+	if cfg.OutboxEnabled {
+		alertOutbox = outbox.New(queue, func(payload []byte) error { return alertHandler.Deliver(payload) },
+			outbox.WithMaxAttempts(cfg.OutboxMaxAttempts),
+			outbox.WithRetryAfter(bot.RetryAfter),
+		)
+		opts = append(opts, handler.WithOutbox(alertOutbox))
+	}
+
+	alertHandler = handler.New(sender, msgStore, alertRouter, cfg.ServerSecret, opts...)
+
+	if cfg.TelegramUpdates {
+		go tgBot.Listen(alertHandler)
+	} else if cfg.ZabbixAPIURL != "" {
+		log.Printf("WARNING Telegram updates are disabled: Ack / Close buttons will not respond")
+	}
+
+	go alertHandler.RunReminders(context.Background())
+	go alertHandler.RunEscalations(context.Background())
 
 	mux := http.NewServeMux()
 	mux.Handle("/zabbix/alert", alertHandler)
+	if alertOutbox != nil {
+		go alertOutbox.Run(context.Background())
+		mux.Handle("/outbox/dead", alertOutbox.DeadLetterHandler(cfg.ServerSecret))
+	}
 
 	log.Printf("zabbix-telegram-event-correlator listening on %s", cfg.ServerAddr)
 	if err := http.ListenAndServe(cfg.ServerAddr, mux); err != nil {
 		log.Fatalf("HTTP server error: %v", err)
 	}
 }
+
+// outboxConsumer returns the configured consumer name, or the host name.
+func outboxConsumer(name string) string {
+	if name != "" {
+		return name
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "default"
+	}
+	return host
+}
+
+// templatesConfigured reports whether any message template is configured,
+// globally or on a route.
+func templatesConfigured(cfg *config.Config) bool {
+	if len(cfg.Templates) > 0 {
+		return true
+	}
+	for _, r := range cfg.Routes {
+		if len(r.Templates) > 0 {
+			return true
+		}
+	}
+	return false
+}
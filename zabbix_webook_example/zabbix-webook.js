@@ -11,10 +11,19 @@ try {
       status:       rawReq.status,
       severity:     rawReq.severity,
       host:         rawReq.host,
+      host_group:   rawReq.hostGroup,
       event_id:     rawReq.eventId,
+      trigger_id:   rawReq.triggerId,
       trigger_name: rawReq.eventName,
       message:      rawReq.message,
-      secret:       rawReq.ZbxNotifierKey
+      secret:       rawReq.ZbxNotifierKey,
+      update_user:    rawReq.updateUser,
+      update_action:  rawReq.updateAction,
+      update_message: rawReq.updateMessage,
+      event_date:          rawReq.eventDate,
+      event_time:          rawReq.eventTime,
+      event_recovery_date: rawReq.eventRecoveryDate,
+      event_recovery_time: rawReq.eventRecoveryTime
     });
 
     Zabbix.log(4, "[Webhook] Body: " + body);